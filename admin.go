@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/waucka/testflight-demo/client"
+	api "github.com/waucka/testflight-demo/internal"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"os"
+	"path/filepath"
+)
+
+var errUsage = errors.New("bad usage")
+
+//runAdmin handles the user/channel/org/item/blob subcommands.  They talk to
+//MongoDB directly through the same store functions the API uses.
+func runAdmin(command string, args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	action := args[0]
+	settings, rest, err := LoadSettingsWithArgs(os.Args[0]+" "+command+" "+action, args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	session, err := dial(settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't connect to MongoDB:", err)
+		return 1
+	}
+	defer session.Close()
+	db := session.DB(settings.DBName)
+	backend, err := settings.NewBlobBackend(session)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't set up the blob store:", err)
+		return 1
+	}
+	blobs := api.NewBlobStore(backend)
+
+	switch command {
+	case "user":
+		err = adminUser(db, action, rest)
+	case "channel":
+		err = adminChannel(db, action, rest)
+	case "org":
+		err = adminOrg(db, action, rest)
+	case "item":
+		err = adminItem(db, blobs, action, rest)
+	case "blob":
+		err = adminBlob(db, blobs, action, rest, func(name string) (api.BlobBackend, error) {
+			return settings.newBlobBackendNamed(session, name)
+		})
+	}
+	if err == errUsage {
+		usage()
+		return 2
+	} else if err == mgo.ErrNotFound {
+		fmt.Fprintln(os.Stderr, "Not found")
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func adminUser(db *mgo.Database, action string, args []string) error {
+	switch {
+	case action == "add" && len(args) == 1:
+		_, err := api.InsertUser(db, args[0])
+		return err
+	case action == "list" && len(args) == 0:
+		users, err := api.ListUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Println(user.Username)
+		}
+		return nil
+	case action == "delete" && len(args) == 1:
+		return api.RemoveUser(db, args[0])
+	case action == "totp-reset" && len(args) == 1:
+		//For users who lost both their authenticator and their recovery
+		//codes.
+		return api.DisableTOTP(db, args[0])
+	}
+	return errUsage
+}
+
+func adminChannel(db *mgo.Database, action string, args []string) error {
+	switch {
+	case action == "add" && len(args) == 3:
+		slug, title, owner := args[0], args[1], args[2]
+		if org, _ := api.SplitChannelSlug(slug); org != "" {
+			return errors.New("organization channels are created through the API")
+		}
+		_, err := api.FindUser(db, owner)
+		if err == mgo.ErrNotFound {
+			return errors.New("no such user " + owner)
+		} else if err != nil {
+			return err
+		}
+		_, err = api.InsertChannel(db, slug, title, owner)
+		return err
+	case action == "list" && len(args) == 0:
+		channels, err := api.ListChannels(db)
+		if err != nil {
+			return err
+		}
+		for _, chanrec := range channels {
+			fmt.Printf("%s\t%s\t%s\t%s\t%d items\n", chanrec.Slug, chanrec.Title, chanrec.Owner, chanrec.GetVisibility(), len(chanrec.Items))
+		}
+		return nil
+	case action == "delete" && len(args) == 1:
+		return api.RemoveChannel(db, args[0])
+	}
+	return errUsage
+}
+
+//adminOrg's "member" action sets anyone's role, so that an organization
+//whose admins have all gone can be given a new one.
+func adminOrg(db *mgo.Database, action string, args []string) error {
+	switch {
+	case action == "add" && len(args) == 3:
+		name, title, admin := args[0], args[1], args[2]
+		_, err := api.FindUser(db, admin)
+		if err == mgo.ErrNotFound {
+			return errors.New("no such user " + admin)
+		} else if err != nil {
+			return err
+		}
+		_, err = api.InsertOrg(db, name, title, admin)
+		return err
+	case action == "list" && len(args) == 0:
+		orgs, err := api.ListOrgs(db)
+		if err != nil {
+			return err
+		}
+		for _, orgrec := range orgs {
+			fmt.Printf("%s\t%s\t%d members\n", orgrec.Name, orgrec.Title, len(orgrec.Members))
+		}
+		return nil
+	case action == "member" && len(args) == 3:
+		name, username := args[0], args[1]
+		role, err := api.ParseOrgRole(args[2])
+		if err != nil {
+			return err
+		}
+		_, err = api.FindUser(db, username)
+		if err == mgo.ErrNotFound {
+			return errors.New("no such user " + username)
+		} else if err != nil {
+			return err
+		}
+		_, err = api.SetOrgMember(db, name, username, role)
+		return err
+	}
+	return errUsage
+}
+
+func adminItem(db *mgo.Database, blobs *api.BlobStore, action string, args []string) error {
+	switch {
+	case action == "import" && len(args) >= 2 && len(args) <= 4:
+		chanSlug, path := args[0], args[1]
+		slug := client.SlugFromFilename(path)
+		if len(args) > 2 {
+			slug = args[2]
+		}
+		title := filepath.Base(path)
+		if len(args) > 3 {
+			title = args[3]
+		}
+		if slug == "" {
+			return errors.New("cannot derive an item slug from " + path)
+		}
+		chanrec, err := api.FindChannel(db, chanSlug)
+		if err != nil {
+			return err
+		}
+		if chanrec.FindItem(slug) != nil {
+			return errors.New("channel " + chanSlug + " already has an item " + slug)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		uploader, err := importUploader(db, chanrec)
+		if err != nil {
+			return err
+		}
+		itemrec := api.NewItem(slug, title, base64.StdEncoding.EncodeToString(data), uploader)
+		err = api.CheckItem(chanrec, itemrec)
+		if err != nil {
+			return err
+		}
+		err = api.ProcessItem(chanrec, itemrec)
+		if err != nil {
+			return err
+		}
+		err = api.ImportItem(db, blobs, chanSlug, itemrec)
+		if err != nil {
+			return err
+		}
+		fmt.Println(api.ChannelPath(chanSlug) + "/item/" + slug)
+		return nil
+	case action == "export" && (len(args) == 2 || len(args) == 3):
+		chanSlug, slug := args[0], args[1]
+		chanrec, err := api.FindChannel(db, chanSlug)
+		if err != nil {
+			return err
+		}
+		item := chanrec.FindItem(slug)
+		if item == nil {
+			return mgo.ErrNotFound
+		}
+		data, err := blobs.ReadItem(db, item)
+		if err != nil {
+			return errors.New("cannot read the data of item " + slug + ": " + err.Error())
+		}
+		if len(args) == 3 && args[2] != "-" {
+			return ioutil.WriteFile(args[2], data, 0644)
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return errUsage
+}
+
+//adminBlob's openBackend makes the backend of a given name from the
+//settings, for migrating blobs out of it.
+//importUploader is who an imported item is credited to: the channel's
+//owner, or for an organization channel, which has none, the
+//organization's first admin.
+func importUploader(db *mgo.Database, chanrec *api.ChannelDBRecord) (string, error) {
+	org, _ := api.SplitChannelSlug(chanrec.Slug)
+	if org == "" {
+		return chanrec.Owner, nil
+	}
+	orgrec, err := api.FindOrg(db, org)
+	if err != nil {
+		return "", err
+	}
+	for _, member := range orgrec.Members {
+		if member.Role == api.OrgRoleAdmin {
+			return member.Username, nil
+		}
+	}
+	return "", errors.New("organization " + org + " has no admin to credit the item to")
+}
+
+func adminBlob(db *mgo.Database, blobs *api.BlobStore, action string, args []string, openBackend func(string) (api.BlobBackend, error)) error {
+	switch {
+	case action == "gc" && len(args) == 0:
+		removed, err := blobs.Collect(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %d unused blobs\n", removed)
+		return nil
+	case action == "migrate" && len(args) == 0:
+		moved, err := blobs.MigrateItems(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved the data of %d items into the blob store\n", moved)
+		others, err := blobs.ForeignBackends(db)
+		if err != nil {
+			return err
+		}
+		for _, name := range others {
+			if name == "" {
+				return errors.New("some blobs don't record their backend; run blob migrate once with the backend they were stored with")
+			}
+			from, err := openBackend(name)
+			if err != nil {
+				return fmt.Errorf("could not open the %s backend: %s", name, err.Error())
+			}
+			moved, err = blobs.MigrateBlobs(db, from)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Moved %d blobs from the %s backend\n", moved, name)
+		}
+		return nil
+	}
+	return errUsage
+}
@@ -0,0 +1,427 @@
+//Package client talks to the channel API over HTTP.  It only depends on
+//the standard library, so it is cheap to import from tools and bots.
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Channel struct {
+	Slug         string   `json:"slug"`
+	Title        string   `json:"title"`
+	Items        []*Item  `json:"items"`
+	StripEXIF    bool     `json:"strip_exif"`
+	AllowedTypes []string `json:"allowed_types"`
+	MaxItemBytes int64    `json:"max_item_bytes"`
+	Visibility   string   `json:"visibility"`
+	Org          string   `json:"org,omitempty"`
+}
+
+type Item struct {
+	Slug         string    `json:"slug"`
+	Title        string    `json:"title"`
+	DateUploaded time.Time `json:"date_uploaded"`
+	Uploader     string    `json:"uploader"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	Hash         string    `json:"hash,omitempty"`
+	//SourceHash is set when the server stripped metadata from the data
+	//it was sent; it is the hash of what was sent.
+	SourceHash string        `json:"source_hash,omitempty"`
+	Metadata   *ItemMetadata `json:"metadata,omitempty"`
+}
+
+//ItemMetadata is what the server found out about an image item.
+type ItemMetadata struct {
+	Width       int        `json:"width"`
+	Height      int        `json:"height"`
+	CaptureTime *time.Time `json:"capture_time,omitempty"`
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	Location    *Location  `json:"location,omitempty"`
+}
+
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+//Error is a non-2xx response from the server.  Message, Info and Code
+//come from the JSON error report the server sends with failures; Code
+//is only set for errors a client might want to handle specially, such
+//as "type_not_allowed".
+type Error struct {
+	StatusCode int
+	Message    string
+	Info       string
+	Code       string
+}
+
+func (self *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", self.StatusCode, http.StatusText(self.StatusCode), self.Message)
+}
+
+func hasStatus(err error, status int) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == status
+}
+
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+func IsBadRequest(err error) bool {
+	return hasStatus(err, http.StatusBadRequest)
+}
+
+type Client struct {
+	//BaseURL is the server root, e.g. "https://channels.example.com".
+	BaseURL  string
+	Username string
+	Secret   string
+	//APIKey, if set, is used instead of Username and Secret.
+	APIKey string
+	//HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	//Retries is how many extra attempts a GET gets after a network error
+	//or a 502/503/504.  Uploads are never retried.
+	Retries    int
+	RetryDelay time.Duration
+}
+
+func New(baseURL, username, secret string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Username:   username,
+		Secret:     secret,
+		HTTPClient: http.DefaultClient,
+		Retries:    2,
+		RetryDelay: 500 * time.Millisecond,
+	}
+}
+
+//channelPath knows that an organization's channels, with slugs like
+//"acme/holiday", live under /org/acme.
+func channelPath(slug string) string {
+	if i := strings.Index(slug, "/"); i >= 0 {
+		return "/org/" + url.PathEscape(slug[:i]) + "/channel/" + url.PathEscape(slug[i+1:])
+	}
+	return "/channel/" + url.PathEscape(slug)
+}
+
+func itemPath(chanSlug, itemSlug string) string {
+	return channelPath(chanSlug) + "/item/" + url.PathEscape(itemSlug)
+}
+
+func (self *Client) newRequest(ctx context.Context, verb, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(verb, self.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if self.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+self.APIKey)
+	} else if self.Username != "" {
+		req.Header.Set("Authorization", "Bearer "+self.Secret+":"+self.Username)
+	}
+	return req, nil
+}
+
+func retryable(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+//get performs a GET, retrying transient failures.  The caller must close
+//the returned body.
+func (self *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	delay := self.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := self.newRequest(ctx, "GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err := self.httpClient().Do(req)
+		if err == nil && !retryable(response.StatusCode) {
+			return checkResponse(response)
+		}
+		if attempt >= self.Retries || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return checkResponse(response)
+		}
+		if err == nil {
+			response.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (self *Client) do(req *http.Request) (*http.Response, error) {
+	response, err := self.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return checkResponse(response)
+}
+
+func (self *Client) httpClient() *http.Client {
+	if self.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return self.HTTPClient
+}
+
+//checkResponse turns non-2xx responses into an *Error.
+func checkResponse(response *http.Response) (*http.Response, error) {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	apiErr := &Error{StatusCode: response.StatusCode}
+	var report struct {
+		Error string `json:"error"`
+		Info  string `json:"info"`
+		Code  string `json:"code"`
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if json.Unmarshal(body, &report) == nil && report.Error != "" {
+		apiErr.Message = report.Error
+		apiErr.Info = report.Info
+		apiErr.Code = report.Code
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return nil, apiErr
+}
+
+func (self *Client) getJSON(ctx context.Context, path string, result interface{}) error {
+	response, err := self.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (self *Client) postForm(ctx context.Context, path string, params url.Values) (string, error) {
+	req, err := self.newRequest(ctx, "POST", path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := self.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	return string(body), err
+}
+
+//ListChannels returns the title of every channel, keyed by slug.
+func (self *Client) ListChannels(ctx context.Context) (map[string]string, error) {
+	channels := make(map[string]string)
+	err := self.getJSON(ctx, "/channel", &channels)
+	return channels, err
+}
+
+func (self *Client) CreateChannel(ctx context.Context, slug, title string) error {
+	params := url.Values{}
+	params.Set("slug", slug)
+	params.Set("title", title)
+	_, err := self.postForm(ctx, "/channel", params)
+	return err
+}
+
+func (self *Client) GetChannel(ctx context.Context, slug string) (*Channel, error) {
+	var channel Channel
+	err := self.getJSON(ctx, channelPath(slug), &channel)
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+//ListItems returns the title of every item in a channel, keyed by slug.
+func (self *Client) ListItems(ctx context.Context, chanSlug string) (map[string]string, error) {
+	items := make(map[string]string)
+	err := self.getJSON(ctx, channelPath(chanSlug)+"/item", &items)
+	return items, err
+}
+
+func (self *Client) GetItem(ctx context.Context, chanSlug, itemSlug string) (*Item, error) {
+	var item Item
+	err := self.getJSON(ctx, itemPath(chanSlug, itemSlug), &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+//UploadItem stores the contents of data as an item in a channel and
+//returns the item's path on the server.  An existing item with the same
+//slug is replaced.  The body is streamed, so data
+//is never held in memory all at once.
+func (self *Client) UploadItem(ctx context.Context, chanSlug, itemSlug, title string, data io.Reader) (string, error) {
+	params := url.Values{}
+	params.Set("itemSlug", itemSlug)
+	params.Set("title", title)
+
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		_, err := io.WriteString(bodyWriter, params.Encode()+"&b64data=")
+		if err == nil {
+			//Base64 only needs '+', '/' and '=' escaped in a form body.
+			encoder := base64.NewEncoder(base64.StdEncoding, &formEscaper{bodyWriter})
+			_, err = io.Copy(encoder, data)
+			if err == nil {
+				err = encoder.Close()
+			}
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	req, err := self.newRequest(ctx, "POST", channelPath(chanSlug)+"/item", bodyReader)
+	if err != nil {
+		bodyReader.Close()
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := self.do(req)
+	bodyReader.Close()
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	location, err := ioutil.ReadAll(response.Body)
+	return string(location), err
+}
+
+func (self *Client) DeleteItem(ctx context.Context, chanSlug, itemSlug string) error {
+	req, err := self.newRequest(ctx, "DELETE", itemPath(chanSlug, itemSlug), nil)
+	if err != nil {
+		return err
+	}
+	response, err := self.do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+//ExportChannel writes a tar archive of a channel and its items to w.
+func (self *Client) ExportChannel(ctx context.Context, chanSlug string, w io.Writer) error {
+	response, err := self.get(ctx, channelPath(chanSlug)+"/export")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+//ImportChannel uploads an archive made by ExportChannel into chanSlug,
+//creating the channel if needed.
+func (self *Client) ImportChannel(ctx context.Context, chanSlug string, archive io.Reader) error {
+	req, err := self.newRequest(ctx, "POST", channelPath(chanSlug)+"/import", archive)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	response, err := self.do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+//DownloadItem writes the decoded contents of an item to w.
+func (self *Client) DownloadItem(ctx context.Context, chanSlug, itemSlug string, w io.Writer) error {
+	response, err := self.get(ctx, itemPath(chanSlug, itemSlug)+"/data")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, base64.NewDecoder(base64.StdEncoding, response.Body))
+	return err
+}
+
+//DownloadResized writes a resized copy of an image item to w.  fit is
+//"contain", "cover" or "fill" ("" means contain); width and height must
+//be 64, 128, 256, 512, 1024 or 2048, or 0 to keep the aspect ratio.  JPEGs come back as JPEGs and other images
+//as PNGs.
+func (self *Client) DownloadResized(ctx context.Context, chanSlug, itemSlug string, width, height int, fit string, w io.Writer) error {
+	query := url.Values{}
+	if width > 0 {
+		query.Set("w", strconv.Itoa(width))
+	}
+	if height > 0 {
+		query.Set("h", strconv.Itoa(height))
+	}
+	if fit != "" {
+		query.Set("fit", fit)
+	}
+	response, err := self.get(ctx, itemPath(chanSlug, itemSlug)+"/data?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, base64.NewDecoder(base64.StdEncoding, response.Body))
+	return err
+}
+
+//formEscaper percent-encodes the characters of base64 output that mean
+//something in an application/x-www-form-urlencoded body.
+type formEscaper struct {
+	w io.Writer
+}
+
+func (self *formEscaper) Write(p []byte) (int, error) {
+	escaped := make([]byte, 0, len(p)+len(p)/8)
+	for _, b := range p {
+		switch b {
+		case '+':
+			escaped = append(escaped, "%2B"...)
+		case '/':
+			escaped = append(escaped, "%2F"...)
+		case '=':
+			escaped = append(escaped, "%3D"...)
+		default:
+			escaped = append(escaped, b)
+		}
+	}
+	_, err := self.w.Write(escaped)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
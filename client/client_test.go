@@ -0,0 +1,243 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	api "github.com/waucka/testflight-demo/internal"
+	. "gopkg.in/check.v1"
+	"image/jpeg"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientSuite struct {
+	session   *mgo.Session
+	apiConfig *api.Config
+	server    *httptest.Server
+	client    *Client
+}
+
+var _ = Suite(&ClientSuite{})
+
+const testDB = "client-testing"
+
+func (self *ClientSuite) SetUpSuite(c *C) {
+	mongoHost := os.Getenv("MONGO_HOST")
+	c.Assert(len(mongoHost) > 0, Equals, true)
+	session, err := mgo.Dial("mongodb://" + mongoHost)
+	c.Assert(err, IsNil)
+	self.session = session
+
+	db := session.DB(testDB)
+	_, err = api.InsertUser(db, "clientuser")
+	c.Assert(err, IsNil)
+	_, err = api.InsertUser(db, "otheruser")
+	c.Assert(err, IsNil)
+	_, err = api.InsertChannel(db, "client-channel", "Client Channel", "clientuser")
+	c.Assert(err, IsNil)
+
+	self.apiConfig = api.NewConfig(session, testDB, api.DefaultOptions())
+	self.server = httptest.NewServer(self.apiConfig.GetRouter())
+	self.client = New(self.server.URL, "clientuser", "SUP3R_S33CR37")
+	self.client.RetryDelay = 10 * time.Millisecond
+}
+
+func (self *ClientSuite) TearDownSuite(c *C) {
+	self.server.Close()
+	err := self.session.DB(testDB).DropDatabase()
+	c.Assert(err, IsNil)
+	self.session.Close()
+}
+
+func (self *ClientSuite) TestListChannels(c *C) {
+	channels, err := self.client.ListChannels(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(channels["client-channel"], Equals, "Client Channel")
+}
+
+func (self *ClientSuite) TestCreateAndGetChannel(c *C) {
+	ctx := context.Background()
+	err := self.client.CreateChannel(ctx, "created-by-client", "Created By Client")
+	c.Assert(err, IsNil)
+	channel, err := self.client.GetChannel(ctx, "created-by-client")
+	c.Assert(err, IsNil)
+	c.Assert(channel.Slug, Equals, "created-by-client")
+	c.Assert(channel.Title, Equals, "Created By Client")
+
+	err = self.client.CreateChannel(ctx, "created-by-client", "Again")
+	c.Assert(IsBadRequest(err), Equals, true)
+}
+
+func (self *ClientSuite) TestTypedErrors(c *C) {
+	ctx := context.Background()
+	_, err := self.client.GetChannel(ctx, "nosuchchannel")
+	c.Assert(IsNotFound(err), Equals, true)
+	apiErr, ok := err.(*Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(apiErr.Message, Equals, "No such channel nosuchchannel")
+
+	stranger := New(self.server.URL, "nosuchuser", "SUP3R_S33CR37")
+	_, err = stranger.ListChannels(ctx)
+	c.Assert(IsUnauthorized(err), Equals, true)
+
+	other := New(self.server.URL, "otheruser", "SUP3R_S33CR37")
+	_, err = other.UploadItem(ctx, "client-channel", "nope", "Nope", bytes.NewReader([]byte("nope")))
+	c.Assert(IsForbidden(err), Equals, true)
+}
+
+func (self *ClientSuite) TestUploadAndDownload(c *C) {
+	ctx := context.Background()
+	raw, err := ioutil.ReadFile(filepath.Join(os.Getenv("TEST_DATADIR"), "item2.jpg"))
+	c.Assert(err, IsNil)
+
+	location, err := self.client.UploadItem(ctx, "client-channel", "uploaded", "Uploaded", bytes.NewReader(raw))
+	c.Assert(err, IsNil)
+	c.Assert(location, Equals, "/channel/client-channel/item/uploaded")
+
+	items, err := self.client.ListItems(ctx, "client-channel")
+	c.Assert(err, IsNil)
+	c.Assert(items["uploaded"], Equals, "Uploaded")
+
+	item, err := self.client.GetItem(ctx, "client-channel", "uploaded")
+	c.Assert(err, IsNil)
+	c.Assert(item.Uploader, Equals, "clientuser")
+
+	var downloaded bytes.Buffer
+	err = self.client.DownloadItem(ctx, "client-channel", "uploaded", &downloaded)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(downloaded.Bytes(), raw), Equals, true)
+
+	var resized bytes.Buffer
+	err = self.client.DownloadResized(ctx, "client-channel", "uploaded", 128, 0, "", &resized)
+	c.Assert(err, IsNil)
+	config, err := jpeg.DecodeConfig(&resized)
+	c.Assert(err, IsNil)
+	c.Assert(config.Width, Equals, 128)
+}
+
+func (self *ClientSuite) TestRetries(c *C) {
+	failures := 2
+	attempts := 0
+	router := self.apiConfig.GetRouter()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	client := New(flaky.URL, "clientuser", "SUP3R_S33CR37")
+	client.RetryDelay = time.Millisecond
+	_, err := client.ListChannels(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 3)
+
+	attempts = 0
+	client.Retries = 1
+	_, err = client.ListChannels(context.Background())
+	c.Assert(hasStatus(err, http.StatusServiceUnavailable), Equals, true)
+	c.Assert(attempts, Equals, 2)
+}
+
+func (self *ClientSuite) TestContextCancel(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := self.client.ListChannels(ctx)
+	c.Assert(err, NotNil)
+}
+
+func (self *ClientSuite) TestSyncDir(c *C) {
+	ctx := context.Background()
+	db := self.session.DB(testDB)
+	_, err := api.InsertChannel(db, "sync-channel", "Sync Channel", "clientuser")
+	c.Assert(err, IsNil)
+	_, err = self.client.UploadItem(ctx, "sync-channel", "stale", "stale.txt", bytes.NewReader([]byte("stale")))
+	c.Assert(err, IsNil)
+	_, err = self.client.UploadItem(ctx, "sync-channel", "changed", "changed.txt", bytes.NewReader([]byte("old")))
+	c.Assert(err, IsNil)
+	_, err = self.client.UploadItem(ctx, "sync-channel", "same", "same.txt", bytes.NewReader([]byte("same")))
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	files := map[string]string{
+		"new.txt":     "new",
+		"changed.txt": "new contents",
+		"same.txt":    "same",
+		".hidden":     "ignored",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	report, err := self.client.SyncDir(ctx, "sync-channel", dir, SyncOptions{Delete: true, DryRun: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Count(SyncUpload), Equals, 1)
+	c.Assert(report.Count(SyncUpdate), Equals, 1)
+	c.Assert(report.Count(SyncUnchanged), Equals, 1)
+	c.Assert(report.Count(SyncDelete), Equals, 1)
+	items, err := self.client.ListItems(ctx, "sync-channel")
+	c.Assert(err, IsNil)
+	c.Assert(len(items), Equals, 3)
+	_, ok := items["new"]
+	c.Assert(ok, Equals, false)
+
+	report, err = self.client.SyncDir(ctx, "sync-channel", dir, SyncOptions{Delete: true})
+	c.Assert(err, IsNil)
+	c.Assert(len(report.Failed()), Equals, 0)
+	items, err = self.client.ListItems(ctx, "sync-channel")
+	c.Assert(err, IsNil)
+	c.Assert(len(items), Equals, 3)
+	_, ok = items["stale"]
+	c.Assert(ok, Equals, false)
+	var changed bytes.Buffer
+	err = self.client.DownloadItem(ctx, "sync-channel", "changed", &changed)
+	c.Assert(err, IsNil)
+	c.Assert(changed.String(), Equals, "new contents")
+
+	report, err = self.client.SyncDir(ctx, "sync-channel", dir, SyncOptions{Delete: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Count(SyncUnchanged), Equals, 3)
+	c.Assert(len(report.Actions), Equals, 3)
+}
+
+//Photos synced to a channel that strips metadata are stored changed,
+//but must not look changed to the next sync.
+func (self *ClientSuite) TestSyncStrippedPhotos(c *C) {
+	ctx := context.Background()
+	db := self.session.DB(testDB)
+	_, err := api.InsertChannel(db, "sync-photos", "Sync Photos", "clientuser")
+	c.Assert(err, IsNil)
+	err = api.UpdateChannel(db, "sync-photos", bson.M{"strip_exif": true})
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	raw, err := ioutil.ReadFile(filepath.Join(os.Getenv("TEST_DATADIR"), "item1.jpg"))
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "photo.jpg"), raw, 0644)
+	c.Assert(err, IsNil)
+
+	report, err := self.client.SyncDir(ctx, "sync-photos", dir, SyncOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Count(SyncUpload), Equals, 1)
+	item, err := self.client.GetItem(ctx, "sync-photos", "photo")
+	c.Assert(err, IsNil)
+	c.Assert(item.Hash, Not(Equals), api.HashData(raw))
+	c.Assert(item.SourceHash, Equals, api.HashData(raw))
+
+	report, err = self.client.SyncDir(ctx, "sync-photos", dir, SyncOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Count(SyncUnchanged), Equals, 1)
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+//SlugFromFilename turns "Holiday Photo 01.JPG" into "holiday-photo-01".
+//It returns "" if nothing usable is left.
+func SlugFromFilename(path string) string {
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(base), "-"), "-")
+}
+
+//extensions is a copy of the server's table in internal/utils.go, which
+//names archive entries with it; keep the two the same.  The client can't
+//import the server package without pulling in its dependencies.
+var extensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"video/mp4":       ".mp4",
+	"audio/mpeg":      ".mp3",
+	"text/plain":      ".txt",
+}
+
+//ExtensionFor guesses a file extension (with the dot) from the first
+//bytes of a file, falling back to ".bin".
+func ExtensionFor(head []byte) string {
+	contentType := http.DetectContentType(head)
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	ext, ok := extensions[contentType]
+	if !ok {
+		return ".bin"
+	}
+	return ext
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type FilesSuite struct{}
+
+var _ = Suite(&FilesSuite{})
+
+func (self *FilesSuite) TestSlugFromFilename(c *C) {
+	c.Assert(SlugFromFilename("/tmp/Holiday Photo 01.JPG"), Equals, "holiday-photo-01")
+	c.Assert(SlugFromFilename("item1.jpg"), Equals, "item1")
+	c.Assert(SlugFromFilename("__weird__.name.png"), Equals, "weird-name")
+	c.Assert(SlugFromFilename("...png"), Equals, "")
+}
+
+func (self *FilesSuite) TestExtensionFor(c *C) {
+	c.Assert(ExtensionFor([]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")), Equals, ".jpg")
+	c.Assert(ExtensionFor([]byte("\x89PNG\x0d\x0a\x1a\x0a")), Equals, ".png")
+	c.Assert(ExtensionFor([]byte("GIF89a")), Equals, ".gif")
+	c.Assert(ExtensionFor([]byte("hello, world")), Equals, ".txt")
+	c.Assert(ExtensionFor([]byte{0, 1, 2, 3}), Equals, ".bin")
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	SyncUpload    = "upload"
+	SyncUpdate    = "update"
+	SyncDelete    = "delete"
+	SyncUnchanged = "unchanged"
+)
+
+type SyncOptions struct {
+	//Delete removes items that have no matching local file.
+	Delete bool
+	//DryRun works out what would happen without changing anything.
+	DryRun bool
+}
+
+//SyncAction is one thing SyncDir did (or, in a dry run, would do).
+type SyncAction struct {
+	Kind string
+	Slug string
+	//Path is the local file; empty for deletions.
+	Path string
+	//Err is set if the action was attempted and failed.
+	Err error
+}
+
+type SyncReport struct {
+	Actions []SyncAction
+}
+
+//Count returns how many actions of the given kind are in the report.
+func (self *SyncReport) Count(kind string) int {
+	n := 0
+	for _, action := range self.Actions {
+		if action.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+//Failed returns the actions that went wrong.
+func (self *SyncReport) Failed() []SyncAction {
+	failed := make([]SyncAction, 0)
+	for _, action := range self.Actions {
+		if action.Err != nil {
+			failed = append(failed, action)
+		}
+	}
+	return failed
+}
+
+//localFiles maps item slugs to the regular, non-hidden files in dir.
+func localFiles(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		slug := SlugFromFilename(entry.Name())
+		if slug == "" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if other, ok := files[slug]; ok {
+			return nil, fmt.Errorf("%s and %s would both be item %s", other, path, slug)
+		}
+		files[slug] = path
+	}
+	return files, nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+//hashItem gets the SHA-256 of an item's data as it was uploaded, from
+//the server if it knows it and by downloading the data otherwise.  The
+//server keeps the hash of the upload separately when it stripped
+//metadata from it, so a photo isn't taken for changed on every sync.
+func (self *Client) hashItem(ctx context.Context, chanSlug, itemSlug string) ([]byte, error) {
+	item, err := self.GetItem(ctx, chanSlug, itemSlug)
+	if err != nil {
+		return nil, err
+	}
+	if sum, err := hex.DecodeString(item.SourceHash); err == nil && len(sum) == sha256.Size {
+		return sum, nil
+	}
+	if sum, err := hex.DecodeString(item.Hash); err == nil && len(sum) == sha256.Size {
+		return sum, nil
+	}
+	hash := sha256.New()
+	err = self.DownloadItem(ctx, chanSlug, itemSlug, hash)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+//planSync compares dir with the channel's items and works out what
+//needs doing, without changing anything.
+func (self *Client) planSync(ctx context.Context, chanSlug, dir string, opts SyncOptions) ([]SyncAction, error) {
+	files, err := localFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := self.ListItems(ctx, chanSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	slugs := make([]string, 0, len(files))
+	for slug := range files {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	actions := make([]SyncAction, 0)
+	for _, slug := range slugs {
+		path := files[slug]
+		if _, exists := remote[slug]; !exists {
+			actions = append(actions, SyncAction{Kind: SyncUpload, Slug: slug, Path: path})
+			continue
+		}
+		localHash, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		remoteHash, err := self.hashItem(ctx, chanSlug, slug)
+		if err != nil {
+			return nil, err
+		}
+		kind := SyncUnchanged
+		if string(localHash) != string(remoteHash) {
+			kind = SyncUpdate
+		}
+		actions = append(actions, SyncAction{Kind: kind, Slug: slug, Path: path})
+	}
+	if opts.Delete {
+		for _, slug := range SortedSlugs(remote) {
+			if _, exists := files[slug]; !exists {
+				actions = append(actions, SyncAction{Kind: SyncDelete, Slug: slug})
+			}
+		}
+	}
+	return actions, nil
+}
+
+//SortedSlugs returns the keys of a map from slugs, such as ListChannels
+//and ListItems return, in order.
+func SortedSlugs(m map[string]string) []string {
+	slugs := make([]string, 0, len(m))
+	for slug := range m {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	return slugs
+}
+
+func (self *Client) uploadFile(ctx context.Context, chanSlug, slug, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = self.UploadItem(ctx, chanSlug, slug, filepath.Base(path), file)
+	return err
+}
+
+//SyncDir mirrors the files in dir (not its subdirectories) into a
+//channel.  Items are matched to files by SlugFromFilename and compared by
+//SHA-256 of their contents.  New files are uploaded, changed ones are
+//re-uploaded and, with opts.Delete, items without a file are removed.
+//A failed upload or delete is recorded in the report and the sync
+//carries on; the returned error is only for failures that stop the
+//sync altogether.
+func (self *Client) SyncDir(ctx context.Context, chanSlug, dir string, opts SyncOptions) (*SyncReport, error) {
+	actions, err := self.planSync(ctx, chanSlug, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	report := &SyncReport{Actions: actions}
+	if opts.DryRun {
+		return report, nil
+	}
+	for i := range report.Actions {
+		action := &report.Actions[i]
+		switch action.Kind {
+		case SyncUpload, SyncUpdate:
+			action.Err = self.uploadFile(ctx, chanSlug, action.Slug, action.Path)
+		case SyncDelete:
+			action.Err = self.DeleteItem(ctx, chanSlug, action.Slug)
+		}
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+	}
+	return report, nil
+}
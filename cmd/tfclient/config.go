@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//clientConfig is what tfclient needs to reach the server.  It is read
+//from ~/.tfclient.json (or -config / TFCLIENT_CONFIG), then overridden by
+//TFCLIENT_* environment variables and flags.
+type clientConfig struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Secret   string `json:"secret"`
+	APIKey   string `json:"api_key"`
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv("TFCLIENT_CONFIG"); path != "" {
+		return path
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".tfclient.json")
+}
+
+//loadClientConfig reads path.  A missing file is fine unless the user
+//named it explicitly.
+func loadClientConfig(path string, explicit bool) (*clientConfig, error) {
+	config := &clientConfig{
+		Server: "http://localhost:8080",
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, config)
+			if err != nil {
+				return nil, errors.New(path + ": " + err.Error())
+			}
+		} else if explicit || !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("TFCLIENT_SERVER"); v != "" {
+		config.Server = v
+	}
+	if v := os.Getenv("TFCLIENT_USERNAME"); v != "" {
+		config.Username = v
+	}
+	if v := os.Getenv("TFCLIENT_SECRET"); v != "" {
+		config.Secret = v
+	}
+	if v := os.Getenv("TFCLIENT_API_KEY"); v != "" {
+		config.APIKey = v
+	}
+	return config, nil
+}
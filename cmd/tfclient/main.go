@@ -0,0 +1,331 @@
+//Command tfclient lists, uploads and downloads channel items from a
+//terminal.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/waucka/testflight-demo/client"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const usageText = `usage: tfclient [-config file] [-server url] [-user name] <command> [args]
+
+commands:
+  channels                                list channels
+  channel <slug>                          show a channel and its items
+  create <slug> <title>                   create a channel
+  upload [-title t] <channel> <file>...   upload files; slugs come from the file names
+  download [-dir d] <channel> [item...]   download items (all of them by default)
+  export <channel> [file]                 save a channel archive (default <channel>.tar)
+  import <channel> <file>                 recreate a channel from an archive
+  sync [-delete] [-dry-run] <channel> <dir>
+                                          mirror the files in dir into a channel
+
+Credentials are read from ~/.tfclient.json:
+  {"server": "https://...", "username": "alice", "secret": "..."}
+or, for scripts, with an API key instead of username and secret:
+  {"server": "https://...", "api_key": "tfk_..."}
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageText)
+}
+
+func main() {
+	flags := flag.NewFlagSet("tfclient", flag.ExitOnError)
+	flags.Usage = usage
+	configPath := flags.String("config", "", "credentials file (default ~/.tfclient.json)")
+	server := flags.String("server", "", "server URL")
+	username := flags.String("user", "", "username")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	path := *configPath
+	if path == "" {
+		path = defaultConfigPath()
+	}
+	config, err := loadClientConfig(path, *configPath != "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *server != "" {
+		config.Server = *server
+	}
+	if *username != "" {
+		config.Username = *username
+	}
+
+	api := client.New(config.Server, config.Username, config.Secret)
+	api.APIKey = config.APIKey
+	ctx := context.Background()
+	command, args := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+	case "channels":
+		err = listChannels(ctx, api, args)
+	case "channel":
+		err = showChannel(ctx, api, args)
+	case "create":
+		err = createChannel(ctx, api, args)
+	case "upload":
+		err = upload(ctx, api, args)
+	case "download":
+		err = download(ctx, api, args)
+	case "sync":
+		err = syncDir(ctx, api, args)
+	case "export":
+		err = exportChannel(ctx, api, args)
+	case "import":
+		err = importChannel(ctx, api, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err == errUsage {
+		usage()
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("bad usage")
+
+func listChannels(ctx context.Context, api *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	channels, err := api.ListChannels(ctx)
+	if err != nil {
+		return err
+	}
+	for _, slug := range client.SortedSlugs(channels) {
+		fmt.Printf("%s\t%s\n", slug, channels[slug])
+	}
+	return nil
+}
+
+func showChannel(ctx context.Context, api *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	channel, err := api.GetChannel(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", channel.Slug, channel.Title)
+	for _, item := range channel.Items {
+		fmt.Printf("  %s\t%s\t%s\t%s\n", item.Slug, item.Title, item.Uploader, item.DateUploaded.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+func createChannel(ctx context.Context, api *client.Client, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return api.CreateChannel(ctx, args[0], args[1])
+}
+
+func uploadFile(ctx context.Context, api *client.Client, chanSlug, path, title string) (string, error) {
+	slug := client.SlugFromFilename(path)
+	if slug == "" {
+		return "", fmt.Errorf("cannot derive an item slug from %s", path)
+	}
+	if title == "" {
+		title = filepath.Base(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return api.UploadItem(ctx, chanSlug, slug, title, file)
+}
+
+func upload(ctx context.Context, api *client.Client, args []string) error {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	title := flags.String("title", "", "item title (default: the file name; only with a single file)")
+	flags.Parse(args)
+	if flags.NArg() < 2 || (*title != "" && flags.NArg() != 2) {
+		return errUsage
+	}
+	chanSlug := flags.Arg(0)
+	failed := 0
+	for _, path := range flags.Args()[1:] {
+		location, err := uploadFile(ctx, api, chanSlug, path, *title)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			failed++
+			continue
+		}
+		fmt.Printf("%s -> %s\n", path, location)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, flags.NArg()-1)
+	}
+	return nil
+}
+
+//downloadItem saves an item as dir/<slug><ext>, guessing the extension
+//from the content.
+func downloadItem(ctx context.Context, api *client.Client, chanSlug, itemSlug, dir string) (string, error) {
+	tmp, err := ioutil.TempFile(dir, "."+itemSlug+".")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	err = api.DownloadItem(ctx, chanSlug, itemSlug, tmp)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	head := make([]byte, 512)
+	n := 0
+	if err == nil {
+		n, err = io.ReadFull(tmp, head)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, itemSlug+client.ExtensionFor(head[:n]))
+	return path, os.Rename(tmp.Name(), path)
+}
+
+func download(ctx context.Context, api *client.Client, args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory to save items in")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return errUsage
+	}
+	chanSlug := flags.Arg(0)
+	itemSlugs := flags.Args()[1:]
+	if len(itemSlugs) == 0 {
+		items, err := api.ListItems(ctx, chanSlug)
+		if err != nil {
+			return err
+		}
+		itemSlugs = client.SortedSlugs(items)
+	}
+	err := os.MkdirAll(*dir, 0755)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, itemSlug := range itemSlugs {
+		path, err := downloadItem(ctx, api, chanSlug, itemSlug, *dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", itemSlug, err.Error())
+			failed++
+			continue
+		}
+		fmt.Println(path)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(itemSlugs))
+	}
+	return nil
+}
+
+func exportChannel(ctx context.Context, api *client.Client, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	path := args[0] + ".tar"
+	if len(args) == 2 {
+		path = args[1]
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = api.ExportChannel(ctx, args[0], file)
+	closeErr := file.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	fmt.Println(path)
+	return nil
+}
+
+func importChannel(ctx context.Context, api *client.Client, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return api.ImportChannel(ctx, args[0], file)
+}
+
+var syncSymbols = map[string]string{
+	client.SyncUpload:    "+",
+	client.SyncUpdate:    "~",
+	client.SyncDelete:    "-",
+	client.SyncUnchanged: "=",
+}
+
+func syncDir(ctx context.Context, api *client.Client, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	deleteRemoved := flags.Bool("delete", false, "delete items whose file is gone")
+	dryRun := flags.Bool("dry-run", false, "only report what would change")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errUsage
+	}
+	report, err := api.SyncDir(ctx, flags.Arg(0), flags.Arg(1), client.SyncOptions{
+		Delete: *deleteRemoved,
+		DryRun: *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+	for _, action := range report.Actions {
+		if action.Kind == client.SyncUnchanged {
+			continue
+		}
+		line := syncSymbols[action.Kind] + " " + action.Slug
+		if action.Path != "" {
+			line += " (" + action.Path + ")"
+		}
+		if action.Err != nil {
+			line += ": " + action.Err.Error()
+		}
+		fmt.Println(line)
+	}
+	verb := "Synced"
+	if *dryRun {
+		verb = "Would sync"
+	}
+	fmt.Printf("%s: %d new, %d changed, %d deleted, %d unchanged\n", verb,
+		report.Count(client.SyncUpload), report.Count(client.SyncUpdate),
+		report.Count(client.SyncDelete), report.Count(client.SyncUnchanged))
+	if failed := report.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d actions failed", len(failed))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+)
+
+//Who may read a channel.  Writing to a channel is up to its members,
+//whatever its visibility.
+const (
+	VisibilityPublic        = "public"
+	VisibilityAuthenticated = "authenticated"
+	VisibilityPrivate       = "private"
+)
+
+//Roles of channel members, from least to most trusted.  Each role can
+//do everything the ones before it can:
+//
+//	viewer       reads the channel, even when it is private
+//	contributor  uploads items, and replaces or deletes their own
+//	maintainer   replaces or deletes any item; changes settings, webhooks
+//	             and download links; manages viewers and contributors
+//	owner        changes visibility and manages every member
+const (
+	RoleViewer      = "viewer"
+	RoleContributor = "contributor"
+	RoleMaintainer  = "maintainer"
+	RoleOwner       = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleMaintainer:  3,
+	RoleOwner:       4,
+}
+
+func ParseRole(value string) (string, error) {
+	if _, ok := roleRanks[value]; !ok {
+		return "", errors.New("role must be viewer, contributor, maintainer or owner")
+	}
+	return value, nil
+}
+
+//roleAtLeast says whether role (possibly "", for no role at all) is
+//wanted or a more trusted one.
+func roleAtLeast(role, wanted string) bool {
+	return roleRanks[role] >= roleRanks[wanted]
+}
+
+//canManage says whether a member with role actor may change a member
+//from role from (or "" if they aren't one yet) to role to (or "" to
+//remove them).  Owners manage anyone; maintainers only the roles below
+//their own.
+func canManage(actor, from, to string) bool {
+	if actor == RoleOwner {
+		return true
+	}
+	return actor == RoleMaintainer && roleRanks[from] < roleRanks[RoleMaintainer] && roleRanks[to] < roleRanks[RoleMaintainer]
+}
+
+func ParseVisibility(value string) (string, error) {
+	switch value {
+	case VisibilityPublic, VisibilityAuthenticated, VisibilityPrivate:
+		return value, nil
+	}
+	return "", errors.New("visibility must be public, authenticated or private")
+}
+
+//fetchReadableChannel is fetchChannel for read routes.  A private
+//channel is a 404 to those who can't read it, so that its name doesn't
+//leak; an authenticated one asks anonymous users to log in.
+func fetchReadableChannel(c *gin.Context, slug string) *ChannelDBRecord {
+	chanRec := fetchChannel(c, slug)
+	checkCanRead(c, chanRec)
+	return chanRec
+}
+
+func checkCanRead(c *gin.Context, chanRec *ChannelDBRecord) {
+	username := currentUser(c)
+	if chanRec.CanRead(username) {
+		return
+	}
+	if username == "" && chanRec.GetVisibility() == VisibilityAuthenticated {
+		Unauthorized("Channel " + chanRec.Slug + " is only visible to logged-in users")
+	}
+	NotFound("No such channel " + chanRec.Slug)
+}
+
+//fetchChannelAs is fetchChannel for routes that need username to have
+//at least the given role.  Those who can't read the channel get the
+//same answer as from a read route.
+func fetchChannelAs(c *gin.Context, slug, username, role string) *ChannelDBRecord {
+	chanRec := fetchReadableChannel(c, slug)
+	checkRole(chanRec, username, role)
+	return chanRec
+}
+
+func checkRole(chanRec *ChannelDBRecord, username, role string) {
+	if !chanRec.HasRole(username, role) {
+		Forbidden("You must be a " + role + " of channel " + chanRec.Slug)
+	}
+}
+
+//checkCanChangeItem lets contributors replace or delete the items they
+//uploaded, and maintainers any item.
+func checkCanChangeItem(chanRec *ChannelDBRecord, item *ItemDBRecord, username string) {
+	if item != nil && item.Uploader != username {
+		checkRole(chanRec, username, RoleMaintainer)
+	} else {
+		checkRole(chanRec, username, RoleContributor)
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type AccessSuite struct{}
+
+var _ = Suite(&AccessSuite{})
+
+func (self *AccessSuite) TestRoles(c *C) {
+	chanRec := NewChannel("team", "Team", "alice")
+	chanRec.Members = []MemberDBRecord{
+		{"bob", RoleViewer},
+		{"carol", RoleContributor},
+		{"dave", RoleMaintainer},
+	}
+	c.Assert(chanRec.RoleOf("alice"), Equals, RoleOwner)
+	c.Assert(chanRec.RoleOf("carol"), Equals, RoleContributor)
+	c.Assert(chanRec.RoleOf("eve"), Equals, "")
+	c.Assert(chanRec.RoleOf(""), Equals, "")
+
+	c.Assert(chanRec.HasRole("dave", RoleContributor), Equals, true)
+	c.Assert(chanRec.HasRole("carol", RoleMaintainer), Equals, false)
+	c.Assert(chanRec.HasRole("bob", RoleViewer), Equals, true)
+	c.Assert(chanRec.HasRole("eve", RoleViewer), Equals, false)
+
+	_, err := ParseRole("admin")
+	c.Assert(err, NotNil)
+	role, err := ParseRole(RoleMaintainer)
+	c.Assert(err, IsNil)
+	c.Assert(role, Equals, RoleMaintainer)
+}
+
+func (self *AccessSuite) TestCanRead(c *C) {
+	chanRec := NewChannel("team", "Team", "alice")
+	chanRec.Members = []MemberDBRecord{{"bob", RoleViewer}}
+	c.Assert(chanRec.CanRead(""), Equals, true)
+
+	chanRec.Visibility = VisibilityAuthenticated
+	c.Assert(chanRec.CanRead(""), Equals, false)
+	c.Assert(chanRec.CanRead("eve"), Equals, true)
+
+	chanRec.Visibility = VisibilityPrivate
+	c.Assert(chanRec.CanRead(""), Equals, false)
+	c.Assert(chanRec.CanRead("eve"), Equals, false)
+	c.Assert(chanRec.CanRead("bob"), Equals, true)
+	c.Assert(chanRec.CanRead("alice"), Equals, true)
+}
+
+func (self *AccessSuite) TestCanManage(c *C) {
+	c.Assert(canManage(RoleOwner, RoleMaintainer, RoleOwner), Equals, true)
+	c.Assert(canManage(RoleOwner, RoleOwner, ""), Equals, true)
+	c.Assert(canManage(RoleMaintainer, "", RoleContributor), Equals, true)
+	c.Assert(canManage(RoleMaintainer, RoleViewer, ""), Equals, true)
+	c.Assert(canManage(RoleMaintainer, RoleContributor, RoleMaintainer), Equals, false)
+	c.Assert(canManage(RoleMaintainer, RoleMaintainer, ""), Equals, false)
+	c.Assert(canManage(RoleContributor, "", RoleViewer), Equals, false)
+}
+
+func (self *AccessSuite) TestOrgRoles(c *C) {
+	chanRec := NewChannel("acme/team", "Team", "")
+	chanRec.Org = "acme"
+	chanRec.Members = []MemberDBRecord{{"bob", RoleMaintainer}, {"carol", RoleViewer}}
+	c.Assert(chanRec.RoleOf("alice"), Equals, "")
+	c.Assert(chanRec.RoleOf(""), Equals, "")
+
+	chanRec.org = &OrgDBRecord{
+		Name:    "acme",
+		Members: []OrgMemberDBRecord{{"alice", OrgRoleAdmin}, {"bob", OrgRoleMember}, {"carol", OrgRoleMember}},
+	}
+	c.Assert(chanRec.RoleOf("alice"), Equals, RoleOwner)
+	c.Assert(chanRec.RoleOf("bob"), Equals, RoleMaintainer)
+	c.Assert(chanRec.RoleOf("carol"), Equals, RoleContributor)
+	c.Assert(chanRec.RoleOf("eve"), Equals, "")
+}
+
+func (self *AccessSuite) TestChannelPath(c *C) {
+	org, name := SplitChannelSlug("acme/holiday")
+	c.Assert(org, Equals, "acme")
+	c.Assert(name, Equals, "holiday")
+	org, name = SplitChannelSlug("holiday")
+	c.Assert(org, Equals, "")
+	c.Assert(name, Equals, "holiday")
+
+	c.Assert(ChannelPath("holiday"), Equals, "/channel/holiday")
+	c.Assert(ChannelPath("acme/holiday"), Equals, "/org/acme/channel/holiday")
+	c.Assert(channelFilename("acme/holiday"), Equals, "acme-holiday")
+}
@@ -1,58 +1,259 @@
 package api
 
 import (
+	"encoding/base64"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"io"
 	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+//Options holds the tunables that main reads from its settings.
+type Options struct {
+	AuthSecret     string
+	MaxUploadBytes int64
+	CORSOrigins    []string
+	//ClientCertAuth lets a verified TLS client certificate stand in for
+	//the Authorization header; its common name is the username.
+	ClientCertAuth bool
+	//BlobBackend keeps item data; nil means GridFS in the same database.
+	BlobBackend BlobBackend
+	//Sessions end after going unused for SessionIdleTimeout (0 for
+	//never) or SessionMaxAge after login, whichever comes first.
+	SessionIdleTimeout time.Duration
+	SessionMaxAge      time.Duration
+	//WebhookAllowInternal lets webhooks reach loopback, private and
+	//link-local addresses; otherwise they are refused when registered
+	//and again when delivered to.
+	WebhookAllowInternal bool
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		AuthSecret:         "SUP3R_S33CR37",
+		MaxUploadBytes:     32 << 20,
+		CORSOrigins:        make([]string, 0),
+		SessionIdleTimeout: 24 * time.Hour,
+		SessionMaxAge:      30 * 24 * time.Hour,
+	}
+}
+
+//Config holds the master MongoDB session.  Handlers never use it
+//directly; MiddlewareSession hands each request a copy.
 type Config struct {
 	session  *mgo.Session
 	db       *mgo.Database
-	usercoll *mgo.Collection
-	chancoll *mgo.Collection
+	opts     *Options
+	monitor  *storeMonitor
+	events   *EventBus
+	webhooks *webhookDispatcher
+	blobs    *BlobStore
+	gc       *blobCollector
+	sessions *SessionCache
 }
 
-func NewConfig(session *mgo.Session, dbname string) *Config {
+func NewConfig(session *mgo.Session, dbname string, opts *Options) *Config {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
 	db := session.DB(dbname)
+	backend := opts.BlobBackend
+	if backend == nil {
+		backend = NewGridFSBackend(session, dbname)
+	}
 	return &Config{
 		session,
 		db,
-		db.C("users"),
-		db.C("channels"),
+		opts,
+		nil,
+		NewEventBus(eventHistorySize),
+		nil,
+		NewBlobStore(backend),
+		nil,
+		NewSessionCache(opts.SessionIdleTimeout),
+	}
+}
+
+//WatchStore starts pinging MongoDB every interval, reconnecting with
+//backoff when it goes away.  Close stops the watcher.
+func (self *Config) WatchStore(interval time.Duration) {
+	if self.monitor != nil {
+		return
+	}
+	self.monitor = newStoreMonitor(self.session, interval)
+	go self.monitor.run()
+}
+
+//DeliverWebhooks starts sending queued webhook deliveries in the
+//background.  Without it, deliveries are queued but wait for a server
+//that does deliver them.  Close stops it.
+func (self *Config) DeliverWebhooks() {
+	if self.webhooks != nil {
+		return
+	}
+	self.webhooks = newWebhookDispatcher(self.session, self.db.Name, self.opts.WebhookAllowInternal)
+	go self.webhooks.run()
+}
+
+//CollectBlobs starts deleting unused item data every interval.  Close
+//stops it.
+func (self *Config) CollectBlobs(interval time.Duration) {
+	if self.gc != nil {
+		return
 	}
+	self.gc = newBlobCollector(self.blobs, self.session, self.db.Name, interval)
+	go self.gc.run()
+}
+
+//StopStreams ends every open event stream so that a graceful shutdown
+//doesn't have to wait for them.  Register it with
+//http.Server.RegisterOnShutdown.
+func (self *Config) StopStreams() {
+	self.events.Close()
+}
+
+//Close releases the MongoDB session.  Call it once the HTTP server has
+//stopped handing requests to the router.
+func (self *Config) Close() {
+	if self.monitor != nil {
+		self.monitor.Stop()
+	}
+	if self.webhooks != nil {
+		self.webhooks.Stop()
+	}
+	if self.gc != nil {
+		self.gc.Stop()
+	}
+	self.session.Close()
 }
 
 func (self *Config) GetRouter() *gin.Engine {
 	router := gin.New()
 
 	router.Use(AjaxErrorGuard())
-	router.Use(MiddlewareAuth(self.usercoll))
-	router.GET("/channel", self.GetChannelList)
-	router.POST("/channel", self.CreateChannel)
-	router.GET("/channel/:slug", self.GetChannelInfo)
-	router.GET("/channel/:slug/item", self.GetChannelItemList)
-	router.POST("/channel/:slug/item", self.CreateChannelItem)
-	router.GET("/channel/:slug/item/:itemSlug", self.GetChannelItem)
-	router.GET("/channel/:slug/item/:itemSlug/data", self.GetChannelItemData)
+	router.Use(MiddlewareCORS(self.opts.CORSOrigins))
+	router.Use(MiddlewareBodyLimit(self.opts.MaxUploadBytes))
+	router.Use(MiddlewareSession(self.session, self.db.Name))
+	router.Use(MiddlewareAuth(self.opts.AuthSecret, self.opts.ClientCertAuth, self.sessions))
+	router.GET("/events", self.GetEventSocket)
+	router.POST("/keys", self.CreateAPIKey)
+	router.GET("/keys", self.GetAPIKeys)
+	router.DELETE("/keys/:keyId", self.DeleteAPIKey)
+	router.POST("/login", self.Login)
+	router.GET("/user/me/sessions", self.GetSessions)
+	router.DELETE("/user/me/sessions", self.DeleteSessions)
+	router.DELETE("/user/me/sessions/:sessionId", self.DeleteSession)
+	router.GET("/user/me/totp", self.GetTOTP)
+	router.POST("/user/me/totp", self.EnrollTOTP)
+	router.DELETE("/user/me/totp", self.DeleteTOTP)
+	router.POST("/user/me/totp/confirm", self.ConfirmTOTP)
+	router.POST("/user/me/totp/recovery", self.RegenerateRecoveryCodes)
+	self.addChannelRoutes(&router.RouterGroup)
+	router.POST("/org", self.CreateOrganization)
+	router.GET("/org/:org", self.GetOrganization)
+	router.PUT("/org/:org/members/:username", self.SetOrganizationMember)
+	router.DELETE("/org/:org/members/:username", self.RemoveOrganizationMember)
+	//An organization's channels have the same routes under its name.
+	self.addChannelRoutes(router.Group("/org/:org"))
 
 	return router
 }
 
+func (self *Config) addChannelRoutes(routes *gin.RouterGroup) {
+	routes.GET("/channel", self.GetChannelList)
+	routes.POST("/channel", self.CreateChannel)
+	routes.GET("/channel/:slug", self.GetChannelInfo)
+	routes.PUT("/channel/:slug", self.UpdateChannelSettings)
+	routes.GET("/channel/:slug/events", self.GetChannelEvents)
+	routes.GET("/channel/:slug/export", self.ExportChannel)
+	routes.POST("/channel/:slug/import", self.ImportChannel)
+	routes.GET("/channel/:slug/item", self.GetChannelItemList)
+	routes.GET("/channel/:slug/item.zip", self.GetChannelItemZip)
+	routes.POST("/channel/:slug/item", self.CreateChannelItem)
+	routes.GET("/channel/:slug/item/:itemSlug", self.GetChannelItem)
+	routes.DELETE("/channel/:slug/item/:itemSlug", self.DeleteChannelItem)
+	routes.GET("/channel/:slug/item/:itemSlug/data", self.GetChannelItemData)
+	routes.POST("/channel/:slug/item/:itemSlug/link", self.CreateDownloadLink)
+	routes.GET("/channel/:slug/members", self.GetChannelMembers)
+	routes.PUT("/channel/:slug/members/:username", self.SetChannelMember)
+	routes.DELETE("/channel/:slug/members/:username", self.RemoveChannelMember)
+	routes.GET("/channel/:slug/webhooks", self.GetChannelWebhooks)
+	routes.POST("/channel/:slug/webhooks", self.CreateChannelWebhook)
+	routes.DELETE("/channel/:slug/webhooks/:webhookId", self.DeleteChannelWebhook)
+	routes.GET("/channel/:slug/webhooks/:webhookId/deliveries", self.GetWebhookDeliveries)
+}
+
+//fetchChannel loads a channel for the current request, bailing out
+//with a 404 if it doesn't exist.
+func fetchChannel(c *gin.Context, slug string) *ChannelDBRecord {
+	chanRec, err := FindChannel(requestDB(c), slug)
+	if err == mgo.ErrNotFound {
+		NotFound("No such channel " + slug)
+	} else if err != nil {
+		InternalError("Could not fetch channel info from database")
+	}
+	return chanRec
+}
+
+//GetChannelList lists the channels the user can read; under /org/:org,
+//only those of the organization.
 func (self *Config) GetChannelList(c *gin.Context) {
-	_ = forceAuth(c)
-	chanIter := self.chancoll.Find(nil).Iter()
+	username := forceAuth(c)
+	org := c.Params.ByName("org")
+	channels, err := ListChannels(requestDB(c))
+	if err != nil {
+		InternalError("Could not fetch channel list from database")
+	}
 	channelData := make(map[string]string)
-	var chanRec ChannelDBRecord
-	for chanIter.Next(&chanRec) {
-		channelData[chanRec.Slug] = chanRec.Title
+	for _, chanRec := range channels {
+		if (org == "" || chanRec.Org == org) && chanRec.CanRead(username) {
+			channelData[chanRec.Slug] = chanRec.Title
+		}
 	}
 	c.JSON(http.StatusOK, channelData)
 }
 
+//parseForm parses the request's form.  A chunked body has no
+//Content-Length for MiddlewareBodyLimit to refuse up front, so running
+//into its limit while reading is reported the same way.
+func parseForm(c *gin.Context) {
+	err := c.Request.ParseForm()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		Fail(http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request body too large")
+	}
+	if err != nil {
+		BadRequest("Malformed form: " + err.Error())
+	}
+}
+
+//formValue is c.Request.FormValue that also says whether the field was
+//given at all.
+func formValue(c *gin.Context, name string) (string, bool) {
+	parseForm(c)
+	values, ok := c.Request.Form[name]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func boolParam(name, value string) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		BadRequest(name + " must be true or false")
+	}
+	return b
+}
+
 func (self *Config) CreateChannel(c *gin.Context) {
 	username := forceAuth(c)
+	parseForm(c)
 	slug := c.Request.FormValue("slug")
 	title := c.Request.FormValue("title")
 	if slug == "" {
@@ -61,12 +262,11 @@ func (self *Config) CreateChannel(c *gin.Context) {
 	if title == "" {
 		BadRequest("title cannot be empty")
 	}
-	err := self.chancoll.Insert(&ChannelDBRecord{
-		Slug:  slug,
-		Title: title,
-		Owner: username,
-		Items: make([]ItemDBRecord, 0),
-	})
+	//A slug like "acme/holiday", or one posted under /org/acme, makes
+	//a channel of organization acme.
+	chanrec := newChannelFor(c, orgChannelSlug(c, slug), title, username)
+	_ = readChannelSettings(c, chanrec)
+	err := AddChannel(requestDB(c), chanrec)
 	if err == nil {
 		c.String(http.StatusNoContent, "")
 	} else {
@@ -76,26 +276,109 @@ func (self *Config) CreateChannel(c *gin.Context) {
 
 func (self *Config) GetChannelInfo(c *gin.Context) {
 	_ = forceAuth(c)
-	slug := c.Params.ByName("slug")
-	var chanRec ChannelDBRecord
-	err := self.chancoll.FindId(slug).One(&chanRec)
-	if err == mgo.ErrNotFound {
-		NotFound("No such channel " + slug)
-	} else if err != nil {
-		InternalError("Could not fetch channel info from database")
-	}
+	slug := channelSlug(c)
+	chanRec := fetchReadableChannel(c, slug)
 	c.JSON(http.StatusOK, chanRec.ToJSON())
 }
 
-func (self *Config) GetChannelItemList(c *gin.Context) {
-	slug := c.Params.ByName("slug")
-	var chanRec ChannelDBRecord
-	err := self.chancoll.FindId(slug).One(&chanRec)
-	if err == mgo.ErrNotFound {
-		NotFound("No such channel " + slug)
-	} else if err != nil {
-		InternalError("Could not fetch channel info from database")
+//readChannelSettings applies the channel settings given in the request
+//to chanrec and returns them as changes for UpdateChannel.  Settings
+//that aren't given are left alone.
+func readChannelSettings(c *gin.Context, chanrec *ChannelDBRecord) bson.M {
+	changes := make(bson.M)
+	if value, ok := formValue(c, "strip_exif"); ok {
+		chanrec.StripEXIF = boolParam("strip_exif", value)
+		changes["strip_exif"] = chanrec.StripEXIF
 	}
+	if value, ok := formValue(c, "allowed_types"); ok {
+		patterns, err := ParseTypePatterns(value)
+		if err != nil {
+			BadRequest(err.Error())
+		}
+		chanrec.AllowedTypes = patterns
+		changes["allowed_types"] = patterns
+	}
+	if value, ok := formValue(c, "max_item_bytes"); ok {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			BadRequest("max_item_bytes must be a whole number of bytes")
+		}
+		chanrec.MaxItemBytes = maxBytes
+		changes["max_item_bytes"] = maxBytes
+	}
+	if value, ok := formValue(c, "visibility"); ok {
+		visibility, err := ParseVisibility(value)
+		if err != nil {
+			BadRequest(err.Error())
+		}
+		chanrec.Visibility = visibility
+		changes["visibility"] = visibility
+	}
+	return changes
+}
+
+//manifestSettings copies the settings in an archive's manifest onto a
+//channel, returning the changes like readChannelSettings.  A manifest
+//without allowed types or a visibility leaves those alone.
+func manifestSettings(chanrec *ChannelDBRecord, manifest *ChannelJSONRecord) bson.M {
+	if manifest.MaxItemBytes < 0 {
+		BadRequest("max_item_bytes must be a whole number of bytes")
+	}
+	chanrec.StripEXIF = manifest.StripEXIF
+	chanrec.MaxItemBytes = manifest.MaxItemBytes
+	changes := bson.M{
+		"strip_exif":     manifest.StripEXIF,
+		"max_item_bytes": manifest.MaxItemBytes,
+	}
+	if manifest.AllowedTypes != nil {
+		patterns, err := ParseTypePatterns(strings.Join(manifest.AllowedTypes, ","))
+		if err != nil {
+			BadRequest(err.Error())
+		}
+		chanrec.AllowedTypes = patterns
+		changes["allowed_types"] = patterns
+	}
+	if manifest.Visibility != "" {
+		visibility, err := ParseVisibility(manifest.Visibility)
+		if err != nil {
+			BadRequest(err.Error())
+		}
+		chanrec.Visibility = visibility
+		changes["visibility"] = visibility
+	}
+	return changes
+}
+
+//UpdateChannelSettings changes a channel's title and settings.  Fields
+//that aren't given are left alone.  Maintainers can change everything
+//but the visibility, which is up to the owners.
+func (self *Config) UpdateChannelSettings(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	chanrec := fetchChannelAs(c, slug, username, RoleMaintainer)
+	changes := readChannelSettings(c, chanrec)
+	if _, ok := changes["visibility"]; ok {
+		checkRole(chanrec, username, RoleOwner)
+	}
+	if title, ok := formValue(c, "title"); ok {
+		if title == "" {
+			BadRequest("title cannot be empty")
+		}
+		changes["title"] = title
+	}
+	if len(changes) == 0 {
+		BadRequest("Nothing to change")
+	}
+	err := UpdateChannel(requestDB(c), slug, changes)
+	if err != nil {
+		InternalError("Cannot update channel info in database")
+	}
+	c.String(http.StatusNoContent, "")
+}
+
+func (self *Config) GetChannelItemList(c *gin.Context) {
+	slug := channelSlug(c)
+	chanRec := fetchReadableChannel(c, slug)
 
 	itemData := make(map[string]string)
 	for _, item := range chanRec.Items {
@@ -106,69 +389,295 @@ func (self *Config) GetChannelItemList(c *gin.Context) {
 
 func (self *Config) CreateChannelItem(c *gin.Context) {
 	username := forceAuth(c)
-	chanSlug := c.Params.ByName("slug")
+	chanSlug := channelSlug(c)
+	parseForm(c)
 	title := c.Request.FormValue("title")
 	b64data := c.Request.FormValue("b64data")
 	itemSlug := c.Request.FormValue("itemSlug")
-	var chanrec ChannelDBRecord
-	err := self.chancoll.FindId(chanSlug).One(&chanrec)
+	if itemSlug == "" {
+		BadRequest("itemSlug cannot be empty")
+	}
+	chanrec := fetchChannelAs(c, chanSlug, username, RoleContributor)
+	//Uploading to an existing slug replaces that item.
+	checkCanChangeItem(chanrec, chanrec.FindItem(itemSlug), username)
+	itemrec := NewItem(itemSlug, title, b64data, username)
+	checkUpload(chanrec, itemrec)
+	processUpload(chanrec, itemrec)
+	replaced, data := self.storeItem(requestDB(c), chanSlug, itemrec)
+	makeThumbnail(requestDB(c), chanSlug, itemrec, data)
+	self.publishPut(c, chanSlug, itemrec, replaced)
+	c.String(http.StatusOK, ChannelPath(chanSlug)+"/item/"+itemSlug)
+}
+
+//storeItem moves a checked item's data into the blob store and puts the
+//item in the channel.  It returns whether an item was replaced, and the
+//item's decoded data.
+func (self *Config) storeItem(db *mgo.Database, chanSlug string, itemrec *ItemDBRecord) (bool, []byte) {
+	data, err := self.blobs.StoreItem(db, itemrec)
+	if err != nil {
+		InternalError("Cannot store item data")
+	}
+	replaced, err := PutItem(db, chanSlug, itemrec)
+	if err != nil {
+		ReleaseBlob(db, itemrec.Hash)
+		InternalError("Cannot update channel info in database")
+	}
+	return replaced, data
+}
+
+//ImportItem stores a checked and processed item that isn't in the
+//channel yet, for the admin item import command.  Like an upload, it
+//caches the item's thumbnail and queues its webhook deliveries, but
+//clients streaming events from a running server aren't told.
+func ImportItem(db *mgo.Database, blobs *BlobStore, chanSlug string, itemrec *ItemDBRecord) error {
+	data, err := blobs.StoreItem(db, itemrec)
 	if err != nil {
-		NotFound("No such channel")
+		return err
 	}
-	if chanrec.Owner != username {
-		Forbidden("You do not own this channel")
+	err = AddItem(db, chanSlug, itemrec)
+	if err != nil {
+		ReleaseBlob(db, itemrec.Hash)
+		return err
+	}
+	makeThumbnail(db, chanSlug, itemrec, data)
+	_, err = EnqueueDeliveries(db, &Event{
+		Type:     EventItemCreated,
+		Channel:  chanSlug,
+		ItemSlug: itemrec.Slug,
+		Item:     itemrec.ToJSON(),
+		Time:     time.Now(),
+	})
+	if err != nil {
+		errorf("Could not queue webhook deliveries for channel %s: %s", chanSlug, err.Error())
 	}
-	itemrec := &ItemDBRecord{
-		Slug:         itemSlug,
-		Title:        title,
-		DateUploaded: time.Now(),
-		Data:         b64data,
-		Uploader:     username,
+	return nil
+}
+
+func (self *Config) publishPut(c *gin.Context, chanSlug string, itemrec *ItemDBRecord, replaced bool) {
+	eventType := EventItemCreated
+	if replaced {
+		eventType = EventItemUpdated
 	}
-	chanrec.Items = append(chanrec.Items, *itemrec)
-	err = self.chancoll.UpdateId(chanSlug, chanrec)
+	self.publish(c, eventType, chanSlug, itemrec.Slug, itemrec.ToJSON())
+}
+
+//publish tells streaming clients about an event and queues it for the
+//channel's webhooks.  The change itself is already stored, so a failure
+//to queue is logged rather than failing the request.
+func (self *Config) publish(c *gin.Context, eventType, chanSlug, itemSlug string, item *ItemJSONRecord) {
+	event := self.events.Publish(eventType, chanSlug, itemSlug, item)
+	queued, err := EnqueueDeliveries(requestDB(c), event)
 	if err != nil {
+		errorf("Could not queue webhook deliveries for channel %s: %s", chanSlug, err.Error())
+	}
+	if queued > 0 && self.webhooks != nil {
+		self.webhooks.Kick()
+	}
+}
+
+func (self *Config) DeleteChannelItem(c *gin.Context) {
+	username := forceAuth(c)
+	chanSlug := channelSlug(c)
+	itemSlug := c.Params.ByName("itemSlug")
+	chanrec := fetchChannelAs(c, chanSlug, username, RoleContributor)
+	item := chanrec.FindItem(itemSlug)
+	if item == nil {
+		NotFound("Channel " + chanSlug + " has no item " + itemSlug)
+	}
+	checkCanChangeItem(chanrec, item, username)
+	err := RemoveItem(requestDB(c), chanSlug, itemSlug)
+	if err == mgo.ErrNotFound {
+		NotFound("Channel " + chanSlug + " has no item " + itemSlug)
+	} else if err != nil {
 		InternalError("Cannot update channel info in database")
 	}
-	c.String(http.StatusOK, "/channel/"+chanSlug+"/item/"+itemSlug)
+	self.publish(c, EventItemDeleted, chanSlug, itemSlug, nil)
+	c.String(http.StatusNoContent, "")
 }
 
 func (self *Config) GetChannelItem(c *gin.Context) {
-	slug := c.Params.ByName("slug")
+	slug := channelSlug(c)
 	itemSlug := c.Params.ByName("itemSlug")
-	var chanRec ChannelDBRecord
-	err := self.chancoll.FindId(slug).One(&chanRec)
+	chanRec := fetchReadableChannel(c, slug)
+
+	item := chanRec.FindItem(itemSlug)
+	if item == nil {
+		NotFound("Channel " + slug + " has no item " + itemSlug)
+	}
+	c.JSON(http.StatusOK, item.ToJSON())
+}
+
+//GetChannelItemData returns an item's data, base64-encoded.  With w
+//and/or h (and optionally fit) query parameters an image item is
+//resized first; resized copies are cached, and a thumbnail is made of
+//every image on upload.  A request signed by CreateDownloadLink gets
+//the data whatever the channel's visibility.
+func (self *Config) GetChannelItemData(c *gin.Context) {
+	slug := channelSlug(c)
+	itemSlug := c.Params.ByName("itemSlug")
+	linked := self.checkDownloadLink(c, slug, itemSlug)
+	query := c.Request.URL.Query()
+	spec, resize, err := ParseVariantSpec(query.Get("w"), query.Get("h"), query.Get("fit"))
+	if err != nil {
+		BadRequest(err.Error())
+	}
+	chanRec := fetchChannel(c, slug)
+	if !linked {
+		checkCanRead(c, chanRec)
+	}
+
+	item := chanRec.FindItem(itemSlug)
+	if item == nil {
+		NotFound("Channel " + slug + " has no item " + itemSlug)
+	}
+	db := requestDB(c)
+	if !resize {
+		self.writeItemData(c, db, item)
+		return
+	}
+
+	variant, err := FindVariant(db, slug, item, spec)
 	if err == mgo.ErrNotFound {
-		NotFound("No such channel " + slug)
-	} else if err != nil {
-		InternalError("Could not fetch channel info from database")
+		var data []byte
+		data, err = self.blobs.ReadItem(db, item)
+		if err == nil {
+			variant, err = NewVariant(slug, item, data, spec)
+		}
+		if err == ErrNotImage {
+			BadRequest("Item " + itemSlug + " is not a JPEG, PNG or GIF image")
+		} else if err == nil {
+			cacheErr := PutVariant(db, variant)
+			if cacheErr != nil {
+				warnf("Could not cache a variant of %s/%s: %s", slug, itemSlug, cacheErr.Error())
+			}
+		}
+	}
+	if err != nil {
+		InternalError("Could not resize item " + itemSlug)
 	}
+	c.Writer.Header().Set("X-Image-Type", variant.ContentType)
+	c.String(http.StatusOK, base64.StdEncoding.EncodeToString(variant.Data))
+}
 
+//writeItemData sends an item's data base64-encoded, encoding blobs as
+//they are read.
+func (self *Config) writeItemData(c *gin.Context, db *mgo.Database, item *ItemDBRecord) {
+	if item.Hash == "" {
+		c.String(http.StatusOK, item.Data)
+		return
+	}
+	reader, _, err := self.blobs.Open(db, item.Hash)
+	if err != nil {
+		InternalError("Could not read the data of item " + item.Slug)
+	}
+	defer reader.Close()
+	c.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	c.Writer.WriteHeader(http.StatusOK)
+	encoder := base64.NewEncoder(base64.StdEncoding, c.Writer)
+	_, err = io.Copy(encoder, reader)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		//Too late for an error response; the client gets truncated data.
+		errorf("Sending the data of item %s failed: %s", item.Slug, err.Error())
+	}
+}
+
+//checkItemData makes sure every inline item in a channel can be decoded
+//before a download starts, while there is still time to fail.
+func checkItemData(chanRec *ChannelDBRecord) {
 	for _, item := range chanRec.Items {
-		if item.Slug == itemSlug {
-			c.JSON(http.StatusOK, item.ToJSON())
-			return
+		if item.Hash == "" && !validBase64(item.Data) {
+			InternalError("Item " + item.Slug + " has corrupt data")
 		}
 	}
-	NotFound("Channel " + slug + " has no item " + itemSlug)
 }
 
-func (self *Config) GetChannelItemData(c *gin.Context) {
-	slug := c.Params.ByName("slug")
-	itemSlug := c.Params.ByName("itemSlug")
-	var chanRec ChannelDBRecord
-	err := self.chancoll.FindId(slug).One(&chanRec)
+func (self *Config) ExportChannel(c *gin.Context) {
+	_ = forceAuth(c)
+	slug := channelSlug(c)
+	chanRec := fetchReadableChannel(c, slug)
+	checkItemData(chanRec)
+
+	c.Writer.Header().Set("Content-Type", "application/x-tar")
+	c.Writer.Header().Set("Content-Disposition", "attachment; filename=\""+channelFilename(slug)+".tar\"")
+	c.Writer.WriteHeader(http.StatusOK)
+	err := WriteChannelArchive(c.Writer, chanRec, self.blobs.itemOpener(requestDB(c)))
+	if err != nil {
+		//Too late for an error response; the client gets a truncated tar.
+		errorf("Export of channel %s failed: %s", slug, err.Error())
+	}
+}
+
+//ImportChannel recreates a channel from an archive made by
+//ExportChannel, under the slug in the URL.  A missing channel is created
+//and owned by the importer; an existing one may only be imported into by
+//its owners, since the archive's settings replace its own, and items with
+//matching slugs are replaced.  Items keep their original uploader and
+//upload date.  Nothing is changed unless every item passes the checks.
+func (self *Config) ImportChannel(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	manifest, items, err := ReadChannelArchive(c.Request.Body)
+	if err != nil {
+		BadRequest(err.Error())
+	}
+
+	db := requestDB(c)
+	chanRec, err := FindChannel(db, slug)
+	exists := err == nil
 	if err == mgo.ErrNotFound {
-		NotFound("No such channel " + slug)
+		title := manifest.Channel.Title
+		if title == "" {
+			title = slug
+		}
+		chanRec = newChannelFor(c, slug, title, username)
 	} else if err != nil {
 		InternalError("Could not fetch channel info from database")
+	} else {
+		checkCanRead(c, chanRec)
+		checkRole(chanRec, username, RoleOwner)
+	}
+	changes := manifestSettings(chanRec, manifest.Channel)
+	for _, item := range items {
+		checkUpload(chanRec, item)
+		processUpload(chanRec, item)
 	}
 
-	for _, item := range chanRec.Items {
-		if item.Slug == itemSlug {
-			c.String(http.StatusOK, item.Data)
-			return
+	if exists {
+		err = UpdateChannel(db, slug, changes)
+		if err != nil {
+			InternalError("Could not update channel settings")
 		}
+	} else {
+		err = AddChannel(db, chanRec)
+		if err != nil {
+			BadRequest(err.Error())
+		}
+	}
+	for _, item := range items {
+		replaced, data := self.storeItem(db, slug, item)
+		makeThumbnail(db, slug, item, data)
+		self.publishPut(c, slug, item, replaced)
+	}
+	c.String(http.StatusOK, ChannelPath(slug))
+}
+
+//GetChannelItemZip streams a zip of every item in a channel.  Each item
+//is decoded straight into the response, so the archive is never held
+//in memory.
+func (self *Config) GetChannelItemZip(c *gin.Context) {
+	slug := channelSlug(c)
+	chanRec := fetchReadableChannel(c, slug)
+	checkItemData(chanRec)
+
+	c.Writer.Header().Set("Content-Type", "application/zip")
+	c.Writer.Header().Set("Content-Disposition", "attachment; filename=\""+channelFilename(slug)+".zip\"")
+	c.Writer.WriteHeader(http.StatusOK)
+	err := WriteItemZip(c.Writer, chanRec, self.blobs.itemOpener(requestDB(c)))
+	if err != nil {
+		//Too late for an error response; the client gets a truncated zip.
+		errorf("Zip of channel %s failed: %s", slug, err.Error())
 	}
-	NotFound("Channel " + slug + " has no item " + itemSlug)
 }
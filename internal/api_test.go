@@ -1,18 +1,26 @@
 package api
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"github.com/drewolson/testflight"
+	"github.com/gorilla/websocket"
 	. "gopkg.in/check.v1"
+	"image"
+	_ "image/jpeg"
 	"io"
 	"io/ioutil"
 	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -56,31 +64,14 @@ var (
 )
 
 func createUser(username string, usercoll *mgo.Collection) (*UserDBRecord, error) {
-	userrec := &UserDBRecord{
-		Username:      username,
-		Subscriptions: make([]string, 0),
-	}
-	err := usercoll.Insert(userrec)
-	return userrec, err
+	return InsertUser(usercoll.Database, username)
 }
 
 func createChannel(slug, title, owner string, chancoll *mgo.Collection) (*ChannelDBRecord, error) {
-	chanrec := &ChannelDBRecord{
-		Slug:  slug,
-		Title: title,
-		Owner: owner,
-		Items: make([]ItemDBRecord, 0),
-	}
-	err := chancoll.Insert(chanrec)
-	return chanrec, err
+	return InsertChannel(chancoll.Database, slug, title, owner)
 }
 
 func createItem(chanSlug, slug, title string, dateUploaded time.Time, b64data, uploader string, chancoll *mgo.Collection) (*ItemDBRecord, error) {
-	var chanrec ChannelDBRecord
-	err := chancoll.FindId(chanSlug).One(&chanrec)
-	if err != nil {
-		return nil, err
-	}
 	itemrec := &ItemDBRecord{
 		Slug:         slug,
 		Title:        title,
@@ -88,8 +79,7 @@ func createItem(chanSlug, slug, title string, dateUploaded time.Time, b64data, u
 		Data:         b64data,
 		Uploader:     uploader,
 	}
-	chanrec.Items = append(chanrec.Items, *itemrec)
-	err = chancoll.UpdateId(chanSlug, chanrec)
+	err := AddItem(chancoll.Database, chanSlug, itemrec)
 	return itemrec, err
 }
 
@@ -97,23 +87,23 @@ func (self *ApiSuite) loadTestData(c *C) {
 	c.Log("Loading test data...")
 	dataDir := os.Getenv("TEST_DATADIR")
 
-	self.apiConfig.usercoll.Create(&mgo.CollectionInfo{
+	self.apiConfig.db.C(usersCollection).Create(&mgo.CollectionInfo{
 		DisableIdIndex: false,
 		ForceIdIndex:   false,
 		Capped:         false,
 	})
-	self.apiConfig.chancoll.Create(&mgo.CollectionInfo{
+	self.apiConfig.db.C(channelsCollection).Create(&mgo.CollectionInfo{
 		DisableIdIndex: false,
 		ForceIdIndex:   false,
 		Capped:         false,
 	})
 
-	_, err := createUser(self.user1.Username, self.apiConfig.usercoll)
+	_, err := createUser(self.user1.Username, self.apiConfig.db.C(usersCollection))
 	c.Assert(err, IsNil)
-	_, err = createUser(self.user2.Username, self.apiConfig.usercoll)
+	_, err = createUser(self.user2.Username, self.apiConfig.db.C(usersCollection))
 	c.Assert(err, IsNil)
 	//Intentionally omitted; we don't want this user to exist.
-	//createUser(self.baduser1.Username, self.apiConfig.usercoll)
+	//createUser(self.baduser1.Username, self.apiConfig.db.C(usersCollection))
 
 	self.chan1Rec = &ChannelJSONRecord{
 		Slug:  "test-channel-1",
@@ -124,7 +114,7 @@ func (self *ApiSuite) loadTestData(c *C) {
 		self.chan1Rec.Slug,
 		self.chan1Rec.Title,
 		self.user1.Username,
-		self.apiConfig.chancoll,
+		self.apiConfig.db.C(channelsCollection),
 	)
 	c.Assert(err, IsNil)
 
@@ -137,7 +127,7 @@ func (self *ApiSuite) loadTestData(c *C) {
 		self.chan2Rec.Slug,
 		self.chan2Rec.Title,
 		self.user2.Username,
-		self.apiConfig.chancoll,
+		self.apiConfig.db.C(channelsCollection),
 	)
 	c.Assert(err, IsNil)
 
@@ -152,7 +142,7 @@ func (self *ApiSuite) loadTestData(c *C) {
 	b64DataItem1 := base64.StdEncoding.EncodeToString(rawDataItem1)
 	createItem(self.chan1Rec.Slug, self.item1Rec.Slug, self.item1Rec.Title,
 		self.item1Rec.DateUploaded, b64DataItem1, self.item1Rec.Uploader,
-		self.apiConfig.chancoll)
+		self.apiConfig.db.C(channelsCollection))
 
 	self.item2Rec = &ItemJSONRecord{
 		Slug:         "test-item-2",
@@ -165,7 +155,7 @@ func (self *ApiSuite) loadTestData(c *C) {
 	b64DataItem2 := base64.StdEncoding.EncodeToString(rawDataItem2)
 	createItem(self.chan1Rec.Slug, self.item2Rec.Slug, self.item2Rec.Title,
 		self.item2Rec.DateUploaded, b64DataItem2, self.item2Rec.Uploader,
-		self.apiConfig.chancoll)
+		self.apiConfig.db.C(channelsCollection))
 
 	c.Log("Test data loaded!")
 }
@@ -184,7 +174,7 @@ func (self *ApiSuite) SetUpSuite(c *C) {
 	session, err := mgo.Dial(dburl)
 	c.Assert(err, IsNil)
 
-	self.apiConfig = NewConfig(session, "testing")
+	self.apiConfig = NewConfig(session, "testing", DefaultOptions())
 	self.loadTestData(c)
 }
 
@@ -446,7 +436,7 @@ func (self *ApiSuite) TestGetItemGoodAuth(c *C) {
 		err = json.Unmarshal(response.RawBody, &item)
 		if err != nil {
 			var chanDB ChannelDBRecord
-			err = self.apiConfig.chancoll.FindId(self.chan1Rec.Slug).One(&chanDB)
+			err = self.apiConfig.db.C(channelsCollection).FindId(self.chan1Rec.Slug).One(&chanDB)
 			c.Assert(err, IsNil)
 			for _, itm := range chanDB.Items {
 				c.Log("Slug: " + itm.Slug + "; Title: " + itm.Title)
@@ -513,7 +503,7 @@ func (self *ApiSuite) TestCreateItem(c *C) {
 		err = json.Unmarshal(response.RawBody, &item)
 		if err != nil {
 			var chanDB ChannelDBRecord
-			err = self.apiConfig.chancoll.FindId(self.chan1Rec.Slug).One(&chanDB)
+			err = self.apiConfig.db.C(channelsCollection).FindId(self.chan1Rec.Slug).One(&chanDB)
 			c.Assert(err, IsNil)
 			for _, itm := range chanDB.Items {
 				c.Log("Slug: " + itm.Slug + "; Title: " + itm.Title)
@@ -533,3 +523,1427 @@ func (self *ApiSuite) TestCreateItem(c *C) {
 		c.Assert(response.Body, Equals, b64DataNewItem)
 	})
 }
+
+func (self *ApiSuite) TestCreateItemReplacesExisting(c *C) {
+	path := "/channel/" + self.chan1Rec.Slug + "/item"
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		for _, title := range []string{"First Version", "Second Version"} {
+			params := url.Values{}
+			params.Add("title", title)
+			params.Add("b64data", base64.StdEncoding.EncodeToString([]byte(title)))
+			params.Add("itemSlug", "replaced-item")
+			response, err := self.authPost(r, self.user1.Username, path, params)
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusOK)
+		}
+
+		response, err := self.unAuthGet(r, path)
+		c.Assert(err, IsNil)
+		results := make(map[string]string)
+		err = json.Unmarshal(response.RawBody, &results)
+		c.Assert(err, IsNil)
+		c.Assert(results["replaced-item"], Equals, "Second Version")
+
+		var chanDB ChannelDBRecord
+		err = self.apiConfig.db.C(channelsCollection).FindId(self.chan1Rec.Slug).One(&chanDB)
+		c.Assert(err, IsNil)
+		count := 0
+		for _, item := range chanDB.Items {
+			if item.Slug == "replaced-item" {
+				count++
+			}
+		}
+		c.Assert(count, Equals, 1)
+	})
+}
+
+func (self *ApiSuite) TestDeleteItem(c *C) {
+	_, err := createItem(self.chan1Rec.Slug, "doomed-item", "Doomed Item", time.Now(),
+		base64.StdEncoding.EncodeToString([]byte("doomed")), self.user1.Username,
+		self.apiConfig.db.C(channelsCollection))
+	c.Assert(err, IsNil)
+	path := "/channel/" + self.chan1Rec.Slug + "/item/doomed-item"
+
+	self.CheckBadAuth(c, "DELETE", path)
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.authDo(r, self.user2.Username, "DELETE", path, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+
+		response, err = self.authDo(r, self.user1.Username, "DELETE", path, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+
+		response, err = self.unAuthGet(r, path)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+
+		response, err = self.authDo(r, self.user1.Username, "DELETE", path, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+	})
+}
+
+func (self *ApiSuite) TestExportImportChannel(c *C) {
+	settings := bson.M{
+		"strip_exif":     true,
+		"allowed_types":  []string{"image/*"},
+		"max_item_bytes": int64(8 << 20),
+		"visibility":     VisibilityAuthenticated,
+	}
+	err := UpdateChannel(self.apiConfig.db, self.chan1Rec.Slug, settings)
+	c.Assert(err, IsNil)
+	defer UpdateChannel(self.apiConfig.db, self.chan1Rec.Slug, bson.M{
+		"strip_exif":     false,
+		"allowed_types":  []string{},
+		"max_item_bytes": int64(0),
+		"visibility":     VisibilityPublic,
+	})
+
+	var archive []byte
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.unAuthGet(r, "/channel/"+self.chan1Rec.Slug+"/export")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+
+		response, err = self.authGet(r, self.user2.Username, "/channel/"+self.chan1Rec.Slug+"/export")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(response.Header.Get("Content-Type"), Equals, "application/x-tar")
+		archive = response.RawBody
+	})
+
+	manifest, items, err := ReadChannelArchive(bytes.NewReader(archive))
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Channel.Slug, Equals, self.chan1Rec.Slug)
+	c.Assert(manifest.Owner, Equals, self.user1.Username)
+	c.Assert(manifest.Files[self.item1Rec.Slug], Equals, "items/"+self.item1Rec.Slug+".jpg")
+
+	var original ChannelDBRecord
+	err = self.apiConfig.db.C(channelsCollection).FindId(self.chan1Rec.Slug).One(&original)
+	c.Assert(err, IsNil)
+	c.Assert(len(items), Equals, len(original.Items))
+
+	headers := map[string]string{"Content-Type": "application/x-tar"}
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.authDo(r, self.user2.Username, "POST", "/channel/imported-channel/import", archive, headers)
+		c.Assert(err, IsNil)
+		c.Log(response.Body)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+		response, err = self.authDo(r, self.user1.Username, "POST", "/channel/imported-channel/import", archive, headers)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+
+		//Maintainers can't import; it may change the channel's settings.
+		_, err = SetMember(self.apiConfig.db, "imported-channel", self.user1.Username, RoleMaintainer)
+		c.Assert(err, IsNil)
+		response, err = self.authDo(r, self.user1.Username, "POST", "/channel/imported-channel/import", archive, headers)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+
+		response, err = self.authDo(r, self.user2.Username, "POST", "/channel/garbage-channel/import", []byte("not a tar file"), headers)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+		//An archive whose items fail the checks changes nothing.
+		tooSmall := original
+		tooSmall.MaxItemBytes = 1
+		var rejected bytes.Buffer
+		err = WriteChannelArchive(&rejected, &tooSmall, self.apiConfig.blobs.itemOpener(self.apiConfig.db))
+		c.Assert(err, IsNil)
+		for _, chanPath := range []string{"/channel/rejected-channel", "/channel/imported-channel"} {
+			response, err = self.authDo(r, self.user2.Username, "POST", chanPath+"/import", rejected.Bytes(), headers)
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Not(Equals), http.StatusOK)
+		}
+		_, err = FindChannel(self.apiConfig.db, "rejected-channel")
+		c.Assert(err, Equals, mgo.ErrNotFound)
+	})
+
+	var imported ChannelDBRecord
+	err = self.apiConfig.db.C(channelsCollection).FindId("imported-channel").One(&imported)
+	c.Assert(err, IsNil)
+	c.Assert(imported.Owner, Equals, self.user2.Username)
+	c.Assert(imported.Title, Equals, original.Title)
+	c.Assert(imported.StripEXIF, Equals, true)
+	c.Assert(imported.AllowedTypes, DeepEquals, []string{"image/*"})
+	c.Assert(imported.MaxItemBytes, Equals, int64(8<<20))
+	c.Assert(imported.Visibility, Equals, VisibilityAuthenticated)
+	for _, item := range original.Items {
+		copied := imported.FindItem(item.Slug)
+		c.Assert(copied, NotNil)
+		c.Assert(copied.Title, Equals, item.Title)
+		c.Assert(copied.Uploader, Equals, item.Uploader)
+		c.Assert(copied.DateUploaded.Equal(item.DateUploaded), Equals, true)
+		//The imported channel strips metadata, so expect what that leaves.
+		expected := &ItemDBRecord{Data: item.Data}
+		err = ProcessItem(&imported, expected)
+		c.Assert(err, IsNil)
+		raw, err := base64.StdEncoding.DecodeString(expected.Data)
+		c.Assert(err, IsNil)
+		c.Assert(copied.Hash, Equals, HashData(raw))
+		c.Assert(copied.Data, Equals, "")
+	}
+}
+
+func (self *ApiSuite) TestGetItemZip(c *C) {
+	dataDir := os.Getenv("TEST_DATADIR")
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.unAuthGet(r, "/channel/nosuchchannel/item.zip")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+
+		response, err = self.unAuthGet(r, "/channel/"+self.chan1Rec.Slug+"/item.zip")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(response.Header.Get("Content-Type"), Equals, "application/zip")
+
+		archive, err := zip.NewReader(bytes.NewReader(response.RawBody), int64(len(response.RawBody)))
+		c.Assert(err, IsNil)
+		files := make(map[string]*zip.File)
+		for _, file := range archive.File {
+			files[file.Name] = file
+		}
+		for slug, name := range map[string]string{self.item1Rec.Slug: "item1.jpg", self.item2Rec.Slug: "item2.jpg"} {
+			file, ok := files[slug+".jpg"]
+			c.Assert(ok, Equals, true)
+			reader, err := file.Open()
+			c.Assert(err, IsNil)
+			contents, err := ioutil.ReadAll(reader)
+			reader.Close()
+			c.Assert(err, IsNil)
+			expected, err := ioutil.ReadFile(filepath.Join(dataDir, name))
+			c.Assert(err, IsNil)
+			c.Assert(bytes.Equal(contents, expected), Equals, true)
+		}
+	})
+}
+
+//readSSE reads one event from an SSE stream, skipping comments and
+//retry hints.
+func readSSE(reader *bufio.Reader) (map[string]string, error) {
+	fields := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if _, ok := fields["event"]; ok {
+				return fields, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+}
+
+func (self *ApiSuite) openEvents(c *C, server *httptest.Server, lastID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest("GET", server.URL+"/channel/"+self.chan2Rec.Slug+"/events", nil)
+	c.Assert(err, IsNil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	response, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Content-Type"), Equals, "text/event-stream")
+	return response, bufio.NewReader(response.Body)
+}
+
+func (self *ApiSuite) TestChannelEvents(c *C) {
+	server := httptest.NewServer(self.apiConfig.GetRouter())
+	defer server.Close()
+
+	response, reader := self.openEvents(c, server, "")
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		for _, title := range []string{"Evented", "Evented Again"} {
+			params := url.Values{}
+			params.Add("title", title)
+			params.Add("b64data", base64.StdEncoding.EncodeToString([]byte(title)))
+			params.Add("itemSlug", "evented-item")
+			response, err := self.authPost(r, self.user2.Username, "/channel/"+self.chan2Rec.Slug+"/item", params)
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusOK)
+		}
+		response, err := self.authDo(r, self.user2.Username, "DELETE", "/channel/"+self.chan2Rec.Slug+"/item/evented-item", nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+	})
+
+	var first map[string]string
+	for _, expected := range []string{EventItemCreated, EventItemUpdated, EventItemDeleted} {
+		fields, err := readSSE(reader)
+		c.Assert(err, IsNil)
+		c.Assert(fields["event"], Equals, expected)
+		var event Event
+		err = json.Unmarshal([]byte(fields["data"]), &event)
+		c.Assert(err, IsNil)
+		c.Assert(event.Channel, Equals, self.chan2Rec.Slug)
+		c.Assert(event.ItemSlug, Equals, "evented-item")
+		if first == nil {
+			first = fields
+		}
+	}
+	response.Body.Close()
+
+	response, reader = self.openEvents(c, server, first["id"])
+	defer response.Body.Close()
+	fields, err := readSSE(reader)
+	c.Assert(err, IsNil)
+	c.Assert(fields["event"], Equals, EventItemUpdated)
+	fields, err = readSSE(reader)
+	c.Assert(err, IsNil)
+	c.Assert(fields["event"], Equals, EventItemDeleted)
+}
+
+func (self *ApiSuite) TestEventSocket(c *C) {
+	server := httptest.NewServer(self.apiConfig.GetRouter())
+	defer server.Close()
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+
+	_, response, err := websocket.DefaultDialer.Dial(socketURL, nil)
+	c.Assert(err, NotNil)
+	c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer SUP3R_S33CR37:"+self.user1.Username)
+	conn, _, err := websocket.DefaultDialer.Dial(socketURL, header)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	var reply SocketReply
+	err = conn.WriteJSON(&SocketRequest{"subscribe", []string{"no-such-channel"}})
+	c.Assert(err, IsNil)
+	err = conn.ReadJSON(&reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Type, Equals, "error")
+
+	err = conn.WriteJSON(&SocketRequest{"subscribe", []string{self.chan1Rec.Slug, self.chan2Rec.Slug}})
+	c.Assert(err, IsNil)
+	err = conn.ReadJSON(&reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Type, Equals, "subscribed")
+
+	self.apiConfig.events.Publish(EventItemCreated, self.chan1Rec.Slug, "one", nil)
+	self.apiConfig.events.Publish(EventItemCreated, self.chan2Rec.Slug, "two", nil)
+	for _, expected := range []string{self.chan1Rec.Slug, self.chan2Rec.Slug} {
+		var event Event
+		err = conn.ReadJSON(&event)
+		c.Assert(err, IsNil)
+		c.Assert(event.Type, Equals, EventItemCreated)
+		c.Assert(event.Channel, Equals, expected)
+	}
+
+	err = conn.WriteJSON(&SocketRequest{"unsubscribe", []string{self.chan1Rec.Slug}})
+	c.Assert(err, IsNil)
+	err = conn.ReadJSON(&reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Type, Equals, "unsubscribed")
+	self.apiConfig.events.Publish(EventItemDeleted, self.chan1Rec.Slug, "one", nil)
+	self.apiConfig.events.Publish(EventItemDeleted, self.chan2Rec.Slug, "two", nil)
+	var event Event
+	err = conn.ReadJSON(&event)
+	c.Assert(err, IsNil)
+	c.Assert(event.Channel, Equals, self.chan2Rec.Slug)
+
+	//Repeats and channels already subscribed to don't count towards the
+	//limit.
+	slugs := make([]string, socketMaxChannels+1)
+	for i := range slugs {
+		slugs[i] = self.chan2Rec.Slug
+	}
+	err = conn.WriteJSON(&SocketRequest{"subscribe", slugs})
+	c.Assert(err, IsNil)
+	err = conn.ReadJSON(&reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Type, Equals, "subscribed")
+}
+
+func (self *ApiSuite) TestEventSocketToken(c *C) {
+	server := httptest.NewServer(self.apiConfig.GetRouter())
+	defer server.Close()
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+
+	//Browsers send the token as a subprotocol.
+	sessrec, token, err := InsertSession(self.apiConfig.db, self.user1.Username, "test", "127.0.0.1", time.Hour)
+	c.Assert(err, IsNil)
+	defer RemoveSession(self.apiConfig.db, self.user1.Username, sessrec.Id.Hex())
+	dialer := websocket.Dialer{Subprotocols: []string{socketProtocol, socketTokenPrefix + token}}
+	conn, _, err := dialer.Dial(socketURL, nil)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.Subprotocol(), Equals, socketProtocol)
+
+	err = conn.WriteJSON(&SocketRequest{"subscribe", []string{self.chan1Rec.Slug}})
+	c.Assert(err, IsNil)
+	var reply SocketReply
+	err = conn.ReadJSON(&reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Type, Equals, "subscribed")
+
+	dialer.Subprotocols = []string{socketProtocol, socketTokenPrefix + "tfs_nonsense"}
+	_, response, err := dialer.Dial(socketURL, nil)
+	c.Assert(err, NotNil)
+	c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (self *ApiSuite) TestWebhooks(c *C) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- req
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	//The receiver is on loopback, which webhooks may only reach when
+	//allowed to.
+	dispatcher := newWebhookDispatcher(self.apiConfig.session, self.apiConfig.db.Name, true)
+	dispatcher.pollEvery = 50 * time.Millisecond
+	dispatcher.retryDelay = 10 * time.Millisecond
+	self.apiConfig.webhooks = dispatcher
+	go dispatcher.run()
+	defer func() {
+		dispatcher.Stop()
+		self.apiConfig.webhooks = nil
+	}()
+
+	var hook WebhookJSONRecord
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		hooksPath := "/channel/" + self.chan2Rec.Slug + "/webhooks"
+		params := url.Values{}
+		params.Add("url", receiver.URL+"/hook")
+		params.Add("events", "item-created")
+		response, err := self.authPost(r, self.user1.Username, hooksPath, params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+		params.Set("url", "file:///etc/passwd")
+		response, err = self.authPost(r, self.user2.Username, hooksPath, params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+		params.Set("url", receiver.URL+"/hook")
+		response, err = self.authPost(r, self.user2.Username, hooksPath, params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+		self.apiConfig.opts.WebhookAllowInternal = true
+		defer func() { self.apiConfig.opts.WebhookAllowInternal = false }()
+		response, err = self.authPost(r, self.user2.Username, hooksPath, params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		err = json.Unmarshal([]byte(response.Body), &hook)
+		c.Assert(err, IsNil)
+		c.Assert(hook.Secret, Not(Equals), "")
+
+		params = url.Values{}
+		params.Add("title", "Hooked")
+		params.Add("b64data", base64.StdEncoding.EncodeToString([]byte("hooked")))
+		params.Add("itemSlug", "hooked-item")
+		response, err = self.authPost(r, self.user2.Username, "/channel/"+self.chan2Rec.Slug+"/item", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+		select {
+		case req := <-received:
+			body := <-bodies
+			c.Assert(req.Header.Get("X-Testflight-Event"), Equals, EventItemCreated)
+			c.Assert(req.Header.Get("X-Testflight-Signature"), Equals, SignPayload(hook.Secret, body))
+			var event Event
+			err = json.Unmarshal(body, &event)
+			c.Assert(err, IsNil)
+			c.Assert(event.ItemSlug, Equals, "hooked-item")
+		case <-time.After(5 * time.Second):
+			c.Fatal("Webhook was not delivered")
+		}
+
+		//Deleting isn't an event this webhook asked for.
+		response, err = self.authDo(r, self.user2.Username, "DELETE", "/channel/"+self.chan2Rec.Slug+"/item/hooked-item", nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+
+		var deliveries []DeliveryJSONRecord
+		for attempt := 0; attempt < 50; attempt++ {
+			response, err = self.authGet(r, self.user2.Username, hooksPath+"/"+hook.ID+"/deliveries")
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusOK)
+			err = json.Unmarshal([]byte(response.Body), &deliveries)
+			c.Assert(err, IsNil)
+			if len(deliveries) == 1 && deliveries[0].Status == DeliveryDelivered {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		c.Assert(deliveries, HasLen, 1)
+		c.Assert(deliveries[0].Status, Equals, DeliveryDelivered)
+		c.Assert(deliveries[0].Attempts, Equals, 2)
+		c.Assert(deliveries[0].LastStatus, Equals, http.StatusOK)
+
+		//The log keeps the newest maxDeliveryLog finished deliveries.
+		hookID := bson.ObjectIdHex(hook.ID)
+		for i := 0; i < maxDeliveryLog+5; i++ {
+			err = self.apiConfig.db.C(deliveriesCollection).Insert(&DeliveryDBRecord{
+				Id:      bson.NewObjectId(),
+				Webhook: hookID,
+				Status:  DeliveryFailed,
+			})
+			c.Assert(err, IsNil)
+		}
+		err = PruneDeliveries(self.apiConfig.db, hookID)
+		c.Assert(err, IsNil)
+		count, err := self.apiConfig.db.C(deliveriesCollection).Find(bson.M{"webhook": hookID}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, maxDeliveryLog)
+
+		response, err = self.authDo(r, self.user2.Username, "DELETE", hooksPath+"/"+hook.ID, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		response, err = self.authGet(r, self.user2.Username, hooksPath+"/"+hook.ID+"/deliveries")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+	})
+}
+
+func (self *ApiSuite) TestGetItemDataResized(c *C) {
+	dataPath := "/channel/" + self.chan1Rec.Slug + "/item/" + self.item1Rec.Slug + "/data"
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		for _, bad := range []string{"?w=0", "?w=abc", "?h=100000", "?w=63&h=65", "?w=64&fit=squash"} {
+			response, err := self.unAuthGet(r, dataPath+bad)
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusBadRequest, Commentf("%s", bad))
+		}
+
+		for attempt := 0; attempt < 2; attempt++ {
+			response, err := self.unAuthGet(r, dataPath+"?w=64&h=64&fit=cover")
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusOK)
+			c.Assert(response.RawResponse.Header.Get("X-Image-Type"), Equals, "image/jpeg")
+			data, err := base64.StdEncoding.DecodeString(response.Body)
+			c.Assert(err, IsNil)
+			config, _, err := image.DecodeConfig(bytes.NewReader(data))
+			c.Assert(err, IsNil)
+			c.Assert(config.Width, Equals, 64)
+			c.Assert(config.Height, Equals, 64)
+		}
+		count, err := self.apiConfig.db.C(variantsCollection).Find(map[string]string{"item": self.item1Rec.Slug}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, 1)
+
+		//Uploading an image makes its thumbnail straight away; uploading
+		//something else doesn't.
+		jpegData, err := base64.StdEncoding.DecodeString(self.getItemData(c, r, dataPath))
+		c.Assert(err, IsNil)
+		for slug, data := range map[string][]byte{"photo": jpegData, "notes": []byte("not a picture")} {
+			params := url.Values{}
+			params.Add("title", slug)
+			params.Add("b64data", base64.StdEncoding.EncodeToString(data))
+			params.Add("itemSlug", slug)
+			response, err := self.authPost(r, self.user2.Username, "/channel/"+self.chan2Rec.Slug+"/item", params)
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusOK)
+		}
+		count, err = self.apiConfig.db.C(variantsCollection).Find(map[string]string{"item": "photo"}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, 1)
+		count, err = self.apiConfig.db.C(variantsCollection).Find(map[string]string{"item": "notes"}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, 0)
+		response, err := self.unAuthGet(r, "/channel/"+self.chan2Rec.Slug+"/item/notes/data?w=64")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+		response, err = self.authDo(r, self.user2.Username, "DELETE", "/channel/"+self.chan2Rec.Slug+"/item/photo", nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		count, err = self.apiConfig.db.C(variantsCollection).Find(map[string]string{"item": "photo"}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, 0)
+	})
+}
+
+func (self *ApiSuite) TestImportItem(c *C) {
+	db := self.apiConfig.db
+	itemrec := NewItem("imported", "Imported", base64.StdEncoding.EncodeToString(exifJPEG(c)), self.user2.Username)
+	err := ImportItem(db, self.apiConfig.blobs, self.chan2Rec.Slug, itemrec)
+	c.Assert(err, IsNil)
+	defer RemoveItem(db, self.chan2Rec.Slug, "imported")
+
+	chanrec, err := FindChannel(db, self.chan2Rec.Slug)
+	c.Assert(err, IsNil)
+	c.Assert(chanrec.FindItem("imported"), NotNil)
+	count, err := db.C(variantsCollection).Find(map[string]string{"item": "imported"}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+}
+
+func (self *ApiSuite) getItemData(c *C, r *testflight.Requester, dataPath string) string {
+	response, err := self.unAuthGet(r, dataPath)
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	return response.Body
+}
+
+func (self *ApiSuite) TestStripEXIF(c *C) {
+	chanPath := "/channel/" + self.chan2Rec.Slug
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		settings := url.Values{}
+		settings.Add("strip_exif", "true")
+		response, err := self.authDo(r, self.user1.Username, "PUT", chanPath, []byte(settings.Encode()),
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+		response, err = self.authDo(r, self.user2.Username, "PUT", chanPath, []byte("strip_exif=maybe"),
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+		response, err = self.authDo(r, self.user2.Username, "PUT", chanPath, []byte(settings.Encode()),
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		defer UpdateChannel(self.apiConfig.db, self.chan2Rec.Slug, bson.M{"strip_exif": false})
+
+		response, err = self.authGet(r, self.user2.Username, chanPath)
+		c.Assert(err, IsNil)
+		var chanJSON ChannelJSONRecord
+		err = json.Unmarshal(response.RawBody, &chanJSON)
+		c.Assert(err, IsNil)
+		c.Assert(chanJSON.StripEXIF, Equals, true)
+
+		params := url.Values{}
+		params.Add("title", "Located")
+		params.Add("b64data", base64.StdEncoding.EncodeToString(exifJPEG(c)))
+		params.Add("itemSlug", "located")
+		response, err = self.authPost(r, self.user2.Username, chanPath+"/item", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+		response, err = self.authGet(r, self.user2.Username, chanPath+"/item/located")
+		c.Assert(err, IsNil)
+		var item ItemJSONRecord
+		err = json.Unmarshal(response.RawBody, &item)
+		c.Assert(err, IsNil)
+		c.Assert(item.Metadata, NotNil)
+		c.Assert(item.Metadata.Width, Equals, 40)
+		c.Assert(item.Metadata.CameraMake, Equals, "TestCam")
+		c.Assert(item.Metadata.Orientation, Equals, 6)
+		c.Assert(item.Metadata.Location, IsNil)
+
+		data, err := base64.StdEncoding.DecodeString(self.getItemData(c, r, chanPath+"/item/located/data"))
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Contains(data, []byte("TestCam")), Equals, false)
+	})
+}
+
+func (self *ApiSuite) TestUploadLimits(c *C) {
+	chanPath := "/channel/" + self.chan2Rec.Slug
+	upload := func(r *testflight.Requester, slug string, b64data string) *testflight.Response {
+		params := url.Values{}
+		params.Add("title", slug)
+		params.Add("b64data", b64data)
+		params.Add("itemSlug", slug)
+		response, err := self.authPost(r, self.user2.Username, chanPath+"/item", params)
+		c.Assert(err, IsNil)
+		return response
+	}
+	errorCode := func(response *testflight.Response) string {
+		var report AjaxErrorReport
+		err := json.Unmarshal(response.RawBody, &report)
+		c.Assert(err, IsNil)
+		return report.Code
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response := upload(r, "garbage", "not*base64")
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+		c.Assert(errorCode(response), Equals, CodeInvalidBase64)
+
+		settings := url.Values{}
+		settings.Add("allowed_types", "image/*")
+		settings.Add("max_item_bytes", "2000")
+		response, err := self.authDo(r, self.user2.Username, "PUT", chanPath, []byte(settings.Encode()),
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		defer UpdateChannel(self.apiConfig.db, self.chan2Rec.Slug, bson.M{"allowed_types": []string{}, "max_item_bytes": 0})
+
+		response = upload(r, "notes", base64.StdEncoding.EncodeToString([]byte("just text")))
+		c.Assert(response.StatusCode, Equals, http.StatusUnsupportedMediaType)
+		c.Assert(errorCode(response), Equals, CodeTypeNotAllowed)
+
+		big := append(exifJPEG(c), make([]byte, 2000)...)
+		response = upload(r, "big", base64.StdEncoding.EncodeToString(big))
+		c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+		c.Assert(errorCode(response), Equals, CodeItemTooLarge)
+
+		photo := exifJPEG(c)
+		response = upload(r, "small-photo", base64.StdEncoding.EncodeToString(photo))
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		response, err = self.authGet(r, self.user2.Username, chanPath+"/item/small-photo")
+		c.Assert(err, IsNil)
+		var item ItemJSONRecord
+		err = json.Unmarshal(response.RawBody, &item)
+		c.Assert(err, IsNil)
+		c.Assert(item.ContentType, Equals, "image/jpeg")
+		c.Assert(item.Size, Equals, int64(len(photo)))
+
+		response, err = self.authGet(r, self.user2.Username, chanPath)
+		c.Assert(err, IsNil)
+		var chanJSON ChannelJSONRecord
+		err = json.Unmarshal(response.RawBody, &chanJSON)
+		c.Assert(err, IsNil)
+		c.Assert(chanJSON.AllowedTypes, DeepEquals, []string{"image/*"})
+		c.Assert(chanJSON.MaxItemBytes, Equals, int64(2000))
+	})
+}
+
+//A streamed upload has no Content-Length, so it only runs into the
+//body limit while the form is being read.
+func (self *ApiSuite) TestStreamedUploadTooLarge(c *C) {
+	maxBytes := self.apiConfig.opts.MaxUploadBytes
+	self.apiConfig.opts.MaxUploadBytes = 1024
+	defer func() { self.apiConfig.opts.MaxUploadBytes = maxBytes }()
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		body := io.MultiReader(strings.NewReader("itemSlug=streamed&b64data="),
+			bytes.NewReader(bytes.Repeat([]byte("A"), 4096)))
+		req, err := http.NewRequest("POST", "/channel/"+self.chan2Rec.Slug+"/item", body)
+		c.Assert(err, IsNil)
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer SUP3R_S33CR37:"+self.user2.Username)
+		response := r.Do(req)
+		c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+		var report AjaxErrorReport
+		err = json.Unmarshal(response.RawBody, &report)
+		c.Assert(err, IsNil)
+		c.Assert(report.Code, Equals, CodeBodyTooLarge)
+	})
+}
+
+func (self *ApiSuite) TestBlobDedup(c *C) {
+	db := self.apiConfig.db
+	chanPath := "/channel/" + self.chan2Rec.Slug
+	data := []byte("the same bytes, uploaded twice")
+	hash := HashData(data)
+	blobRefs := func() int {
+		var blob BlobDBRecord
+		err := db.C(blobsCollection).FindId(hash).One(&blob)
+		if err == mgo.ErrNotFound {
+			return -1
+		}
+		c.Assert(err, IsNil)
+		return blob.Refs
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		for _, slug := range []string{"dup-a", "dup-b"} {
+			params := url.Values{}
+			params.Add("title", slug)
+			params.Add("b64data", base64.StdEncoding.EncodeToString(data))
+			params.Add("itemSlug", slug)
+			response, err := self.authPost(r, self.user2.Username, chanPath+"/item", params)
+			c.Assert(err, IsNil)
+			c.Assert(response.StatusCode, Equals, http.StatusOK)
+		}
+		c.Assert(blobRefs(), Equals, 2)
+		files, err := db.GridFS(blobsGridFS).Find(bson.M{"filename": hash}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(files, Equals, 1)
+
+		response, err := self.authGet(r, self.user2.Username, chanPath+"/item/dup-b")
+		c.Assert(err, IsNil)
+		var item ItemJSONRecord
+		err = json.Unmarshal(response.RawBody, &item)
+		c.Assert(err, IsNil)
+		c.Assert(item.Hash, Equals, hash)
+		response, err = self.authGet(r, self.user2.Username, chanPath+"/item/dup-b/data")
+		c.Assert(err, IsNil)
+		c.Assert(response.Body, Equals, base64.StdEncoding.EncodeToString(data))
+
+		response, err = self.authDo(r, self.user2.Username, "DELETE", chanPath+"/item/dup-a", nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		c.Assert(blobRefs(), Equals, 1)
+		_, err = self.apiConfig.blobs.Collect(db)
+		c.Assert(err, IsNil)
+		c.Assert(blobRefs(), Equals, 1)
+
+		response, err = self.authDo(r, self.user2.Username, "DELETE", chanPath+"/item/dup-b", nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		c.Assert(blobRefs(), Equals, 0)
+		removed, err := self.apiConfig.blobs.Collect(db)
+		c.Assert(err, IsNil)
+		c.Assert(removed >= 1, Equals, true)
+		c.Assert(blobRefs(), Equals, -1)
+		files, err = db.GridFS(blobsGridFS).Find(bson.M{"filename": hash}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(files, Equals, 0)
+	})
+}
+
+func (self *ApiSuite) TestFSBlobBackend(c *C) {
+	backend, err := NewFSBackend(c.MkDir())
+	c.Assert(err, IsNil)
+	gridfs := self.apiConfig.blobs
+	self.apiConfig.blobs = NewBlobStore(backend)
+	defer func() { self.apiConfig.blobs = gridfs }()
+
+	chanPath := "/channel/" + self.chan2Rec.Slug
+	data := []byte("kept on the filesystem")
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		params := url.Values{}
+		params.Add("title", "On disk")
+		params.Add("b64data", base64.StdEncoding.EncodeToString(data))
+		params.Add("itemSlug", "on-disk")
+		response, err := self.authPost(r, self.user2.Username, chanPath+"/item", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+
+		response, err = self.authGet(r, self.user2.Username, chanPath+"/item/on-disk/data")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(response.Body, Equals, base64.StdEncoding.EncodeToString(data))
+	})
+
+	var blob BlobDBRecord
+	err = self.apiConfig.db.C(blobsCollection).FindId(HashData(data)).One(&blob)
+	c.Assert(err, IsNil)
+	reader, err := backend.Open(blob.Location)
+	c.Assert(err, IsNil)
+	stored, err := ioutil.ReadAll(reader)
+	reader.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(stored), Equals, string(data))
+	c.Assert(blob.Backend, Equals, "fs")
+
+	//Back on GridFS, the blob can't be read until it is migrated.
+	db := self.apiConfig.db
+	self.apiConfig.blobs = gridfs
+	others, err := gridfs.ForeignBackends(db)
+	c.Assert(err, IsNil)
+	c.Assert(others, DeepEquals, []string{"fs"})
+	_, _, err = gridfs.Open(db, blob.Hash)
+	c.Assert(err, NotNil)
+	moved, err := gridfs.MigrateBlobs(db, backend)
+	c.Assert(err, IsNil)
+	c.Assert(moved, Equals, 1)
+	others, err = gridfs.ForeignBackends(db)
+	c.Assert(err, IsNil)
+	c.Assert(others, HasLen, 0)
+	_, err = backend.Open(blob.Location)
+	c.Assert(err, Equals, ErrBlobNotFound)
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.authGet(r, self.user2.Username, chanPath+"/item/on-disk/data")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(response.Body, Equals, base64.StdEncoding.EncodeToString(data))
+	})
+
+	//Data another backend holds isn't stored again until it's migrated.
+	other := []byte("first kept on the filesystem")
+	hash, err := NewBlobStore(backend).Put(db, other)
+	c.Assert(err, IsNil)
+	defer ReleaseBlob(db, hash)
+	_, err = gridfs.Put(db, other)
+	c.Assert(err, ErrorMatches, ".*run blob migrate")
+	err = db.C(blobsCollection).FindId(hash).One(&blob)
+	c.Assert(err, IsNil)
+	c.Assert(blob.Backend, Equals, "fs")
+	c.Assert(blob.Refs, Equals, 1)
+	reader, err = backend.Open(blob.Location)
+	c.Assert(err, IsNil)
+	reader.Close()
+}
+
+func (self *ApiSuite) TestDownloadLinks(c *C) {
+	itemPath := "/channel/" + self.chan1Rec.Slug + "/item/" + self.item1Rec.Slug
+	var plain string
+	mint := func(r *testflight.Requester, params url.Values) string {
+		response, err := self.authPost(r, self.user1.Username, itemPath+"/link", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		var link LinkJSONRecord
+		err = json.Unmarshal(response.RawBody, &link)
+		c.Assert(err, IsNil)
+		c.Assert(strings.HasPrefix(link.URL, itemPath+"/data?"), Equals, true)
+		return link.URL
+	}
+	fetch := func(r *testflight.Requester, linkURL string, status int, code string) {
+		response, err := self.unAuthGet(r, linkURL)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, status, Commentf("%s", linkURL))
+		if code != "" {
+			var report AjaxErrorReport
+			err = json.Unmarshal(response.RawBody, &report)
+			c.Assert(err, IsNil)
+			c.Assert(report.Code, Equals, code)
+		} else {
+			c.Assert(response.Body, Equals, plain)
+		}
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.unAuthGet(r, itemPath+"/data")
+		c.Assert(err, IsNil)
+		plain = response.Body
+
+		response, err = self.authPost(r, self.user2.Username, itemPath+"/link", url.Values{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+		response, err = self.authPost(r, self.user1.Username, itemPath+"/link", url.Values{"expires_in": {"99999999"}})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+		linkURL := mint(r, url.Values{"expires_in": {"60"}})
+		fetch(r, linkURL, http.StatusOK, "")
+		fetch(r, linkURL, http.StatusOK, "")
+		fetch(r, strings.Replace(linkURL, "expires=", "expires=1", 1), http.StatusForbidden, CodeLinkInvalid)
+		fetch(r, strings.Replace(linkURL, self.item1Rec.Slug, self.item2Rec.Slug, 1), http.StatusForbidden, CodeLinkInvalid)
+
+		linkURL = mint(r, url.Values{"single_use": {"true"}})
+		fetch(r, linkURL, http.StatusOK, "")
+		fetch(r, linkURL, http.StatusForbidden, CodeLinkUsed)
+
+		linkURL = mint(r, url.Values{"ip": {"192.0.2.1"}})
+		fetch(r, linkURL, http.StatusForbidden, CodeLinkIPMismatch)
+		linkURL = mint(r, url.Values{"ip": {"127.0.0.1"}})
+		fetch(r, linkURL, http.StatusOK, "")
+	})
+
+	expired, err := NewDownloadLink(self.chan1Rec.Slug, self.item1Rec.Slug, -time.Minute, false, "")
+	c.Assert(err, IsNil)
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		fetch(r, expired.Path()+"?"+expired.Query(linkKey(self.apiConfig.opts.AuthSecret)).Encode(), http.StatusForbidden, CodeLinkExpired)
+	})
+}
+
+func (self *ApiSuite) TestChannelVisibility(c *C) {
+	owner, other := self.user1.Username, self.user2.Username
+	create := func(r *testflight.Requester, slug, visibility string) {
+		params := url.Values{}
+		params.Add("slug", slug)
+		params.Add("title", slug)
+		params.Add("visibility", visibility)
+		response, err := self.authPost(r, owner, "/channel", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		params = url.Values{}
+		params.Add("title", "Item")
+		params.Add("b64data", base64.StdEncoding.EncodeToString([]byte(visibility+" data")))
+		params.Add("itemSlug", "item")
+		response, err = self.authPost(r, owner, "/channel/"+slug+"/item", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+	}
+	//get fetches route as username, or anonymously if username is "".
+	get := func(r *testflight.Requester, username, route string) int {
+		var response *testflight.Response
+		var err error
+		if username == "" {
+			response, err = self.unAuthGet(r, route)
+		} else {
+			response, err = self.authGet(r, username, route)
+		}
+		c.Assert(err, IsNil)
+		return response.StatusCode
+	}
+	listed := func(r *testflight.Requester, username string) map[string]string {
+		response, err := self.authGet(r, username, "/channel")
+		c.Assert(err, IsNil)
+		channels := make(map[string]string)
+		err = json.Unmarshal(response.RawBody, &channels)
+		c.Assert(err, IsNil)
+		return channels
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		params := url.Values{}
+		params.Add("slug", "bad-visibility")
+		params.Add("title", "Bad")
+		params.Add("visibility", "secret")
+		response, err := self.authPost(r, owner, "/channel", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+		create(r, "vis-authenticated", VisibilityAuthenticated)
+		create(r, "vis-private", VisibilityPrivate)
+
+		routes := []string{"/item", "/item/item", "/item/item/data", "/item.zip"}
+		for _, route := range routes {
+			path := "/channel/vis-authenticated" + route
+			c.Assert(get(r, "", path), Equals, http.StatusUnauthorized, Commentf("%s", path))
+			c.Assert(get(r, other, path), Equals, http.StatusOK, Commentf("%s", path))
+			path = "/channel/vis-private" + route
+			c.Assert(get(r, "", path), Equals, http.StatusNotFound, Commentf("%s", path))
+			c.Assert(get(r, other, path), Equals, http.StatusNotFound, Commentf("%s", path))
+			c.Assert(get(r, owner, path), Equals, http.StatusOK, Commentf("%s", path))
+		}
+		for _, route := range []string{"", "/export"} {
+			c.Assert(get(r, other, "/channel/vis-private"+route), Equals, http.StatusNotFound)
+			c.Assert(get(r, owner, "/channel/vis-private"+route), Equals, http.StatusOK)
+		}
+		c.Assert(get(r, other, "/channel/vis-private/events"), Equals, http.StatusNotFound)
+
+		ownerList, otherList := listed(r, owner), listed(r, other)
+		_, ok := ownerList["vis-private"]
+		c.Assert(ok, Equals, true)
+		_, ok = otherList["vis-private"]
+		c.Assert(ok, Equals, false)
+		_, ok = otherList["vis-authenticated"]
+		c.Assert(ok, Equals, true)
+
+		//A download link still works for anyone.
+		response, err = self.authPost(r, owner, "/channel/vis-private/item/item/link", url.Values{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		var link LinkJSONRecord
+		err = json.Unmarshal(response.RawBody, &link)
+		c.Assert(err, IsNil)
+		c.Assert(get(r, "", link.URL), Equals, http.StatusOK)
+
+		settings := url.Values{}
+		settings.Add("visibility", VisibilityPublic)
+		response, err = self.authDo(r, owner, "PUT", "/channel/vis-private", []byte(settings.Encode()),
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		c.Assert(get(r, "", "/channel/vis-private/item"), Equals, http.StatusOK)
+	})
+
+	//The WebSocket endpoint won't subscribe others to a private channel.
+	server := httptest.NewServer(self.apiConfig.GetRouter())
+	defer server.Close()
+	err := UpdateChannel(self.apiConfig.db, "vis-private", bson.M{"visibility": VisibilityPrivate})
+	c.Assert(err, IsNil)
+	header := http.Header{}
+	header.Set("Authorization", "Bearer SUP3R_S33CR37:"+other)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/events", header)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	err = conn.WriteJSON(&SocketRequest{Action: "subscribe", Channels: []string{"vis-private"}})
+	c.Assert(err, IsNil)
+	var reply SocketReply
+	err = conn.ReadJSON(&reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Type, Equals, "error")
+	c.Assert(reply.Error, Equals, "No such channel vis-private")
+}
+
+func (self *ApiSuite) TestChannelMembers(c *C) {
+	owner, member := self.user1.Username, self.user2.Username
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	do := func(r *testflight.Requester, username, verb, route string, params url.Values) int {
+		response, err := self.authDo(r, username, verb, route, []byte(params.Encode()), form)
+		c.Assert(err, IsNil)
+		return response.StatusCode
+	}
+	setRole := func(r *testflight.Requester, username, memberName, role string) int {
+		params := url.Values{}
+		params.Add("role", role)
+		return do(r, username, "PUT", "/channel/team/members/"+memberName, params)
+	}
+	upload := func(r *testflight.Requester, username, itemSlug string) int {
+		params := url.Values{}
+		params.Add("title", itemSlug)
+		params.Add("b64data", base64.StdEncoding.EncodeToString([]byte(itemSlug)))
+		params.Add("itemSlug", itemSlug)
+		return do(r, username, "POST", "/channel/team/item", params)
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		params := url.Values{}
+		params.Add("slug", "team")
+		params.Add("title", "Team")
+		params.Add("visibility", VisibilityPrivate)
+		c.Assert(do(r, owner, "POST", "/channel", params), Equals, http.StatusNoContent)
+		c.Assert(upload(r, owner, "owners"), Equals, http.StatusOK)
+		c.Assert(do(r, member, "GET", "/channel/team/item", url.Values{}), Equals, http.StatusNotFound)
+
+		c.Assert(setRole(r, owner, member, "admin"), Equals, http.StatusBadRequest)
+		c.Assert(setRole(r, owner, "nobody", RoleViewer), Equals, http.StatusNotFound)
+		c.Assert(setRole(r, owner, member, RoleViewer), Equals, http.StatusCreated)
+		c.Assert(do(r, member, "GET", "/channel/team/item", url.Values{}), Equals, http.StatusOK)
+		c.Assert(upload(r, member, "members"), Equals, http.StatusForbidden)
+
+		c.Assert(setRole(r, owner, member, RoleContributor), Equals, http.StatusOK)
+		c.Assert(upload(r, member, "members"), Equals, http.StatusOK)
+		c.Assert(upload(r, member, "owners"), Equals, http.StatusForbidden)
+		c.Assert(do(r, member, "DELETE", "/channel/team/item/owners", url.Values{}), Equals, http.StatusForbidden)
+		c.Assert(do(r, member, "DELETE", "/channel/team/item/members", url.Values{}), Equals, http.StatusNoContent)
+		c.Assert(setRole(r, member, member, RoleMaintainer), Equals, http.StatusForbidden)
+		params = url.Values{}
+		params.Add("title", "Renamed")
+		c.Assert(do(r, member, "PUT", "/channel/team", params), Equals, http.StatusForbidden)
+
+		c.Assert(setRole(r, owner, member, RoleMaintainer), Equals, http.StatusOK)
+		c.Assert(do(r, member, "PUT", "/channel/team", params), Equals, http.StatusNoContent)
+		c.Assert(do(r, member, "DELETE", "/channel/team/item/owners", url.Values{}), Equals, http.StatusNoContent)
+		c.Assert(setRole(r, member, owner, RoleViewer), Equals, http.StatusBadRequest)
+		c.Assert(setRole(r, member, member, RoleOwner), Equals, http.StatusForbidden)
+		params = url.Values{}
+		params.Add("visibility", VisibilityPublic)
+		c.Assert(do(r, member, "PUT", "/channel/team", params), Equals, http.StatusForbidden)
+
+		response, err := self.authGet(r, member, "/channel/team/members")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		var members []MemberJSONRecord
+		err = json.Unmarshal(response.RawBody, &members)
+		c.Assert(err, IsNil)
+		c.Assert(members, DeepEquals, []MemberJSONRecord{{owner, RoleOwner}, {member, RoleMaintainer}})
+
+		c.Assert(do(r, owner, "DELETE", "/channel/team/members/"+owner, url.Values{}), Equals, http.StatusBadRequest)
+		c.Assert(do(r, member, "DELETE", "/channel/team/members/"+member, url.Values{}), Equals, http.StatusNoContent)
+		c.Assert(do(r, member, "GET", "/channel/team/item", url.Values{}), Equals, http.StatusNotFound)
+		c.Assert(do(r, owner, "DELETE", "/channel/team/members/"+member, url.Values{}), Equals, http.StatusNotFound)
+	})
+}
+
+func (self *ApiSuite) TestRemoveUser(c *C) {
+	db := self.apiConfig.db
+	_, err := InsertUser(db, "carol")
+	c.Assert(err, IsNil)
+	defer RemoveUser(db, "carol")
+	_, err = InsertChannel(db, "carols", "Carol's", "carol")
+	c.Assert(err, IsNil)
+	_, err = SetMember(db, self.chan1Rec.Slug, "carol", RoleMaintainer)
+	c.Assert(err, IsNil)
+	_, err = InsertOrg(db, "carolco", "Carol Co.", "carol")
+	c.Assert(err, IsNil)
+	defer db.C(orgsCollection).RemoveId("carolco")
+
+	//Someone recreated as carol must not inherit carol's channels and orgs.
+	c.Assert(RemoveUser(db, "carol"), NotNil)
+	c.Assert(RemoveChannel(db, "carols"), IsNil)
+	c.Assert(RemoveUser(db, "carol"), NotNil)
+	_, err = SetOrgMember(db, "carolco", self.user1.Username, OrgRoleAdmin)
+	c.Assert(err, IsNil)
+	c.Assert(RemoveUser(db, "carol"), IsNil)
+
+	chanrec, err := FindChannel(db, self.chan1Rec.Slug)
+	c.Assert(err, IsNil)
+	c.Assert(chanrec.RoleOf("carol"), Equals, "")
+	orgrec, err := FindOrg(db, "carolco")
+	c.Assert(err, IsNil)
+	c.Assert(orgrec.RoleOf("carol"), Equals, "")
+}
+
+func (self *ApiSuite) TestOrganizations(c *C) {
+	admin, member := self.user1.Username, self.user2.Username
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	do := func(r *testflight.Requester, username, verb, route string, params url.Values) *testflight.Response {
+		response, err := self.authDo(r, username, verb, route, []byte(params.Encode()), form)
+		c.Assert(err, IsNil)
+		return response
+	}
+	status := func(r *testflight.Requester, username, verb, route string, params url.Values) int {
+		return do(r, username, verb, route, params).StatusCode
+	}
+	role := func(value string) url.Values {
+		return url.Values{"role": {value}}
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		params := url.Values{"name": {"acme"}, "title": {"Acme"}}
+		c.Assert(status(r, admin, "POST", "/org", params), Equals, http.StatusCreated)
+		c.Assert(status(r, admin, "POST", "/org", params), Equals, http.StatusBadRequest)
+		c.Assert(status(r, member, "GET", "/org/acme", url.Values{}), Equals, http.StatusNotFound)
+
+		//Only admins can make organization channels.
+		params = url.Values{"slug": {"acme/shared"}, "title": {"Shared"}, "visibility": {VisibilityPrivate}}
+		c.Assert(status(r, member, "POST", "/channel", params), Equals, http.StatusNotFound)
+		c.Assert(status(r, admin, "POST", "/channel", params), Equals, http.StatusNoContent)
+		params = url.Values{"slug": {"other"}, "title": {"Other"}}
+		c.Assert(status(r, admin, "POST", "/org/acme/channel", params), Equals, http.StatusNoContent)
+
+		response := do(r, admin, "GET", "/org/acme/channel/shared", url.Values{})
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		var channel ChannelJSONRecord
+		err := json.Unmarshal(response.RawBody, &channel)
+		c.Assert(err, IsNil)
+		c.Assert(channel.Slug, Equals, "acme/shared")
+		c.Assert(channel.Org, Equals, "acme")
+		c.Assert(status(r, member, "GET", "/org/acme/channel/shared/item", url.Values{}), Equals, http.StatusNotFound)
+
+		c.Assert(status(r, admin, "PUT", "/org/acme/members/"+member, role("boss")), Equals, http.StatusBadRequest)
+		c.Assert(status(r, admin, "PUT", "/org/acme/members/"+member, role(OrgRoleMember)), Equals, http.StatusCreated)
+		c.Assert(status(r, member, "PUT", "/org/acme/members/"+member, role(OrgRoleAdmin)), Equals, http.StatusForbidden)
+		c.Assert(status(r, admin, "PUT", "/org/acme/members/"+admin, role(OrgRoleMember)), Equals, http.StatusBadRequest)
+
+		//Org members are contributors.
+		params = url.Values{
+			"title":    {"Plan"},
+			"b64data":  {base64.StdEncoding.EncodeToString([]byte("plan"))},
+			"itemSlug": {"plan"},
+		}
+		response = do(r, member, "POST", "/org/acme/channel/shared/item", params)
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(response.Body, Equals, "/org/acme/channel/shared/item/plan")
+		c.Assert(status(r, member, "PUT", "/org/acme/channel/shared", url.Values{"title": {"Mine"}}), Equals, http.StatusForbidden)
+
+		var channels map[string]string
+		response = do(r, member, "GET", "/org/acme/channel", url.Values{})
+		err = json.Unmarshal(response.RawBody, &channels)
+		c.Assert(err, IsNil)
+		c.Assert(channels, DeepEquals, map[string]string{"acme/shared": "Shared", "acme/other": "Other"})
+
+		response = do(r, member, "GET", "/org/acme", url.Values{})
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		var org OrgJSONRecord
+		err = json.Unmarshal(response.RawBody, &org)
+		c.Assert(err, IsNil)
+		c.Assert(org.Members, HasLen, 2)
+
+		//Once the member leaves, the private channel is gone for them.
+		c.Assert(status(r, admin, "DELETE", "/org/acme/members/"+admin, url.Values{}), Equals, http.StatusBadRequest)
+		c.Assert(status(r, member, "DELETE", "/org/acme/members/"+member, url.Values{}), Equals, http.StatusNoContent)
+		c.Assert(status(r, member, "GET", "/org/acme/channel/shared/item/plan", url.Values{}), Equals, http.StatusNotFound)
+	})
+}
+
+func (self *ApiSuite) TestAPIKeys(c *C) {
+	username := self.user1.Username
+	slug := self.chan1Rec.Slug
+	//keyDo makes a request with an API key instead of the shared secret.
+	keyDo := func(r *testflight.Requester, key, verb, route string, params url.Values) *testflight.Response {
+		req, err := http.NewRequest(verb, route, strings.NewReader(params.Encode()))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r.Do(req)
+	}
+	newKey := func(r *testflight.Requester, scopes string) *APIKeyJSONRecord {
+		params := url.Values{"name": {"build bot"}, "scopes": {scopes}}
+		response, err := self.authPost(r, username, "/keys", params)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		var key APIKeyJSONRecord
+		err = json.Unmarshal(response.RawBody, &key)
+		c.Assert(err, IsNil)
+		c.Assert(strings.HasPrefix(key.Key, APIKeyPrefix), Equals, true)
+		c.Assert(strings.HasPrefix(key.Key, key.Prefix), Equals, true)
+		return &key
+	}
+	upload := url.Values{
+		"title":    {"Build"},
+		"b64data":  {base64.StdEncoding.EncodeToString([]byte("build output"))},
+		"itemSlug": {"build"},
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response, err := self.authPost(r, username, "/keys", url.Values{"scopes": {"write"}})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+		reader := newKey(r, ScopeRead)
+		uploader := newKey(r, ScopeUploadPrefix+slug)
+		c.Assert(keyDo(r, reader.Key, "GET", "/channel/"+slug+"/item", nil).StatusCode, Equals, http.StatusOK)
+		response = keyDo(r, reader.Key, "POST", "/channel/"+slug+"/item", upload)
+		c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+		c.Assert(strings.Contains(response.Body, `"code":"key_scope"`), Equals, true)
+		c.Assert(keyDo(r, reader.Key, "GET", "/keys", nil).StatusCode, Equals, http.StatusForbidden)
+
+		c.Assert(keyDo(r, uploader.Key, "GET", "/channel/"+slug+"/item", nil).StatusCode, Equals, http.StatusForbidden)
+		c.Assert(keyDo(r, uploader.Key, "POST", "/channel/"+slug+"/item", upload).StatusCode, Equals, http.StatusOK)
+		c.Assert(keyDo(r, uploader.Key, "POST", "/channel/"+self.chan2Rec.Slug+"/item", upload).StatusCode, Equals, http.StatusForbidden)
+		c.Assert(keyDo(r, uploader.Key, "DELETE", "/channel/"+slug+"/item/build", nil).StatusCode, Equals, http.StatusForbidden)
+		c.Assert(keyDo(r, "tfk_0000", "GET", "/channel", nil).StatusCode, Equals, http.StatusUnauthorized)
+
+		response, err = self.authGet(r, username, "/keys")
+		c.Assert(err, IsNil)
+		var keys []APIKeyJSONRecord
+		err = json.Unmarshal(response.RawBody, &keys)
+		c.Assert(err, IsNil)
+		c.Assert(keys, HasLen, 2)
+		for _, key := range keys {
+			c.Assert(key.Key, Equals, "")
+			c.Assert(key.LastUsed, NotNil)
+		}
+
+		//Keys are stored hashed.
+		count, err := self.apiConfig.db.C(apiKeysCollection).Find(bson.M{"hash": reader.Key}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, 0)
+
+		response, err = self.authDo(r, self.user2.Username, "DELETE", "/keys/"+reader.ID, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+		response, err = self.authDo(r, username, "DELETE", "/keys/"+reader.ID, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusNoContent)
+		c.Assert(keyDo(r, reader.Key, "GET", "/channel", nil).StatusCode, Equals, http.StatusUnauthorized)
+	})
+}
+
+func (self *ApiSuite) TestSessions(c *C) {
+	username := self.user1.Username
+	login := func(r *testflight.Requester) *SessionJSONRecord {
+		response, err := self.authPost(r, username, "/login", url.Values{})
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		var session SessionJSONRecord
+		err = json.Unmarshal(response.RawBody, &session)
+		c.Assert(err, IsNil)
+		c.Assert(strings.HasPrefix(session.Token, SessionTokenPrefix), Equals, true)
+		return &session
+	}
+	//sessionDo makes a request with a session token.
+	sessionDo := func(r *testflight.Requester, token, verb, route string) *testflight.Response {
+		req, err := http.NewRequest(verb, route, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return r.Do(req)
+	}
+	listed := func(r *testflight.Requester, token string) []SessionJSONRecord {
+		response := sessionDo(r, token, "GET", "/user/me/sessions")
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		var sessions []SessionJSONRecord
+		err := json.Unmarshal(response.RawBody, &sessions)
+		c.Assert(err, IsNil)
+		return sessions
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		first, second := login(r), login(r)
+		c.Assert(sessionDo(r, first.Token, "GET", "/channel").StatusCode, Equals, http.StatusOK)
+		c.Assert(sessionDo(r, "tfs_nonsense", "GET", "/channel").StatusCode, Equals, http.StatusUnauthorized)
+		//A session can't be traded in for a newer one.
+		c.Assert(sessionDo(r, first.Token, "POST", "/login").StatusCode, Equals, http.StatusForbidden)
+
+		sessions := listed(r, first.Token)
+		c.Assert(sessions, HasLen, 2)
+		for _, session := range sessions {
+			c.Assert(session.Token, Equals, "")
+			c.Assert(session.Current, Equals, session.ID == first.ID)
+		}
+
+		//Revoking a session takes effect at once, cache or no cache.
+		c.Assert(sessionDo(r, first.Token, "DELETE", "/user/me/sessions/"+second.ID).StatusCode, Equals, http.StatusNoContent)
+		response := sessionDo(r, second.Token, "GET", "/channel")
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(response.Body, CodeSessionInvalid), Equals, true)
+		c.Assert(listed(r, first.Token), HasLen, 1)
+
+		//Sessions idle for too long are refused.
+		third := login(r)
+		err := self.apiConfig.db.C(sessionsCollection).UpdateId(bson.ObjectIdHex(third.ID),
+			bson.M{"$set": bson.M{"last_seen": time.Now().Add(-self.apiConfig.opts.SessionIdleTimeout)}})
+		c.Assert(err, IsNil)
+		self.apiConfig.sessions.forgetUser(username)
+		response = sessionDo(r, third.Token, "GET", "/channel")
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(response.Body, CodeSessionExpired), Equals, true)
+
+		c.Assert(sessionDo(r, first.Token, "DELETE", "/user/me/sessions").StatusCode, Equals, http.StatusNoContent)
+		c.Assert(sessionDo(r, first.Token, "GET", "/channel").StatusCode, Equals, http.StatusUnauthorized)
+	})
+}
+
+func (self *ApiSuite) TestTOTP(c *C) {
+	username := self.user2.Username
+	post := func(r *testflight.Requester, route string, params url.Values) *testflight.Response {
+		response, err := self.authPost(r, username, route, params)
+		c.Assert(err, IsNil)
+		return response
+	}
+	sessionDo := func(r *testflight.Requester, token, verb, route string) *testflight.Response {
+		req, err := http.NewRequest(verb, route, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return r.Do(req)
+	}
+	status := func(response *testflight.Response) *TOTPJSONRecord {
+		var totp TOTPJSONRecord
+		err := json.Unmarshal(response.RawBody, &totp)
+		c.Assert(err, IsNil)
+		return &totp
+	}
+
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		response := post(r, "/user/me/totp", url.Values{})
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		enrollment := status(response)
+		c.Assert(enrollment.Enabled, Equals, false)
+		c.Assert(strings.HasPrefix(enrollment.URI, "otpauth://totp/"), Equals, true)
+		key, err := totpEncoding.DecodeString(enrollment.Secret)
+		c.Assert(err, IsNil)
+		//Until it is confirmed, logging in works as before.
+		response = post(r, "/login", url.Values{})
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		var early SessionJSONRecord
+		err = json.Unmarshal(response.RawBody, &early)
+		c.Assert(err, IsNil)
+		c.Assert(sessionDo(r, early.Token, "GET", "/channel").StatusCode, Equals, http.StatusOK)
+
+		step := totpStep(time.Now())
+		response = post(r, "/user/me/totp/confirm", url.Values{"code": {totpCode(key, step+5)}})
+		c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+		response = post(r, "/user/me/totp/confirm", url.Values{"code": {totpCode(key, step)}})
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		recovery := status(response).RecoveryCodes
+		c.Assert(recovery, HasLen, recoveryCodeCount)
+		//A session opened without a code no longer does.
+		response = sessionDo(r, early.Token, "GET", "/channel")
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(response.Body, CodeTOTPSessionRequired), Equals, true)
+
+		response = post(r, "/login", url.Values{})
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(response.Body, CodeTOTPRequired), Equals, true)
+		//The code used to confirm can't be used again.
+		response = post(r, "/login", url.Values{"code": {totpCode(key, step)}})
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(response.Body, CodeTOTPInvalid), Equals, true)
+		response = post(r, "/login", url.Values{"code": {totpCode(key, step+1)}})
+		c.Assert(response.StatusCode, Equals, http.StatusCreated)
+		var session SessionJSONRecord
+		err = json.Unmarshal(response.RawBody, &session)
+		c.Assert(err, IsNil)
+
+		//The shared secret skips the code, so it is only good for logging
+		//in; everything else wants the session.
+		response, err = self.authGet(r, username, "/channel")
+		c.Assert(err, IsNil)
+		c.Assert(response.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(response.Body, CodeTOTPSessionRequired), Equals, true)
+		c.Assert(post(r, "/keys", url.Values{"name": {"sneaky"}, "scopes": {"admin"}}).StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(sessionDo(r, session.Token, "GET", "/channel").StatusCode, Equals, http.StatusOK)
+
+		c.Assert(post(r, "/login", url.Values{"code": {recovery[0]}}).StatusCode, Equals, http.StatusCreated)
+		c.Assert(post(r, "/login", url.Values{"code": {recovery[0]}}).StatusCode, Equals, http.StatusUnauthorized)
+		response = sessionDo(r, session.Token, "GET", "/user/me/totp")
+		c.Assert(response.StatusCode, Equals, http.StatusOK)
+		c.Assert(status(response).RecoveryCodesLeft, Equals, recoveryCodeCount-1)
+
+		//Too many wrong codes lock the second factor, good codes and all.
+		//The reused recovery code above already counted as one.
+		for i := 1; i < maxTOTPFailures; i++ {
+			c.Assert(post(r, "/login", url.Values{"code": {"abcdef"}}).StatusCode, Equals, http.StatusUnauthorized)
+		}
+		response = post(r, "/login", url.Values{"code": {recovery[2]}})
+		c.Assert(response.StatusCode, Equals, http.StatusTooManyRequests)
+		c.Assert(strings.Contains(response.Body, CodeTOTPLocked), Equals, true)
+		err = self.apiConfig.db.C(usersCollection).UpdateId(username, bson.M{"$unset": bson.M{"totp_locked_until": ""}})
+		c.Assert(err, IsNil)
+
+		c.Assert(sessionDo(r, session.Token, "DELETE", "/user/me/totp").StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(sessionDo(r, session.Token, "DELETE", "/user/me/totp?code="+recovery[1]).StatusCode, Equals, http.StatusNoContent)
+		c.Assert(post(r, "/login", url.Values{}).StatusCode, Equals, http.StatusCreated)
+		c.Assert(sessionDo(r, session.Token, "DELETE", "/user/me/sessions").StatusCode, Equals, http.StatusNoContent)
+	})
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//API keys let scripts act for a user without the user's credentials.  A
+//key is "tfk_" and 64 hex digits, sent as "Authorization: Bearer tfk_...";
+//only its SHA-256 is stored, so the key itself is shown once, when it is
+//made.  Each key has scopes limiting what it can do:
+//read            GET anything the user can read
+//upload:<slug>   upload items to one channel
+//admin           anything the user can do, managing keys included
+
+const (
+	apiKeysCollection = "api_keys"
+
+	APIKeyPrefix = "tfk_"
+
+	ScopeRead         = "read"
+	ScopeAdmin        = "admin"
+	ScopeUploadPrefix = "upload:"
+
+	//Keys are shown by their first few characters, enough to tell them
+	//apart.
+	apiKeyShownLength = len(APIKeyPrefix) + 8
+
+	//touchAPIKeyEvery keeps a busy key from writing its last use on
+	//every request.
+	touchAPIKeyEvery = time.Minute
+)
+
+//CodeKeyScope is sent when an API key lacks the scope for a request.
+const CodeKeyScope = "key_scope"
+
+//ParseScopes checks a comma-separated list of scopes.
+func ParseScopes(list string) ([]string, error) {
+	scopes := make([]string, 0)
+	for _, scope := range strings.Split(list, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if strings.HasPrefix(scope, ScopeUploadPrefix) {
+			org, name := SplitChannelSlug(strings.TrimPrefix(scope, ScopeUploadPrefix))
+			if !validName(name) || (org != "" && !validName(org)) {
+				return nil, errors.New("bad channel in scope " + scope)
+			}
+		} else if scope != ScopeRead && scope != ScopeAdmin {
+			return nil, errors.New("unknown scope " + scope + "; scopes are read, upload:<channel> and admin")
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("scopes cannot be empty")
+	}
+	return scopes, nil
+}
+
+//requiredScope is the scope a key needs for a request.  chanSlug is the
+//channel the route is about, if any.
+func requiredScope(method, path, chanSlug string) string {
+	for _, account := range []string{"/keys", "/login", "/user/"} {
+		if strings.HasPrefix(path, account) {
+			return ScopeAdmin
+		}
+	}
+	if method == "GET" || method == "HEAD" {
+		return ScopeRead
+	}
+	if method == "POST" && chanSlug != "" && strings.HasSuffix(path, "/item") {
+		return ScopeUploadPrefix + chanSlug
+	}
+	return ScopeAdmin
+}
+
+func hasScope(scopes []string, wanted string) bool {
+	for _, scope := range scopes {
+		if scope == wanted || scope == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+//newToken makes a random bearer token: prefix and 64 hex digits.
+func newToken(prefix string) (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(secret), nil
+}
+
+//hashToken is what is stored of API keys and session tokens.  They are
+//random enough that a plain SHA-256 does.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+//InsertAPIKey makes a key for owner.  The key is returned alongside its
+//record, which only holds its hash.
+func InsertAPIKey(db *mgo.Database, owner, name string, scopes []string) (*APIKeyDBRecord, string, error) {
+	key, err := newToken(APIKeyPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	keys := db.C(apiKeysCollection)
+	err = keys.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true})
+	if err != nil {
+		return nil, "", err
+	}
+	keyrec := &APIKeyDBRecord{
+		Id:          bson.NewObjectId(),
+		Hash:        hashToken(key),
+		Prefix:      key[:apiKeyShownLength],
+		Owner:       owner,
+		Name:        name,
+		Scopes:      scopes,
+		DateCreated: time.Now(),
+	}
+	err = keys.Insert(keyrec)
+	if err != nil {
+		return nil, "", err
+	}
+	return keyrec, key, nil
+}
+
+func FindAPIKey(db *mgo.Database, key string) (*APIKeyDBRecord, error) {
+	var keyrec APIKeyDBRecord
+	err := db.C(apiKeysCollection).Find(bson.M{"hash": hashToken(key)}).One(&keyrec)
+	if err != nil {
+		return nil, err
+	}
+	return &keyrec, nil
+}
+
+func ListAPIKeys(db *mgo.Database, owner string) ([]APIKeyDBRecord, error) {
+	keys := make([]APIKeyDBRecord, 0)
+	err := db.C(apiKeysCollection).Find(bson.M{"owner": owner}).Sort("date_created").All(&keys)
+	return keys, err
+}
+
+//RemoveAPIKey revokes one of owner's keys.
+func RemoveAPIKey(db *mgo.Database, owner, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	return db.C(apiKeysCollection).Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+}
+
+//touchAPIKey records that a key was used.  It is only a hint for the
+//key's owner, so failures are just logged.
+func touchAPIKey(db *mgo.Database, keyrec *APIKeyDBRecord, now time.Time) {
+	if now.Sub(keyrec.LastUsed) < touchAPIKeyEvery {
+		return
+	}
+	err := db.C(apiKeysCollection).UpdateId(keyrec.Id, bson.M{"$set": bson.M{"last_used": now}})
+	if err != nil && err != mgo.ErrNotFound {
+		warnf("Could not record the use of API key %s: %s", keyrec.Prefix, err.Error())
+	}
+}
+
+//authenticateKey checks an API key and its scope for the request, and
+//returns the user it acts for.
+func authenticateKey(c *gin.Context, key string) string {
+	db := requestDB(c)
+	keyrec, err := FindAPIKey(db, key)
+	if err == mgo.ErrNotFound {
+		Unauthorized("Invalid API key")
+	} else if err != nil {
+		InternalError("Could not fetch API key from database")
+	}
+	userrec, err := FindUser(db, keyrec.Owner)
+	if err != nil {
+		Unauthorized("No such user " + keyrec.Owner)
+	}
+	//It may have been made with the shared secret, before a second factor
+	//was needed.
+	if userrec.TOTPSecret != "" && keyrec.DateCreated.Before(userrec.TOTPSince) {
+		Fail(http.StatusUnauthorized, CodeTOTPSessionRequired, "API key "+keyrec.Prefix+" predates two-factor authentication; make a new one")
+	}
+	chanSlug := ""
+	if c.Params.ByName("slug") != "" {
+		chanSlug = channelSlug(c)
+	}
+	scope := requiredScope(c.Request.Method, c.Request.URL.Path, chanSlug)
+	if !hasScope(keyrec.Scopes, scope) {
+		Fail(http.StatusForbidden, CodeKeyScope, "API key "+keyrec.Prefix+" lacks the "+scope+" scope")
+	}
+	touchAPIKey(db, keyrec, time.Now())
+	debugf("Good API key %s for user %s", keyrec.Prefix, keyrec.Owner)
+	return keyrec.Owner
+}
+
+//CreateAPIKey makes a key for the current user.  Form fields: name, and
+//scopes as a comma-separated list.  The response is the only time the
+//key is shown.
+func (self *Config) CreateAPIKey(c *gin.Context) {
+	username := forceAuth(c)
+	scopes, err := ParseScopes(c.Request.FormValue("scopes"))
+	if err != nil {
+		BadRequest(err.Error())
+	}
+	keyrec, key, err := InsertAPIKey(requestDB(c), username, c.Request.FormValue("name"), scopes)
+	if err != nil {
+		InternalError("Could not save API key")
+	}
+	keyJSON := keyrec.ToJSON()
+	keyJSON.Key = key
+	c.JSON(http.StatusCreated, keyJSON)
+}
+
+func (self *Config) GetAPIKeys(c *gin.Context) {
+	username := forceAuth(c)
+	keys, err := ListAPIKeys(requestDB(c), username)
+	if err != nil {
+		InternalError("Could not fetch API keys from database")
+	}
+	keyData := make([]*APIKeyJSONRecord, 0)
+	for i := range keys {
+		keyData = append(keyData, keys[i].ToJSON())
+	}
+	c.JSON(http.StatusOK, keyData)
+}
+
+func (self *Config) DeleteAPIKey(c *gin.Context) {
+	username := forceAuth(c)
+	id := c.Params.ByName("keyId")
+	err := RemoveAPIKey(requestDB(c), username, id)
+	if err == mgo.ErrNotFound {
+		NotFound("No such API key " + id)
+	} else if err != nil {
+		InternalError("Could not delete API key")
+	}
+	c.String(http.StatusNoContent, "")
+}
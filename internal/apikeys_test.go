@@ -0,0 +1,42 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type APIKeySuite struct{}
+
+var _ = Suite(&APIKeySuite{})
+
+func (self *APIKeySuite) TestParseScopes(c *C) {
+	scopes, err := ParseScopes(" read, upload:holiday,upload:acme/team ")
+	c.Assert(err, IsNil)
+	c.Assert(scopes, DeepEquals, []string{"read", "upload:holiday", "upload:acme/team"})
+
+	for _, list := range []string{"", " , ", "write", "upload:", "upload:a/b/c", "read,root"} {
+		_, err = ParseScopes(list)
+		c.Assert(err, NotNil, Commentf("%q", list))
+	}
+}
+
+func (self *APIKeySuite) TestRequiredScope(c *C) {
+	c.Assert(requiredScope("GET", "/channel/holiday/item", "holiday"), Equals, ScopeRead)
+	c.Assert(requiredScope("GET", "/events", ""), Equals, ScopeRead)
+	c.Assert(requiredScope("POST", "/channel/holiday/item", "holiday"), Equals, "upload:holiday")
+	c.Assert(requiredScope("POST", "/org/acme/channel/team/item", "acme/team"), Equals, "upload:acme/team")
+	c.Assert(requiredScope("POST", "/channel/holiday/import", "holiday"), Equals, ScopeAdmin)
+	c.Assert(requiredScope("DELETE", "/channel/holiday/item/beach", "holiday"), Equals, ScopeAdmin)
+	c.Assert(requiredScope("POST", "/channel", ""), Equals, ScopeAdmin)
+	c.Assert(requiredScope("GET", "/keys", ""), Equals, ScopeAdmin)
+	c.Assert(requiredScope("GET", "/user/me/sessions", ""), Equals, ScopeAdmin)
+}
+
+func (self *APIKeySuite) TestHasScope(c *C) {
+	scopes := []string{"read", "upload:holiday"}
+	c.Assert(hasScope(scopes, ScopeRead), Equals, true)
+	c.Assert(hasScope(scopes, "upload:holiday"), Equals, true)
+	c.Assert(hasScope(scopes, "upload:work"), Equals, false)
+	c.Assert(hasScope(scopes, ScopeAdmin), Equals, false)
+	c.Assert(hasScope([]string{ScopeAdmin}, "upload:work"), Equals, true)
+	c.Assert(hasScope(nil, ScopeRead), Equals, false)
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//A channel archive is a tar file whose first entry is manifest.json,
+//followed by one items/<slug><ext> file per item holding the decoded
+//item data.
+
+const (
+	archiveManifestName = "manifest.json"
+	archiveVersion      = 1
+)
+
+type ArchiveManifest struct {
+	Version int                `json:"version"`
+	Channel *ChannelJSONRecord `json:"channel"`
+	Owner   string             `json:"owner"`
+	//Files maps item slugs to their file names in the archive.
+	Files map[string]string `json:"files"`
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, data io.Reader, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, data)
+	return err
+}
+
+//ItemOpener returns a reader for an item's decoded data and its size;
+//see BlobStore.OpenItem.
+type ItemOpener func(item *ItemDBRecord) (io.ReadCloser, int64, error)
+
+//itemFilename is the name an item's data gets in an archive: its slug
+//and extension.  Items stored before slugs were checked may have slugs
+//that aren't names, so only the last part of the slug is used and one
+//that is still no name is refused; unpacking an archive must never write
+//outside the folder it is unpacked into.
+func itemFilename(item *ItemDBRecord, open ItemOpener) (string, error) {
+	name := path.Base(strings.Replace(item.Slug, "\\", "/", -1))
+	if !validName(name) {
+		return "", fmt.Errorf("item %q cannot be named in an archive", item.Slug)
+	}
+	ext, err := itemExtension(item, open)
+	if err != nil {
+		return "", fmt.Errorf("cannot read item %s: %s", item.Slug, err.Error())
+	}
+	return name + ext, nil
+}
+
+//itemExtension picks the file extension for an item, sniffing its data
+//if the item was stored before content types were recorded.
+func itemExtension(item *ItemDBRecord, open ItemOpener) (string, error) {
+	if item.ContentType != "" {
+		return extensionForType(item.ContentType), nil
+	}
+	if item.Hash == "" {
+		return extensionFor(decodeHead(item.Data)), nil
+	}
+	reader, _, err := open(item)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return extensionFor(head[:n]), nil
+}
+
+//WriteChannelArchive writes chanrec and its items to w as a channel
+//archive.  Item data is read through open as it is written rather than
+//up front.
+func WriteChannelArchive(w io.Writer, chanrec *ChannelDBRecord, open ItemOpener) error {
+	manifest := &ArchiveManifest{
+		Version: archiveVersion,
+		Channel: chanrec.ToJSON(),
+		Owner:   chanrec.Owner,
+		Files:   make(map[string]string),
+	}
+	for i := range chanrec.Items {
+		item := &chanrec.Items[i]
+		if item.Hash == "" && !validBase64(item.Data) {
+			return fmt.Errorf("item %s does not hold valid base64 data", item.Slug)
+		}
+		name, err := itemFilename(item, open)
+		if err != nil {
+			return err
+		}
+		manifest.Files[item.Slug] = "items/" + name
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = writeTarFile(tw, archiveManifestName, int64(len(manifestData)), bytes.NewReader(manifestData), time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range chanrec.Items {
+		item := &chanrec.Items[i]
+		err = writeArchiveItem(tw, manifest.Files[item.Slug], item, open)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeArchiveItem(tw *tar.Writer, name string, item *ItemDBRecord, open ItemOpener) error {
+	reader, size, err := open(item)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return writeTarFile(tw, name, size, reader, item.DateUploaded)
+}
+
+//ReadChannelArchive parses a channel archive.  The items come back in
+//manifest order with their data base64-encoded, ready to store.
+func ReadChannelArchive(r io.Reader) (*ArchiveManifest, []*ItemDBRecord, error) {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, nil, errors.New("archive is empty or not a tar file")
+	}
+	if header.Name != archiveManifestName {
+		return nil, nil, errors.New("archive must start with " + archiveManifestName)
+	}
+	var manifest ArchiveManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return nil, nil, errors.New("bad manifest: " + err.Error())
+	}
+	if manifest.Version != archiveVersion {
+		return nil, nil, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if manifest.Channel == nil {
+		return nil, nil, errors.New("manifest has no channel")
+	}
+
+	contents := make(map[string][]byte)
+	for {
+		header, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, errors.New("corrupt archive: " + err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, errors.New("corrupt archive: " + err.Error())
+		}
+		contents[header.Name] = data
+	}
+
+	items := make([]*ItemDBRecord, 0, len(manifest.Channel.Items))
+	for _, item := range manifest.Channel.Items {
+		if item.Slug == "" {
+			return nil, nil, errors.New("manifest has an item with no slug")
+		}
+		data, ok := contents[manifest.Files[item.Slug]]
+		if !ok {
+			return nil, nil, errors.New("archive has no data for item " + item.Slug)
+		}
+		items = append(items, &ItemDBRecord{
+			Slug:         item.Slug,
+			Title:        item.Title,
+			DateUploaded: item.DateUploaded,
+			Data:         base64.StdEncoding.EncodeToString(data),
+			Uploader:     item.Uploader,
+			SourceHash:   item.SourceHash,
+		})
+	}
+	return &manifest, items, nil
+}
+
+//Formats that are already compressed are stored rather than deflated.
+var storedExtensions = map[string]bool{
+	".jpg":  true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".zip":  true,
+	".mp4":  true,
+	".mp3":  true,
+}
+
+//WriteItemZip writes the decoded data of every item in chanrec to w as
+//a zip file with one <slug><ext> entry per item.  If w is an
+//http.Flusher it is flushed after each item.
+func WriteItemZip(w io.Writer, chanrec *ChannelDBRecord, open ItemOpener) error {
+	zw := zip.NewWriter(w)
+	flusher, canFlush := w.(http.Flusher)
+	for i := range chanrec.Items {
+		item := &chanrec.Items[i]
+		name, err := itemFilename(item, open)
+		if err != nil {
+			return err
+		}
+		header := &zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: item.DateUploaded,
+		}
+		if storedExtensions[path.Ext(name)] {
+			header.Method = zip.Store
+		}
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		err = copyItem(entry, item, open)
+		if err != nil {
+			return err
+		}
+		err = zw.Flush()
+		if err != nil {
+			return err
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	return zw.Close()
+}
+
+func copyItem(w io.Writer, item *ItemDBRecord, open ItemOpener) error {
+	reader, _, err := open(item)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
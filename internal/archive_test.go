@@ -0,0 +1,51 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+)
+
+type ArchiveSuite struct{}
+
+var _ = Suite(&ArchiveSuite{})
+
+//Items stored before slugs were checked must not escape the folder an
+//archive is unpacked into.
+func (self *ArchiveSuite) TestItemFilename(c *C) {
+	data := base64.StdEncoding.EncodeToString([]byte("hello, world"))
+	for slug, expected := range map[string]string{
+		"notes":         "notes.txt",
+		"../../.bashrc": ".bashrc.txt",
+		`..\..\evil`:    "evil.txt",
+		"/etc/passwd":   "passwd.txt",
+		"holiday/beach": "beach.txt",
+	} {
+		name, err := itemFilename(NewItem(slug, "Text", data, "someone"), nil)
+		c.Assert(err, IsNil)
+		c.Assert(name, Equals, expected, Commentf("%q", slug))
+	}
+	for _, slug := range []string{"..", "a/..", "/"} {
+		_, err := itemFilename(NewItem(slug, "Text", data, "someone"), nil)
+		c.Assert(err, NotNil, Commentf("%q", slug))
+	}
+}
+
+func (self *ArchiveSuite) TestItemZipNames(c *C) {
+	chanrec := NewChannel("zips", "Zips", "someone")
+	data := base64.StdEncoding.EncodeToString([]byte("hello, world"))
+	chanrec.Items = []ItemDBRecord{*NewItem("../../.bashrc", "Text", data, "someone")}
+	var out bytes.Buffer
+	open := func(item *ItemDBRecord) (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(decodeReader(item.Data)), -1, nil
+	}
+	err := WriteItemZip(&out, chanrec, open)
+	c.Assert(err, IsNil)
+	archive, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(archive.File, HasLen, 1)
+	c.Assert(archive.File[0].Name, Equals, ".bashrc.txt")
+}
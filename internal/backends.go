@@ -0,0 +1,285 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Blob backends other than GridFS.  Both name each copy after its hash
+//plus a random suffix, so two uploads of the same new data never write
+//to the same place; the store deletes whichever copy loses.
+
+var blobLocationPattern = regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{64}-[0-9a-f]{16}$`)
+
+//ErrBlobNotFound is returned by backends asked for a location that
+//holds nothing.
+var ErrBlobNotFound = errors.New("blob not found")
+
+func newBlobLocation(hash string) (string, error) {
+	if len(hash) < 2 {
+		return "", errors.New("bad blob hash " + hash)
+	}
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return hash[:2] + "/" + hash + "-" + hex.EncodeToString(suffix), nil
+}
+
+//fsBackend keeps blobs as files under a directory.
+type fsBackend struct {
+	root string
+}
+
+//NewFSBackend stores blobs under dir, creating it if need be.
+func NewFSBackend(dir string) (BlobBackend, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &fsBackend{dir}, nil
+}
+
+func (self *fsBackend) path(location string) (string, error) {
+	if !blobLocationPattern.MatchString(location) {
+		return "", fmt.Errorf("bad blob location %q", location)
+	}
+	return filepath.Join(self.root, filepath.FromSlash(location)), nil
+}
+
+func (self *fsBackend) Name() string {
+	return "fs"
+}
+
+func (self *fsBackend) Put(hash string, data []byte) (string, error) {
+	location, err := newBlobLocation(hash)
+	if err != nil {
+		return "", err
+	}
+	path, err := self.path(location)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	//Write to a temporary file first so that a crash never leaves a
+	//truncated blob behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return location, nil
+}
+
+func (self *fsBackend) Open(location string) (io.ReadCloser, error) {
+	path, err := self.path(location)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (self *fsBackend) Delete(location string) error {
+	path, err := self.path(location)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//S3Options says where an S3-compatible object store is.  Endpoint is
+//the service root, e.g. "https://s3.eu-west-1.amazonaws.com" or
+//"http://localhost:9000" for MinIO; objects are addressed path-style.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+const s3Timeout = time.Minute
+
+type s3Backend struct {
+	opts   S3Options
+	base   *url.URL
+	client *http.Client
+}
+
+func NewS3Backend(opts S3Options) (BlobBackend, error) {
+	base, err := url.Parse(opts.Endpoint)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("bad S3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("S3 bucket cannot be empty")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	return &s3Backend{opts, base, &http.Client{Timeout: s3Timeout}}, nil
+}
+
+func (self *s3Backend) request(verb, location string, body []byte) (*http.Response, error) {
+	if !blobLocationPattern.MatchString(location) {
+		return nil, fmt.Errorf("bad blob location %q", location)
+	}
+	u := *self.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + self.opts.Bucket + "/" + self.opts.Prefix + location
+	req, err := http.NewRequest(verb, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(body)
+	signS3Request(req, hex.EncodeToString(payloadHash[:]), self.opts.AccessKey, self.opts.SecretKey, self.opts.Region, time.Now())
+	return self.client.Do(req)
+}
+
+func s3Error(response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+	return fmt.Errorf("S3 %s: %s", response.Status, strings.TrimSpace(string(body)))
+}
+
+func (self *s3Backend) Name() string {
+	return "s3"
+}
+
+func (self *s3Backend) Put(hash string, data []byte) (string, error) {
+	location, err := newBlobLocation(hash)
+	if err != nil {
+		return "", err
+	}
+	response, err := self.request("PUT", location, data)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", s3Error(response)
+	}
+	return location, nil
+}
+
+func (self *s3Backend) Open(location string) (io.ReadCloser, error) {
+	response, err := self.request("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusOK {
+		return response.Body, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	return nil, s3Error(response)
+}
+
+func (self *s3Backend) Delete(location string) error {
+	response, err := self.request("DELETE", location, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		return s3Error(response)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//signS3Request adds AWS Signature Version 4 headers to req, signing the
+//host and every header already set.
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
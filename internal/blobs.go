@@ -0,0 +1,509 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"regexp"
+	"sort"
+	"time"
+)
+
+//Item data lives in a content-addressed blob store: each distinct piece
+//of data is stored once, keyed by its SHA-256, and items refer to it by
+//hash.  The blobs collection counts the references; the bytes
+//themselves are kept by a BlobBackend, whose name each blob records so
+//that data stored with another backend is never looked for in the wrong
+//place.  Items from before the blob store still hold their data inline,
+//base64-encoded.
+
+const (
+	blobsCollection = "blobs"
+	blobsGridFS     = "blobdata"
+	maxCollect      = 1000
+)
+
+//BlobBackend stores blob bytes.  Put always writes a new copy and
+//returns where it went; that location is all Open and Delete get.  Name
+//is the backend's blob_backend setting.
+type BlobBackend interface {
+	Name() string
+	Put(hash string, data []byte) (location string, err error)
+	Open(location string) (io.ReadCloser, error)
+	Delete(location string) error
+}
+
+type BlobStore struct {
+	backend BlobBackend
+}
+
+func NewBlobStore(backend BlobBackend) *BlobStore {
+	return &BlobStore{backend}
+}
+
+func HashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//Put stores data (if it isn't stored already) and takes a reference to
+//it, returning its hash.  Each Put must be matched by a ReleaseBlob, or
+//by storing the hash in an item, which the item functions release when
+//the item goes away.
+func (self *BlobStore) Put(db *mgo.Database, data []byte) (string, error) {
+	hash := HashData(data)
+	name := self.backend.Name()
+	blobs := db.C(blobsCollection)
+	err := blobs.Update(bson.M{"_id": hash, "backend": name}, bson.M{"$inc": bson.M{"refs": 1}})
+	if err != mgo.ErrNotFound {
+		return hash, err
+	}
+
+	//Data another backend holds can't be referenced until it is
+	//migrated; storing a second copy here would orphan the first.
+	var blob BlobDBRecord
+	err = blobs.FindId(hash).One(&blob)
+	if err == nil {
+		return "", wrongBackend(hash, blob.Backend, name)
+	} else if err != mgo.ErrNotFound {
+		return "", err
+	}
+
+	//New data (or data that was just collected).  Write it, then record
+	//it unless someone else got there first.
+	location, err := self.backend.Put(hash, data)
+	if err != nil {
+		return "", err
+	}
+	_, err = blobs.UpsertId(hash, bson.M{
+		"$setOnInsert": bson.M{
+			"location":     location,
+			"backend":      name,
+			"size":         int64(len(data)),
+			"date_created": time.Now(),
+		},
+		"$inc": bson.M{"refs": 1},
+	})
+	if err != nil {
+		self.backend.Delete(location)
+		return "", err
+	}
+	err = blobs.FindId(hash).One(&blob)
+	if err == nil && blob.Location != location {
+		self.backend.Delete(location)
+	}
+	if err == nil && blob.Backend != name {
+		ReleaseBlob(db, hash)
+		return "", wrongBackend(hash, blob.Backend, name)
+	}
+	return hash, nil
+}
+
+func wrongBackend(hash, stored, configured string) error {
+	return fmt.Errorf("blob %s is stored with the %q backend, not %q; run blob migrate", hash, stored, configured)
+}
+
+//ReleaseBlob drops a reference taken by Put.  The data stays until the
+//next Collect.
+func ReleaseBlob(db *mgo.Database, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	err := db.C(blobsCollection).UpdateId(hash, bson.M{"$inc": bson.M{"refs": -1}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (self *BlobStore) Open(db *mgo.Database, hash string) (io.ReadCloser, int64, error) {
+	var blob BlobDBRecord
+	err := db.C(blobsCollection).FindId(hash).One(&blob)
+	if err != nil {
+		return nil, 0, err
+	}
+	if blob.Backend != self.backend.Name() {
+		return nil, 0, wrongBackend(hash, blob.Backend, self.backend.Name())
+	}
+	reader, err := self.backend.Open(blob.Location)
+	return reader, blob.Size, err
+}
+
+//OpenItem returns a reader for an item's decoded data and its size,
+//wherever the data is kept.
+func (self *BlobStore) OpenItem(db *mgo.Database, item *ItemDBRecord) (io.ReadCloser, int64, error) {
+	if item.Hash == "" {
+		return ioutil.NopCloser(decodeReader(item.Data)), decodedLen(item.Data), nil
+	}
+	return self.Open(db, item.Hash)
+}
+
+func (self *BlobStore) ReadItem(db *mgo.Database, item *ItemDBRecord) ([]byte, error) {
+	reader, _, err := self.OpenItem(db, item)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+//itemOpener adapts OpenItem for the archive writers.
+func (self *BlobStore) itemOpener(db *mgo.Database) ItemOpener {
+	return func(item *ItemDBRecord) (io.ReadCloser, int64, error) {
+		return self.OpenItem(db, item)
+	}
+}
+
+//StoreItem moves an item's base64 data into the store, leaving its hash
+//in the item.  It returns the decoded data.
+func (self *BlobStore) StoreItem(db *mgo.Database, itemrec *ItemDBRecord) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(itemrec.Data)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := self.Put(db, data)
+	if err != nil {
+		return nil, err
+	}
+	itemrec.Hash = hash
+	itemrec.Data = ""
+	return data, nil
+}
+
+//Collect deletes blobs nothing refers to and returns how many it
+//deleted.  The reference counts are checked against the items first, so
+//a count that went wrong can't lose data; it is corrected instead.
+func (self *BlobStore) Collect(db *mgo.Database) (int, error) {
+	blobs := db.C(blobsCollection)
+	chancoll := db.C(channelsCollection)
+	err := chancoll.EnsureIndexKey("items.hash")
+	if err != nil {
+		return 0, err
+	}
+	//Blobs another backend holds wait for blob migrate; this backend
+	//can't delete them.
+	candidates := make([]BlobDBRecord, 0)
+	err = blobs.Find(bson.M{"refs": bson.M{"$lte": 0}, "backend": self.backend.Name()}).Limit(maxCollect).All(&candidates)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, blob := range candidates {
+		refs, err := countItemRefs(db, blob.Hash)
+		if err != nil {
+			return removed, err
+		}
+		if refs > 0 {
+			warnf("Blob %s has %d references but was counted as unused", blob.Hash, refs)
+			err = blobs.Update(bson.M{"_id": blob.Hash, "refs": bson.M{"$lte": 0}}, bson.M{"$inc": bson.M{"refs": refs}})
+			if err != nil && err != mgo.ErrNotFound {
+				return removed, err
+			}
+			continue
+		}
+		//Only remove it if nobody has taken a reference meanwhile.
+		err = blobs.Remove(bson.M{"_id": blob.Hash, "refs": bson.M{"$lte": 0}})
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		err = self.backend.Delete(blob.Location)
+		if err != nil {
+			warnf("Could not delete data of blob %s: %s", blob.Hash, err.Error())
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func countItemRefs(db *mgo.Database, hash string) (int, error) {
+	channels := make([]ChannelDBRecord, 0)
+	err := db.C(channelsCollection).Find(bson.M{"items.hash": hash}).Select(bson.M{"items.hash": 1}).All(&channels)
+	if err != nil {
+		return 0, err
+	}
+	refs := 0
+	for _, chanrec := range channels {
+		for _, item := range chanrec.Items {
+			if item.Hash == hash {
+				refs++
+			}
+		}
+	}
+	return refs, nil
+}
+
+//MigrateItems moves the inline data of items from before the blob store
+//into it, and returns how many items it moved.
+func (self *BlobStore) MigrateItems(db *mgo.Database) (int, error) {
+	chancoll := db.C(channelsCollection)
+	channels := make([]ChannelDBRecord, 0)
+	err := chancoll.Find(bson.M{"items.data": bson.M{"$exists": true, "$ne": ""}}).All(&channels)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, chanrec := range channels {
+		for i := range chanrec.Items {
+			item := &chanrec.Items[i]
+			if item.Hash != "" || item.Data == "" {
+				continue
+			}
+			b64data := item.Data
+			//CheckItem fills in the size and content type; the channel's
+			//limits don't apply to items it already has.
+			err = CheckItem(&chanrec, item)
+			if err != nil && err.(*UploadError).Code == CodeInvalidBase64 {
+				warnf("Item %s/%s has corrupt data; leaving it alone", chanrec.Slug, item.Slug)
+				continue
+			}
+			_, err = self.StoreItem(db, item)
+			if err != nil {
+				return moved, err
+			}
+			//Only if the item hasn't changed since we read it.
+			err = chancoll.Update(
+				bson.M{"_id": chanrec.Slug, "items": bson.M{"$elemMatch": bson.M{"_id": item.Slug, "data": b64data}}},
+				bson.M{
+					"$set": bson.M{
+						"items.$.hash":         item.Hash,
+						"items.$.content_type": item.ContentType,
+						"items.$.size":         item.Size,
+					},
+					"$unset": bson.M{"items.$.data": ""},
+				},
+			)
+			if err == mgo.ErrNotFound {
+				ReleaseBlob(db, item.Hash)
+				continue
+			} else if err != nil {
+				ReleaseBlob(db, item.Hash)
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+//gridFSLocation matches the locations the GridFS backend hands out.
+var gridFSLocation = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+//nameBlobs records the backend of blobs stored before blobs recorded
+//it.  A GridFS file id can only be GridFS's; anything else is taken to
+//be the configured backend's, as switching used to need a fresh
+//database.  With GridFS configured, those are left unnamed.
+func (self *BlobStore) nameBlobs(db *mgo.Database) error {
+	blobs := db.C(blobsCollection)
+	_, err := blobs.UpdateAll(
+		bson.M{"backend": bson.M{"$exists": false}, "location": bson.M{"$regex": gridFSLocation.String()}},
+		bson.M{"$set": bson.M{"backend": "gridfs"}})
+	if err != nil || self.backend.Name() == "gridfs" {
+		return err
+	}
+	_, err = blobs.UpdateAll(bson.M{"backend": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"backend": self.backend.Name()}})
+	return err
+}
+
+//ForeignBackends lists the backends other than this store's that hold
+//blobs, with "" for blobs whose backend is unknown.  The server won't
+//start while there are any; MigrateBlobs moves them.
+func (self *BlobStore) ForeignBackends(db *mgo.Database) ([]string, error) {
+	err := self.nameBlobs(db)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = db.C(blobsCollection).Find(bson.M{"backend": bson.M{"$ne": self.backend.Name()}}).Distinct("backend", &names)
+	if err != nil {
+		return nil, err
+	}
+	count, err := db.C(blobsCollection).Find(bson.M{"backend": bson.M{"$exists": false}}).Count()
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		names = append(names, "")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//MigrateBlobs copies the blobs from holds into this store's backend,
+//deleting them from from, and returns how many it moved.
+func (self *BlobStore) MigrateBlobs(db *mgo.Database, from BlobBackend) (int, error) {
+	err := self.nameBlobs(db)
+	if err != nil {
+		return 0, err
+	}
+	blobs := db.C(blobsCollection)
+	name := self.backend.Name()
+	if from.Name() == name {
+		return 0, nil
+	}
+	moved := 0
+	var blob BlobDBRecord
+	iter := blobs.Find(bson.M{"backend": from.Name()}).Iter()
+	for iter.Next(&blob) {
+		reader, err := from.Open(blob.Location)
+		if err != nil {
+			iter.Close()
+			return moved, fmt.Errorf("could not read blob %s: %s", blob.Hash, err.Error())
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			iter.Close()
+			return moved, fmt.Errorf("could not read blob %s: %s", blob.Hash, err.Error())
+		}
+		if HashData(data) != blob.Hash {
+			warnf("Blob %s does not match its hash; leaving it alone", blob.Hash)
+			continue
+		}
+		location, err := self.backend.Put(blob.Hash, data)
+		if err != nil {
+			iter.Close()
+			return moved, err
+		}
+		//Only if nobody has moved or collected it meanwhile.
+		err = blobs.Update(
+			bson.M{"_id": blob.Hash, "backend": from.Name(), "location": blob.Location},
+			bson.M{"$set": bson.M{"backend": name, "location": location}})
+		if err == mgo.ErrNotFound {
+			self.backend.Delete(location)
+			continue
+		} else if err != nil {
+			self.backend.Delete(location)
+			iter.Close()
+			return moved, err
+		}
+		err = from.Delete(blob.Location)
+		if err != nil {
+			warnf("Could not delete old copy of blob %s: %s", blob.Hash, err.Error())
+		}
+		moved++
+	}
+	return moved, iter.Close()
+}
+
+//blobCollector runs Collect in the background.
+type blobCollector struct {
+	blobs    *BlobStore
+	session  *mgo.Session
+	dbname   string
+	interval time.Duration
+	stop     chan bool
+	done     chan bool
+}
+
+func newBlobCollector(blobs *BlobStore, session *mgo.Session, dbname string, interval time.Duration) *blobCollector {
+	return &blobCollector{blobs, session, dbname, interval, make(chan bool), make(chan bool)}
+}
+
+func (self *blobCollector) collect() {
+	session := self.session.Copy()
+	defer session.Close()
+	removed, err := self.blobs.Collect(session.DB(self.dbname))
+	if err != nil {
+		errorf("Blob collection failed: %s", err.Error())
+	} else if removed > 0 {
+		infof("Deleted %d unused blobs", removed)
+	}
+}
+
+func (self *blobCollector) run() {
+	defer close(self.done)
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-time.After(self.interval):
+		}
+		self.collect()
+	}
+}
+
+func (self *blobCollector) Stop() {
+	close(self.stop)
+	<-self.done
+}
+
+//gridFSBackend keeps blobs in MongoDB's GridFS, which has no 16MB
+//document limit.
+type gridFSBackend struct {
+	session *mgo.Session
+	dbname  string
+}
+
+func NewGridFSBackend(session *mgo.Session, dbname string) BlobBackend {
+	return &gridFSBackend{session, dbname}
+}
+
+func (self *gridFSBackend) Name() string {
+	return "gridfs"
+}
+
+func (self *gridFSBackend) Put(hash string, data []byte) (string, error) {
+	session := self.session.Copy()
+	defer session.Close()
+	file, err := session.DB(self.dbname).GridFS(blobsGridFS).Create(hash)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return "", err
+	}
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+	return file.Id().(bson.ObjectId).Hex(), nil
+}
+
+//gridFSReader closes the session copy along with the file.
+type gridFSReader struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (self *gridFSReader) Close() error {
+	err := self.GridFile.Close()
+	self.session.Close()
+	return err
+}
+
+func (self *gridFSBackend) Open(location string) (io.ReadCloser, error) {
+	if !bson.IsObjectIdHex(location) {
+		return nil, mgo.ErrNotFound
+	}
+	session := self.session.Copy()
+	file, err := session.DB(self.dbname).GridFS(blobsGridFS).OpenId(bson.ObjectIdHex(location))
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &gridFSReader{file, session}, nil
+}
+
+func (self *gridFSBackend) Delete(location string) error {
+	if !bson.IsObjectIdHex(location) {
+		return nil
+	}
+	session := self.session.Copy()
+	defer session.Close()
+	err := session.DB(self.dbname).GridFS(blobsGridFS).RemoveId(bson.ObjectIdHex(location))
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+)
+
+type BlobSuite struct{}
+
+var _ = Suite(&BlobSuite{})
+
+func (self *BlobSuite) TestHashData(c *C) {
+	c.Assert(HashData([]byte("abc")), Equals, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	c.Assert(HashData(nil), Equals, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+}
+
+//WriteItemZip reads hashed items through the opener and inline ones
+//directly.
+func (self *BlobSuite) TestItemZip(c *C) {
+	stored := map[string][]byte{
+		HashData([]byte("hashed text")): []byte("hashed text"),
+	}
+	open := func(item *ItemDBRecord) (io.ReadCloser, int64, error) {
+		if item.Hash == "" {
+			return ioutil.NopCloser(decodeReader(item.Data)), decodedLen(item.Data), nil
+		}
+		data, ok := stored[item.Hash]
+		if !ok {
+			return nil, 0, mgo.ErrNotFound
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+
+	chanrec := NewChannel("blobs", "Blobs", "someone")
+	inline := NewItem("inline", "Inline", base64.StdEncoding.EncodeToString([]byte("inline text")), "someone")
+	hashed := NewItem("hashed", "Hashed", "", "someone")
+	hashed.Hash = HashData([]byte("hashed text"))
+	chanrec.Items = append(chanrec.Items, *inline, *hashed)
+
+	var buf bytes.Buffer
+	err := WriteItemZip(&buf, chanrec, open)
+	c.Assert(err, IsNil)
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	c.Assert(err, IsNil)
+	contents := make(map[string]string)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(reader)
+		c.Assert(err, IsNil)
+		contents[file.Name] = string(data)
+	}
+	c.Assert(contents, DeepEquals, map[string]string{
+		"inline.txt": "inline text",
+		"hashed.txt": "hashed text",
+	})
+
+	chanrec.Items[1].Hash = HashData([]byte("missing"))
+	err = WriteItemZip(ioutil.Discard, chanrec, open)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
@@ -1,12 +1,28 @@
 package api
 
 import (
+	"encoding/json"
+	"labix.org/v2/mgo/bson"
 	"time"
 )
 
 type UserDBRecord struct {
 	Username      string   "_id,omitempty"
 	Subscriptions []string "subscriptions"
+	//TOTPSecret is set once two-factor authentication is confirmed;
+	//until then the secret being enrolled is in TOTPPending.
+	TOTPSecret   string "totp_secret,omitempty"
+	TOTPPending  string "totp_pending,omitempty"
+	TOTPLastStep int64  "totp_last_step,omitempty"
+	//TOTPSince is when two-factor authentication was turned on; API keys
+	//made before then stop working.
+	TOTPSince time.Time "totp_since,omitempty"
+	//TOTPFailures counts wrong codes since the last good one.  Too many
+	//lock the second factor until TOTPLockedUntil.
+	TOTPFailures    int       "totp_failures,omitempty"
+	TOTPLockedUntil time.Time "totp_locked_until,omitempty"
+	//RecoveryCodes are the hashes of the unused recovery codes.
+	RecoveryCodes []string "recovery_codes,omitempty"
 }
 
 func (self *UserDBRecord) ToJSON() *UserJSONRecord {
@@ -17,27 +33,105 @@ func (self *UserDBRecord) ToJSON() *UserJSONRecord {
 }
 
 type ItemDBRecord struct {
-	Slug         string    "_id,omitempty"
-	Title        string    "title"
-	DateUploaded time.Time "date_uploaded"
-	Data         string    "data"
-	Uploader     string    "uploader"
+	Slug         string                "_id,omitempty"
+	Title        string                "title"
+	DateUploaded time.Time             "date_uploaded"
+	Data         string                "data,omitempty"
+	Hash         string                "hash,omitempty"
+	Uploader     string                "uploader"
+	ContentType  string                "content_type,omitempty"
+	Size         int64                 "size,omitempty"
+	Metadata     *ItemMetadataDBRecord "metadata,omitempty"
+	//SourceHash is the hash of the data as uploaded, when stripping
+	//metadata changed it.
+	SourceHash string "source_hash,omitempty"
 }
 
 func (self *ItemDBRecord) ToJSON() *ItemJSONRecord {
-	return &ItemJSONRecord{
+	rec := &ItemJSONRecord{
 		Slug:         self.Slug,
 		Title:        self.Title,
 		DateUploaded: self.DateUploaded,
 		Uploader:     self.Uploader,
+		ContentType:  self.ContentType,
+		Size:         self.Size,
+		Hash:         self.Hash,
+		SourceHash:   self.SourceHash,
 	}
+	if self.Metadata != nil {
+		rec.Metadata = self.Metadata.ToJSON()
+	}
+	return rec
+}
+
+//LocationDBRecord is where a photo was taken, in decimal degrees.
+type LocationDBRecord struct {
+	Latitude  float64 "latitude"
+	Longitude float64 "longitude"
+}
+
+type ItemMetadataDBRecord struct {
+	Width       int               "width"
+	Height      int               "height"
+	CaptureTime time.Time         "capture_time,omitempty"
+	CameraMake  string            "camera_make,omitempty"
+	CameraModel string            "camera_model,omitempty"
+	Orientation int               "orientation,omitempty"
+	Location    *LocationDBRecord "location,omitempty"
+}
+
+func (self *ItemMetadataDBRecord) ToJSON() *ItemMetadataJSONRecord {
+	rec := &ItemMetadataJSONRecord{
+		Width:       self.Width,
+		Height:      self.Height,
+		CameraMake:  self.CameraMake,
+		CameraModel: self.CameraModel,
+		Orientation: self.Orientation,
+	}
+	if !self.CaptureTime.IsZero() {
+		rec.CaptureTime = &self.CaptureTime
+	}
+	if self.Location != nil {
+		rec.Location = &LocationJSONRecord{self.Location.Latitude, self.Location.Longitude}
+	}
+	return rec
 }
 
 type ChannelDBRecord struct {
-	Slug  string         "_id,omitempty"
-	Title string         "title"
-	Owner string         "owner"
-	Items []ItemDBRecord "items"
+	Slug      string         "_id,omitempty"
+	Title     string         "title"
+	Owner     string         "owner"
+	Items     []ItemDBRecord "items"
+	StripEXIF bool           "strip_exif"
+	//AllowedTypes are MIME types or patterns like "image/*"; empty
+	//means anything goes.
+	AllowedTypes []string "allowed_types"
+	//MaxItemBytes is the largest item the channel takes; 0 means only
+	//the server's upload limit applies.
+	MaxItemBytes int64 "max_item_bytes"
+	//Visibility is one of the Visibility* constants; empty (channels
+	//from before the setting) means public.
+	Visibility string "visibility,omitempty"
+	//Members are the users with a role in the channel besides its
+	//owner, who is always an owner.
+	Members []MemberDBRecord "members,omitempty"
+	//Org is the organization owning the channel, if any; such channels
+	//have no Owner.
+	Org string "org,omitempty"
+	//org is Org's record, filled in by FindChannel and ListChannels.
+	org *OrgDBRecord
+}
+
+type MemberDBRecord struct {
+	Username string "username"
+	Role     string "role"
+}
+
+func (self *MemberDBRecord) ToJSON() *MemberJSONRecord {
+	return &MemberJSONRecord{
+		Username: self.Username,
+		Role:     self.Role,
+	}
 }
 
 func (self *ChannelDBRecord) ToJSON() *ChannelJSONRecord {
@@ -46,8 +140,263 @@ func (self *ChannelDBRecord) ToJSON() *ChannelJSONRecord {
 		items = append(items, item.ToJSON())
 	}
 	return &ChannelJSONRecord{
-		Slug:  self.Slug,
-		Title: self.Title,
-		Items: items,
+		Slug:         self.Slug,
+		Title:        self.Title,
+		Items:        items,
+		StripEXIF:    self.StripEXIF,
+		AllowedTypes: self.AllowedTypes,
+		MaxItemBytes: self.MaxItemBytes,
+		Visibility:   self.GetVisibility(),
+		Org:          self.Org,
+	}
+}
+
+func (self *ChannelDBRecord) GetVisibility() string {
+	if self.Visibility == "" {
+		return VisibilityPublic
 	}
+	return self.Visibility
+}
+
+//CanRead says whether username (or nobody, if it is "") may see the
+//channel and its items.
+func (self *ChannelDBRecord) CanRead(username string) bool {
+	switch self.GetVisibility() {
+	case VisibilityPublic:
+		return true
+	case VisibilityAuthenticated:
+		return username != ""
+	}
+	return self.HasRole(username, RoleViewer)
+}
+
+//RoleOf returns username's role in the channel, or "" if they have none.
+//In an organization's channel it is the better of their role as a
+//channel member and the one their org role gives them.
+func (self *ChannelDBRecord) RoleOf(username string) string {
+	if username == "" {
+		return ""
+	}
+	if username == self.Owner {
+		return RoleOwner
+	}
+	role := ""
+	for _, member := range self.Members {
+		if member.Username == username {
+			role = member.Role
+		}
+	}
+	if self.org != nil {
+		orgRole := channelRoleInOrg[self.org.RoleOf(username)]
+		if roleRanks[orgRole] > roleRanks[role] {
+			role = orgRole
+		}
+	}
+	return role
+}
+
+func (self *ChannelDBRecord) HasRole(username, role string) bool {
+	return roleAtLeast(self.RoleOf(username), role)
+}
+
+//FindItem returns the item with the given slug, or nil.
+func (self *ChannelDBRecord) FindItem(slug string) *ItemDBRecord {
+	for i := range self.Items {
+		if self.Items[i].Slug == slug {
+			return &self.Items[i]
+		}
+	}
+	return nil
+}
+
+type OrgDBRecord struct {
+	Name        string              "_id"
+	Title       string              "title"
+	Members     []OrgMemberDBRecord "members"
+	DateCreated time.Time           "date_created"
+}
+
+type OrgMemberDBRecord struct {
+	Username string "username"
+	Role     string "role"
+}
+
+func (self *OrgDBRecord) ToJSON() *OrgJSONRecord {
+	members := make([]*MemberJSONRecord, 0)
+	for _, member := range self.Members {
+		members = append(members, &MemberJSONRecord{member.Username, member.Role})
+	}
+	return &OrgJSONRecord{
+		Name:        self.Name,
+		Title:       self.Title,
+		Members:     members,
+		DateCreated: self.DateCreated,
+	}
+}
+
+//RoleOf returns username's role in the organization, or "".
+func (self *OrgDBRecord) RoleOf(username string) string {
+	for _, member := range self.Members {
+		if member.Username == username {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+//lastAdmin reports whether username is the organization's only admin.
+func (self *OrgDBRecord) lastAdmin(username string) bool {
+	if self.RoleOf(username) != OrgRoleAdmin {
+		return false
+	}
+	for _, member := range self.Members {
+		if member.Role == OrgRoleAdmin && member.Username != username {
+			return false
+		}
+	}
+	return true
+}
+
+//APIKeyDBRecord is an API key.  Only the key's hash is kept; Prefix is
+//its first few characters, for telling keys apart.
+type APIKeyDBRecord struct {
+	Id          bson.ObjectId "_id"
+	Hash        string        "hash"
+	Prefix      string        "prefix"
+	Owner       string        "owner"
+	Name        string        "name"
+	Scopes      []string      "scopes"
+	DateCreated time.Time     "date_created"
+	LastUsed    time.Time     "last_used,omitempty"
+}
+
+func (self *APIKeyDBRecord) ToJSON() *APIKeyJSONRecord {
+	rec := &APIKeyJSONRecord{
+		ID:          self.Id.Hex(),
+		Name:        self.Name,
+		Prefix:      self.Prefix,
+		Scopes:      self.Scopes,
+		DateCreated: self.DateCreated,
+	}
+	if !self.LastUsed.IsZero() {
+		rec.LastUsed = &self.LastUsed
+	}
+	return rec
+}
+
+//SessionDBRecord is a login session.  Only the token's hash is kept.
+type SessionDBRecord struct {
+	Id          bson.ObjectId "_id"
+	Hash        string        "hash"
+	Username    string        "username"
+	DateCreated time.Time     "date_created"
+	LastSeen    time.Time     "last_seen"
+	Expires     time.Time     "expires"
+	UserAgent   string        "user_agent"
+	IP          string        "ip"
+}
+
+func (self *SessionDBRecord) ToJSON() *SessionJSONRecord {
+	return &SessionJSONRecord{
+		ID:          self.Id.Hex(),
+		DateCreated: self.DateCreated,
+		LastSeen:    self.LastSeen,
+		Expires:     self.Expires,
+		UserAgent:   self.UserAgent,
+		IP:          self.IP,
+	}
+}
+
+type WebhookDBRecord struct {
+	Id          bson.ObjectId "_id"
+	Channel     string        "channel"
+	URL         string        "url"
+	Secret      string        "secret"
+	Events      []string      "events"
+	Creator     string        "creator"
+	DateCreated time.Time     "date_created"
+}
+
+//ToJSON leaves the secret out; it is only shown once, when the webhook
+//is created.
+func (self *WebhookDBRecord) ToJSON() *WebhookJSONRecord {
+	return &WebhookJSONRecord{
+		ID:          self.Id.Hex(),
+		Channel:     self.Channel,
+		URL:         self.URL,
+		Events:      self.Events,
+		Creator:     self.Creator,
+		DateCreated: self.DateCreated,
+	}
+}
+
+//Wants reports whether the webhook is interested in an event type.
+func (self *WebhookDBRecord) Wants(eventType string) bool {
+	for _, wanted := range self.Events {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//DeliveryDBRecord is one event on its way to one webhook.  Pending
+//deliveries are the retry queue; the rest are the delivery log.
+type DeliveryDBRecord struct {
+	Id            bson.ObjectId "_id"
+	Webhook       bson.ObjectId "webhook"
+	Channel       string        "channel"
+	EventType     string        "event_type"
+	Payload       string        "payload"
+	Status        string        "status"
+	Attempts      int           "attempts"
+	NextAttempt   time.Time     "next_attempt"
+	LastStatus    int           "last_status"
+	LastError     string        "last_error"
+	DateCreated   time.Time     "date_created"
+	DateDelivered time.Time     "date_delivered"
+}
+
+func (self *DeliveryDBRecord) ToJSON() *DeliveryJSONRecord {
+	rec := &DeliveryJSONRecord{
+		ID:          self.Id.Hex(),
+		Webhook:     self.Webhook.Hex(),
+		EventType:   self.EventType,
+		Payload:     json.RawMessage(self.Payload),
+		Status:      self.Status,
+		Attempts:    self.Attempts,
+		LastStatus:  self.LastStatus,
+		LastError:   self.LastError,
+		DateCreated: self.DateCreated,
+	}
+	if self.Status == DeliveryPending {
+		rec.NextAttempt = &self.NextAttempt
+	}
+	if !self.DateDelivered.IsZero() {
+		rec.DateDelivered = &self.DateDelivered
+	}
+	return rec
+}
+
+//VariantDBRecord is a cached resized copy of an image item.  Source is
+//the item's upload date, so a variant of a replaced item is never used.
+type VariantDBRecord struct {
+	Key         string    "_id"
+	Channel     string    "channel"
+	Item        string    "item"
+	Source      time.Time "source"
+	ContentType string    "content_type"
+	Data        []byte    "data"
+	DateCreated time.Time "date_created"
+}
+
+//BlobDBRecord is a piece of item data in the blob store, keyed by its
+//SHA-256.  Refs counts the items (and uploads in progress) using it.
+type BlobDBRecord struct {
+	Hash        string    "_id"
+	Location    string    "location"
+	Backend     string    "backend"
+	Size        int64     "size"
+	Refs        int       "refs"
+	DateCreated time.Time "date_created"
 }
@@ -7,6 +7,18 @@ import (
 type ErrorDescription struct {
 	Status int
 	Error  string
+	//Code is a stable machine-readable name for the error, for clients
+	//that need to tell failures apart.  Most errors don't have one.
+	Code string
+}
+
+//Fail raises an error with a code.
+func Fail(status int, code, msg string) {
+	panic(&ErrorDescription{
+		Status: status,
+		Error:  msg,
+		Code:   code,
+	})
 }
 
 func InternalError(msg string) {
@@ -50,3 +62,17 @@ func Gone(msg string) {
 		Error:  msg,
 	})
 }
+
+func RequestEntityTooLarge(msg string) {
+	panic(&ErrorDescription{
+		Status: http.StatusRequestEntityTooLarge,
+		Error:  msg,
+	})
+}
+
+func UnsupportedMediaType(msg string) {
+	panic(&ErrorDescription{
+		Status: http.StatusUnsupportedMediaType,
+		Error:  msg,
+	})
+}
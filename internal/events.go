@@ -0,0 +1,178 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventItemCreated = "item-created"
+	EventItemUpdated = "item-updated"
+	EventItemDeleted = "item-deleted"
+)
+
+//Event is something that happened to a channel.  IDs increase by one per
+//event and are only meaningful within one run of the server.
+type Event struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	Channel  string          `json:"channel"`
+	ItemSlug string          `json:"item_slug"`
+	Item     *ItemJSONRecord `json:"item,omitempty"`
+	Time     time.Time       `json:"time"`
+}
+
+//EventBus fans channel events out to in-process subscribers and keeps a
+//short history so that subscribers can resume after a reconnect.
+//Publishing never blocks: a subscriber that falls too far behind is
+//dropped (its channel is closed with Overflowed set) and has to resume
+//from the last event it saw.
+type EventBus struct {
+	mutex       sync.Mutex
+	lastID      int64
+	history     []*Event
+	historySize int
+	subscribers map[*Subscription]bool
+	closed      bool
+}
+
+type Subscription struct {
+	C          chan *Event
+	bus        *EventBus
+	channels   map[string]bool
+	overflowed bool
+	closed     bool
+}
+
+func NewEventBus(historySize int) *EventBus {
+	return &EventBus{
+		history:     make([]*Event, 0, historySize),
+		historySize: historySize,
+		subscribers: make(map[*Subscription]bool),
+	}
+}
+
+func (self *EventBus) Publish(eventType, channel, itemSlug string, item *ItemJSONRecord) *Event {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.lastID++
+	event := &Event{
+		ID:       self.lastID,
+		Type:     eventType,
+		Channel:  channel,
+		ItemSlug: itemSlug,
+		Item:     item,
+		Time:     time.Now(),
+	}
+	if len(self.history) == self.historySize {
+		copy(self.history, self.history[1:])
+		self.history = self.history[:len(self.history)-1]
+	}
+	self.history = append(self.history, event)
+
+	for sub := range self.subscribers {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.C <- event:
+		default:
+			sub.overflowed = true
+			self.unsubscribe(sub)
+		}
+	}
+	return event
+}
+
+func (self *Subscription) wants(event *Event) bool {
+	return self.channels[event.Channel]
+}
+
+//Subscribe returns a subscription to events on the given channel slugs
+//(more can be added later with Add), with room for buffer undelivered
+//events.  If lastID is non-zero the events after it that are still in
+//the history are returned too; complete is false if some of them have
+//already been forgotten.
+func (self *EventBus) Subscribe(buffer int, lastID int64, channels ...string) (sub *Subscription, missed []*Event, complete bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	sub = &Subscription{
+		C:        make(chan *Event, buffer),
+		bus:      self,
+		channels: make(map[string]bool),
+	}
+	for _, channel := range channels {
+		sub.channels[channel] = true
+	}
+	if self.closed {
+		sub.closed = true
+		close(sub.C)
+		return sub, nil, true
+	}
+	self.subscribers[sub] = true
+
+	missed = make([]*Event, 0)
+	complete = true
+	if lastID > 0 && lastID <= self.lastID {
+		if len(self.history) == 0 || self.history[0].ID > lastID+1 {
+			complete = false
+		}
+		for _, event := range self.history {
+			if event.ID > lastID && sub.wants(event) {
+				missed = append(missed, event)
+			}
+		}
+	} else if lastID > self.lastID {
+		//The client saw IDs from before a restart.
+		complete = false
+	}
+	return sub, missed, complete
+}
+
+func (self *EventBus) unsubscribe(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(self.subscribers, sub)
+	close(sub.C)
+}
+
+//Close ends every subscription and makes new ones start out closed.  It
+//is used on shutdown so that streaming handlers return.
+func (self *EventBus) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	for sub := range self.subscribers {
+		self.unsubscribe(sub)
+	}
+}
+
+//Add subscribes to events on another channel.
+func (self *Subscription) Add(channel string) {
+	self.bus.mutex.Lock()
+	defer self.bus.mutex.Unlock()
+	self.channels[channel] = true
+}
+
+//Remove stops delivery of events on a channel.
+func (self *Subscription) Remove(channel string) {
+	self.bus.mutex.Lock()
+	defer self.bus.mutex.Unlock()
+	delete(self.channels, channel)
+}
+
+//Overflowed reports whether the subscription was dropped for falling
+//behind.  Only meaningful once C has been closed.
+func (self *Subscription) Overflowed() bool {
+	self.bus.mutex.Lock()
+	defer self.bus.mutex.Unlock()
+	return self.overflowed
+}
+
+func (self *Subscription) Close() {
+	self.bus.mutex.Lock()
+	defer self.bus.mutex.Unlock()
+	self.bus.unsubscribe(self)
+}
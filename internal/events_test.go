@@ -0,0 +1,80 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type EventBusSuite struct{}
+
+var _ = Suite(&EventBusSuite{})
+
+func (self *EventBusSuite) TestDeliversOnlySubscribedChannels(c *C) {
+	bus := NewEventBus(10)
+	sub, missed, complete := bus.Subscribe(10, 0, "a")
+	defer sub.Close()
+	c.Assert(len(missed), Equals, 0)
+	c.Assert(complete, Equals, true)
+
+	bus.Publish(EventItemCreated, "b", "x", nil)
+	bus.Publish(EventItemCreated, "a", "y", nil)
+	event := <-sub.C
+	c.Assert(event.Channel, Equals, "a")
+	c.Assert(event.ItemSlug, Equals, "y")
+	c.Assert(event.ID, Equals, int64(2))
+
+	sub.Add("b")
+	sub.Remove("a")
+	bus.Publish(EventItemDeleted, "a", "y", nil)
+	bus.Publish(EventItemDeleted, "b", "x", nil)
+	event = <-sub.C
+	c.Assert(event.Channel, Equals, "b")
+	c.Assert(event.Type, Equals, EventItemDeleted)
+}
+
+func (self *EventBusSuite) TestResume(c *C) {
+	bus := NewEventBus(3)
+	for i := 0; i < 5; i++ {
+		bus.Publish(EventItemCreated, "a", "x", nil)
+	}
+	sub, missed, complete := bus.Subscribe(10, 3, "a")
+	sub.Close()
+	c.Assert(complete, Equals, true)
+	c.Assert(len(missed), Equals, 2)
+	c.Assert(missed[0].ID, Equals, int64(4))
+
+	sub, missed, complete = bus.Subscribe(10, 1, "a")
+	sub.Close()
+	c.Assert(complete, Equals, false)
+	c.Assert(len(missed), Equals, 3)
+
+	sub, _, complete = bus.Subscribe(10, 99, "a")
+	sub.Close()
+	c.Assert(complete, Equals, false)
+}
+
+func (self *EventBusSuite) TestSlowSubscriberIsDropped(c *C) {
+	bus := NewEventBus(10)
+	sub, _, _ := bus.Subscribe(2, 0, "a")
+	for i := 0; i < 3; i++ {
+		bus.Publish(EventItemCreated, "a", "x", nil)
+	}
+	count := 0
+	for _ = range sub.C {
+		count++
+	}
+	c.Assert(count, Equals, 2)
+	c.Assert(sub.Overflowed(), Equals, true)
+}
+
+func (self *EventBusSuite) TestCloseEndsSubscriptions(c *C) {
+	bus := NewEventBus(10)
+	sub, _, _ := bus.Subscribe(2, 0, "a")
+	bus.Close()
+	_, ok := <-sub.C
+	c.Assert(ok, Equals, false)
+	c.Assert(sub.Overflowed(), Equals, false)
+
+	late, _, _ := bus.Subscribe(2, 0, "a")
+	_, ok = <-late.C
+	c.Assert(ok, Equals, false)
+}
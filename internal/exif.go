@@ -0,0 +1,319 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+)
+
+var errBadImage = errors.New("image is malformed")
+
+//ExtractMetadata reads what we want to know about an image: its size
+//and, for JPEGs with EXIF, when and with what it was taken, its
+//orientation and where it was taken.  It returns nil for anything that
+//isn't a JPEG, PNG or GIF.
+func ExtractMetadata(data []byte) *ItemMetadataDBRecord {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	meta := &ItemMetadataDBRecord{
+		Width:  config.Width,
+		Height: config.Height,
+	}
+	if format != "jpeg" {
+		return meta
+	}
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		//No EXIF, or EXIF too broken to be worth reporting.
+		return meta
+	}
+	if captured, err := x.DateTime(); err == nil {
+		meta.CaptureTime = captured
+	}
+	if tag, err := x.Get(exif.Make); err == nil {
+		meta.CameraMake, _ = tag.StringVal()
+	}
+	if tag, err := x.Get(exif.Model); err == nil {
+		meta.CameraModel, _ = tag.StringVal()
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		meta.Orientation, _ = tag.Int(0)
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		meta.Location = &LocationDBRecord{lat, long}
+	}
+	return meta
+}
+
+//StripMetadata removes EXIF and XMP metadata (which is where GPS
+//coordinates and camera serial numbers live) from a JPEG, PNG or WebP.
+//A JPEG also loses its Photoshop/IPTC block and the extra pictures
+//phones append after the image, which carry metadata of their own, and
+//keeps a minimal EXIF block holding only its orientation, so it still
+//displays the right way up.  Other data is returned unchanged.
+func StripMetadata(data []byte, orientation int) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return stripJPEG(data, orientation)
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		return stripPNG(data)
+	}
+	if len(data) >= 12 && bytes.HasPrefix(data, riffHeader) && bytes.Equal(data[8:12], webpHeader) {
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+var (
+	exifHeader         = []byte("Exif\x00\x00")
+	xmpHeader          = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtensionHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	mpfHeader          = []byte("MPF\x00")
+	pngSignature       = []byte("\x89PNG\r\n\x1a\n")
+	riffHeader         = []byte("RIFF")
+	webpHeader         = []byte("WEBP")
+)
+
+//jpegMetadataSegment says whether a JPEG segment holds metadata: EXIF,
+//XMP (extended XMP included), the MPF index of appended pictures, or
+//Photoshop's APP13 with its IPTC data.
+func jpegMetadataSegment(marker byte, payload []byte) bool {
+	switch marker {
+	case 0xE1:
+		return bytes.HasPrefix(payload, exifHeader) || bytes.HasPrefix(payload, xmpHeader) ||
+			bytes.HasPrefix(payload, xmpExtensionHeader)
+	case 0xE2:
+		return bytes.HasPrefix(payload, mpfHeader)
+	case 0xED:
+		return true
+	}
+	return false
+}
+
+//scanEnd finds where the entropy-coded data starting at pos ends: at the
+//first marker that isn't a stuffed zero or a restart marker.
+func scanEnd(data []byte, pos int) int {
+	for pos+1 < len(data) {
+		if data[pos] != 0xFF {
+			pos++
+			continue
+		}
+		next := data[pos+1]
+		if next != 0x00 && (next < 0xD0 || next > 0xD7) {
+			return pos
+		}
+		pos += 2
+	}
+	return len(data)
+}
+
+func stripJPEG(data []byte, orientation int) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	replaced := orientation <= 1
+	scanned := false
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF || pos+1 >= len(data) {
+			return nil, errBadImage
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			//Fill byte.
+			pos++
+			continue
+		}
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+		if (marker == 0xDA || marker == 0xD9) && !replaced {
+			out.Write(orientationSegment(orientation))
+			replaced = true
+		}
+		if marker == 0xD9 {
+			//End of image.  Anything after it, such as the pictures MPF
+			//appends, goes.
+			out.Write(data[pos : pos+2])
+			return out.Bytes(), nil
+		}
+		if pos+4 > len(data) {
+			return nil, errBadImage
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			return nil, errBadImage
+		}
+		if marker == 0xDA {
+			//Start of scan: the image data follows, up to the next marker.
+			end = scanEnd(data, end)
+			out.Write(data[pos:end])
+			scanned = true
+		} else if jpegMetadataSegment(marker, data[pos+4:end]) {
+			if !replaced {
+				out.Write(orientationSegment(orientation))
+				replaced = true
+			}
+		} else {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	if !scanned {
+		return nil, errBadImage
+	}
+	//The image data ran to the end without an end of image marker.
+	return out.Bytes(), nil
+}
+
+//orientationSegment is an APP1 segment with an EXIF block holding
+//nothing but the orientation tag.
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, //big-endian header, IFD0 at offset 8
+		0, 1, //one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, //Orientation, SHORT, 1 value
+		0, 0, 0, 0, //no more IFDs
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, errBadImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return nil, errBadImage
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		body := data[pos+8 : pos+8+length]
+		if !pngMetadataChunk(chunkType, body) {
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if chunkType == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+	return nil, errBadImage
+}
+
+//VP8X flags saying a WebP has EXIF and XMP chunks.
+const (
+	webpEXIFFlag = 0x08
+	webpXMPFlag  = 0x04
+)
+
+//stripWebP drops a WebP's EXIF and XMP chunks, orientation included, and
+//anything after the RIFF container.
+func stripWebP(data []byte) ([]byte, error) {
+	riffEnd := 8 + int(binary.LittleEndian.Uint32(data[4:]))
+	if riffEnd > len(data) || riffEnd < 12 {
+		return nil, errBadImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, riffEnd))
+	out.Write(data[:12])
+	pos := 12
+	for pos < riffEnd {
+		if pos+8 > riffEnd {
+			return nil, errBadImage
+		}
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		//Chunks are padded to an even length.
+		end := pos + 8 + length + length%2
+		if length < 0 || end > riffEnd || end < pos {
+			return nil, errBadImage
+		}
+		switch string(data[pos : pos+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[pos:end]...)
+			if length > 0 {
+				chunk[8] &^= webpEXIFFlag | webpXMPFlag
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+func pngMetadataChunk(chunkType string, body []byte) bool {
+	switch chunkType {
+	case "eXIf":
+		return true
+	case "tEXt", "zTXt", "iTXt":
+		keyword := body
+		if i := bytes.IndexByte(body, 0); i >= 0 {
+			keyword = body[:i]
+		}
+		return string(keyword) == "XML:com.adobe.xmp" || bytes.HasPrefix(keyword, []byte("Raw profile type"))
+	}
+	return false
+}
+
+//stripsMetadata says whether ProcessItem will rewrite an item's data.
+//The item must have been through CheckItem.
+func stripsMetadata(chanrec *ChannelDBRecord, itemrec *ItemDBRecord) bool {
+	switch itemrec.ContentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return chanrec.StripEXIF
+	}
+	return false
+}
+
+//ProcessItem fills in an item's metadata and, if the channel asks for
+//it, strips the metadata out of its data.  The location is only kept
+//when the data is left alone; it would be odd to strip GPS from the
+//photo and then show it to everyone anyway.  Stripped items get their
+//new size, which is what the channel's size limit applies to; an item
+//still too large is refused with an *UploadError.
+func ProcessItem(chanrec *ChannelDBRecord, itemrec *ItemDBRecord) error {
+	switch extensionFor(decodeHead(itemrec.Data)) {
+	case ".jpg", ".png", ".gif", ".webp":
+	default:
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(itemrec.Data)
+	if err != nil {
+		return nil
+	}
+	itemrec.Metadata = ExtractMetadata(data)
+	if !chanrec.StripEXIF {
+		return nil
+	}
+	orientation := 0
+	if itemrec.Metadata != nil {
+		itemrec.Metadata.Location = nil
+		orientation = itemrec.Metadata.Orientation
+	}
+	stripped, err := StripMetadata(data, orientation)
+	if err != nil {
+		return err
+	}
+	if itemrec.SourceHash == "" && !bytes.Equal(stripped, data) {
+		itemrec.SourceHash = HashData(data)
+	}
+	itemrec.Data = base64.StdEncoding.EncodeToString(stripped)
+	itemrec.Size = int64(len(stripped))
+	return checkItemSize(chanrec, itemrec)
+}
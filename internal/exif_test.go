@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	. "gopkg.in/check.v1"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+)
+
+type ExifSuite struct{}
+
+var _ = Suite(&ExifSuite{})
+
+//exifJPEG makes a small JPEG carrying a camera make, an orientation of
+//6 and a location of 44.5N 93.25W.
+func exifJPEG(c *C) []byte {
+	tiff := new(bytes.Buffer)
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			c.Assert(binary.Write(tiff, binary.BigEndian, value), IsNil)
+		}
+	}
+	rational := func(num, den uint32) []uint32 { return []uint32{num, den} }
+	write([]byte("MM"), uint16(42), uint32(8))
+	//IFD0 at 8: Make, Orientation, GPS pointer.
+	write(uint16(3))
+	write(uint16(0x010F), uint16(2), uint32(8), uint32(50))
+	write(uint16(0x0112), uint16(3), uint32(1), uint16(6), uint16(0))
+	write(uint16(0x8825), uint16(4), uint32(1), uint32(58))
+	write(uint32(0))
+	write([]byte("TestCam\x00"))
+	//GPS IFD at 58.
+	write(uint16(4))
+	write(uint16(1), uint16(2), uint32(2), []byte("N\x00\x00\x00"))
+	write(uint16(2), uint16(5), uint32(3), uint32(112))
+	write(uint16(3), uint16(2), uint32(2), []byte("W\x00\x00\x00"))
+	write(uint16(4), uint16(5), uint32(3), uint32(136))
+	write(uint32(0))
+	write(rational(44, 1), rational(30, 1), rational(0, 1))
+	write(rational(93, 1), rational(15, 1), rational(0, 1))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+
+	var plain bytes.Buffer
+	c.Assert(jpeg.Encode(&plain, testImage(40, 20), nil), IsNil)
+	data := append([]byte{}, plain.Bytes()[:2]...)
+	data = append(data, segment...)
+	data = append(data, payload...)
+	return append(data, plain.Bytes()[2:]...)
+}
+
+func pngChunk(chunkType string, body []byte) []byte {
+	chunk := make([]byte, 4, 12+len(body))
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, body...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func (self *ExifSuite) TestExtractMetadata(c *C) {
+	meta := ExtractMetadata(exifJPEG(c))
+	c.Assert(meta, NotNil)
+	c.Assert(meta.Width, Equals, 40)
+	c.Assert(meta.Height, Equals, 20)
+	c.Assert(meta.CameraMake, Equals, "TestCam")
+	c.Assert(meta.Orientation, Equals, 6)
+	c.Assert(meta.Location, NotNil)
+	c.Assert(meta.Location.Latitude, Equals, 44.5)
+	c.Assert(meta.Location.Longitude, Equals, -93.25)
+
+	c.Assert(ExtractMetadata([]byte("not an image")), IsNil)
+}
+
+func (self *ExifSuite) TestStripJPEG(c *C) {
+	stripped, err := StripMetadata(exifJPEG(c), 6)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(stripped, []byte("TestCam")), Equals, false)
+	meta := ExtractMetadata(stripped)
+	c.Assert(meta, NotNil)
+	c.Assert(meta.Orientation, Equals, 6)
+	c.Assert(meta.CameraMake, Equals, "")
+	c.Assert(meta.Location, IsNil)
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	c.Assert(err, IsNil)
+
+	stripped, err = StripMetadata(exifJPEG(c), 1)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(stripped, []byte("Exif")), Equals, false)
+
+	_, err = StripMetadata([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF}, 0)
+	c.Assert(err, NotNil)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+//withSegments puts segments right after a JPEG's start of image marker.
+func withSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+func (self *ExifSuite) TestStripMultiPictureJPEG(c *C) {
+	//Phones append a preview after the end of the image, with its own
+	//EXIF, and index it with an MPF segment.
+	first := withSegments(exifJPEG(c),
+		jpegSegment(0xE2, []byte("MPF\x00MM\x00*index")),
+		jpegSegment(0xED, []byte("Photoshop 3.0\x008BIM iptc")))
+	data := append(append([]byte{}, first...), exifJPEG(c)...)
+
+	stripped, err := StripMetadata(data, 6)
+	c.Assert(err, IsNil)
+	for _, secret := range []string{"TestCam", "MPF", "Photoshop"} {
+		c.Assert(bytes.Contains(stripped, []byte(secret)), Equals, false, Commentf(secret))
+	}
+	c.Assert(len(stripped) < len(first), Equals, true)
+	c.Assert(bytes.HasSuffix(stripped, []byte{0xFF, 0xD9}), Equals, true)
+	meta := ExtractMetadata(stripped)
+	c.Assert(meta, NotNil)
+	c.Assert(meta.Orientation, Equals, 6)
+	c.Assert(meta.Location, IsNil)
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	c.Assert(err, IsNil)
+}
+
+func (self *ExifSuite) TestStripExtendedXMP(c *C) {
+	extension := append([]byte("http://ns.adobe.com/xmp/extension/\x00"), []byte("0123456789abcdef0123456789abcdef<exif:GPSLatitude>44,30N</exif:GPSLatitude>")...)
+	data := withSegments(exifJPEG(c), jpegSegment(0xE1, extension))
+
+	stripped, err := StripMetadata(data, 1)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(stripped, []byte("GPSLatitude")), Equals, false)
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	c.Assert(err, IsNil)
+}
+
+func webpChunk(chunkType string, body []byte) []byte {
+	chunk := make([]byte, 8, 9+len(body))
+	copy(chunk, chunkType)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func (self *ExifSuite) TestStripWebP(c *C) {
+	body := webpChunk("VP8X", []byte{webpEXIFFlag | webpXMPFlag, 0, 0, 0, 9, 0, 0, 9, 0, 0})
+	body = append(body, webpChunk("VP8L", []byte("pixel"))...)
+	body = append(body, webpChunk("EXIF", []byte("MM\x00*secret"))...)
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	data := append([]byte("RIFF\x00\x00\x00\x00WEBP"), body...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	data = append(data, "trailing GPS"...)
+
+	stripped, err := StripMetadata(data, 0)
+	c.Assert(err, IsNil)
+	for _, secret := range []string{"secret", "xmpmeta", "trailing"} {
+		c.Assert(bytes.Contains(stripped, []byte(secret)), Equals, false, Commentf(secret))
+	}
+	c.Assert(bytes.Contains(stripped, []byte("pixel")), Equals, true)
+	c.Assert(stripped[20], Equals, byte(0))
+	c.Assert(int(binary.LittleEndian.Uint32(stripped[4:])), Equals, len(stripped)-8)
+
+	//Channels that strip metadata strip it from WebPs too.
+	chanrec := NewChannel("exif", "Exif", "someone")
+	chanrec.StripEXIF = true
+	itemrec := NewItem("photo", "Photo", base64.StdEncoding.EncodeToString(data), "someone")
+	c.Assert(CheckItem(chanrec, itemrec), IsNil)
+	c.Assert(stripsMetadata(chanrec, itemrec), Equals, true)
+	c.Assert(ProcessItem(chanrec, itemrec), IsNil)
+	c.Assert(itemrec.Data, Equals, base64.StdEncoding.EncodeToString(stripped))
+}
+
+func (self *ExifSuite) TestStripPNG(c *C) {
+	var plain bytes.Buffer
+	c.Assert(png.Encode(&plain, testImage(10, 10)), IsNil)
+	//The IHDR chunk is 25 bytes, after the 8-byte signature.
+	data := append([]byte{}, plain.Bytes()[:33]...)
+	data = append(data, pngChunk("eXIf", []byte("MM\x00*secret"))...)
+	data = append(data, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))...)
+	data = append(data, pngChunk("tEXt", []byte("Comment\x00keep me"))...)
+	data = append(data, plain.Bytes()[33:]...)
+
+	stripped, err := StripMetadata(data, 0)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(stripped, []byte("secret")), Equals, false)
+	c.Assert(bytes.Contains(stripped, []byte("xmpmeta")), Equals, false)
+	c.Assert(bytes.Contains(stripped, []byte("keep me")), Equals, true)
+	_, err = png.Decode(bytes.NewReader(stripped))
+	c.Assert(err, IsNil)
+}
+
+func (self *ExifSuite) TestProcessItem(c *C) {
+	raw := exifJPEG(c)
+	chanrec := NewChannel("exif", "Exif", "someone")
+	itemrec := NewItem("photo", "Photo", base64.StdEncoding.EncodeToString(raw), "someone")
+	c.Assert(ProcessItem(chanrec, itemrec), IsNil)
+	c.Assert(itemrec.Metadata.Location, NotNil)
+	c.Assert(itemrec.Data, Equals, base64.StdEncoding.EncodeToString(raw))
+	c.Assert(itemrec.SourceHash, Equals, "")
+
+	chanrec.StripEXIF = true
+	itemrec = NewItem("photo", "Photo", base64.StdEncoding.EncodeToString(raw), "someone")
+	c.Assert(ProcessItem(chanrec, itemrec), IsNil)
+	c.Assert(itemrec.Metadata.Location, IsNil)
+	c.Assert(itemrec.Metadata.CameraMake, Equals, "TestCam")
+	data, err := base64.StdEncoding.DecodeString(itemrec.Data)
+	c.Assert(err, IsNil)
+	c.Assert(ExtractMetadata(data).Location, IsNil)
+	_, _, err = image.Decode(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(itemrec.SourceHash, Equals, HashData(raw))
+	c.Assert(itemrec.Size, Equals, int64(len(data)))
+
+	//The size limit applies to what is left after stripping.
+	c.Assert(len(data) < len(raw), Equals, true)
+	chanrec.MaxItemBytes = int64(len(data))
+	itemrec = NewItem("photo", "Photo", base64.StdEncoding.EncodeToString(raw), "someone")
+	c.Assert(CheckItem(chanrec, itemrec), IsNil)
+	c.Assert(ProcessItem(chanrec, itemrec), IsNil)
+	c.Assert(itemrec.Size, Equals, int64(len(data)))
+	chanrec.MaxItemBytes--
+	itemrec = NewItem("photo", "Photo", base64.StdEncoding.EncodeToString(raw), "someone")
+	c.Assert(CheckItem(chanrec, itemrec), IsNil)
+	err = ProcessItem(chanrec, itemrec)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*UploadError).Code, Equals, CodeItemTooLarge)
+	chanrec.MaxItemBytes = 0
+
+	itemrec = NewItem("notes", "Notes", base64.StdEncoding.EncodeToString([]byte("hello")), "someone")
+	c.Assert(ProcessItem(chanrec, itemrec), IsNil)
+	c.Assert(itemrec.Metadata, IsNil)
+}
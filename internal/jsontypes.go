@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -10,14 +11,111 @@ type UserJSONRecord struct {
 }
 
 type ItemJSONRecord struct {
-	Slug         string    `json:"slug"`
-	Title        string    `json:"title"`
-	DateUploaded time.Time `json:"date_uploaded"`
-	Uploader     string    `json:"uploader"`
+	Slug         string                  `json:"slug"`
+	Title        string                  `json:"title"`
+	DateUploaded time.Time               `json:"date_uploaded"`
+	Uploader     string                  `json:"uploader"`
+	ContentType  string                  `json:"content_type,omitempty"`
+	Size         int64                   `json:"size,omitempty"`
+	Hash         string                  `json:"hash,omitempty"`
+	SourceHash   string                  `json:"source_hash,omitempty"`
+	Metadata     *ItemMetadataJSONRecord `json:"metadata,omitempty"`
+}
+
+type LocationJSONRecord struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type ItemMetadataJSONRecord struct {
+	Width       int                 `json:"width"`
+	Height      int                 `json:"height"`
+	CaptureTime *time.Time          `json:"capture_time,omitempty"`
+	CameraMake  string              `json:"camera_make,omitempty"`
+	CameraModel string              `json:"camera_model,omitempty"`
+	Orientation int                 `json:"orientation,omitempty"`
+	Location    *LocationJSONRecord `json:"location,omitempty"`
 }
 
 type ChannelJSONRecord struct {
-	Slug  string            `json:"slug"`
-	Title string            `json:"title"`
-	Items []*ItemJSONRecord `json:"items"`
+	Slug         string            `json:"slug"`
+	Title        string            `json:"title"`
+	Items        []*ItemJSONRecord `json:"items"`
+	StripEXIF    bool              `json:"strip_exif"`
+	AllowedTypes []string          `json:"allowed_types"`
+	MaxItemBytes int64             `json:"max_item_bytes"`
+	Visibility   string            `json:"visibility"`
+	Org          string            `json:"org,omitempty"`
+}
+
+type MemberJSONRecord struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type OrgJSONRecord struct {
+	Name        string              `json:"name"`
+	Title       string              `json:"title"`
+	Members     []*MemberJSONRecord `json:"members"`
+	DateCreated time.Time           `json:"date_created"`
+}
+
+type APIKeyJSONRecord struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Scopes      []string   `json:"scopes"`
+	DateCreated time.Time  `json:"date_created"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	Key         string     `json:"key,omitempty"`
+}
+
+type SessionJSONRecord struct {
+	ID          string    `json:"id"`
+	DateCreated time.Time `json:"date_created"`
+	LastSeen    time.Time `json:"last_seen"`
+	Expires     time.Time `json:"expires"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	Current     bool      `json:"current"`
+	Token       string    `json:"token,omitempty"`
+}
+
+type TOTPJSONRecord struct {
+	Enabled           bool     `json:"enabled"`
+	RecoveryCodesLeft int      `json:"recovery_codes_left"`
+	Secret            string   `json:"secret,omitempty"`
+	URI               string   `json:"uri,omitempty"`
+	RecoveryCodes     []string `json:"recovery_codes,omitempty"`
+}
+
+type WebhookJSONRecord struct {
+	ID          string    `json:"id"`
+	Channel     string    `json:"channel"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Creator     string    `json:"creator"`
+	DateCreated time.Time `json:"date_created"`
+	Secret      string    `json:"secret,omitempty"`
+}
+
+type DeliveryJSONRecord struct {
+	ID            string          `json:"id"`
+	Webhook       string          `json:"webhook"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttempt   *time.Time      `json:"next_attempt,omitempty"`
+	LastStatus    int             `json:"last_status,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	DateCreated   time.Time       `json:"date_created"`
+	DateDelivered *time.Time      `json:"date_delivered,omitempty"`
+}
+
+type LinkJSONRecord struct {
+	URL       string    `json:"url"`
+	Expires   time.Time `json:"expires"`
+	SingleUse bool      `json:"single_use"`
+	IP        string    `json:"ip,omitempty"`
 }
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A download link is the item's data URL plus query parameters signed
+//with a key derived from the auth secret, so checking one needs no
+//database lookup.  Single-use links are the exception: using one
+//records its nonce, and a second use finds it already recorded.
+
+const (
+	usedLinksCollection = "used_links"
+
+	defaultLinkLifetime = time.Hour
+	maxLinkLifetime     = 7 * 24 * time.Hour
+)
+
+//Error codes sent when a download link is refused.
+const (
+	CodeLinkInvalid    = "link_invalid"
+	CodeLinkExpired    = "link_expired"
+	CodeLinkUsed       = "link_used"
+	CodeLinkIPMismatch = "link_ip_mismatch"
+)
+
+var (
+	ErrLinkInvalid    = errors.New("download link signature is invalid")
+	ErrLinkExpired    = errors.New("download link has expired")
+	ErrLinkUsed       = errors.New("download link has already been used")
+	ErrLinkIPMismatch = errors.New("download link is for a different address")
+)
+
+//DownloadLink grants access to one item's data until Expires.  Nonce is
+//set for single-use links and IP for links bound to one client address.
+type DownloadLink struct {
+	Channel string
+	Item    string
+	Expires time.Time
+	Nonce   string
+	IP      string
+}
+
+//linkKey turns the auth secret into the key links are signed with, so
+//that a link signature can never double as anything else.
+func linkKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("download links"))
+	return mac.Sum(nil)
+}
+
+func NewDownloadLink(chanSlug, itemSlug string, lifetime time.Duration, singleUse bool, ip string) (*DownloadLink, error) {
+	link := &DownloadLink{
+		Channel: chanSlug,
+		Item:    itemSlug,
+		Expires: time.Now().Add(lifetime).Truncate(time.Second),
+		IP:      ip,
+	}
+	if singleUse {
+		nonce := make([]byte, 16)
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		link.Nonce = hex.EncodeToString(nonce)
+	}
+	return link, nil
+}
+
+func (self *DownloadLink) signature(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{
+		self.Channel,
+		self.Item,
+		strconv.FormatInt(self.Expires.Unix(), 10),
+		self.Nonce,
+		self.IP,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Query returns the signed query parameters for the link.
+func (self *DownloadLink) Query(key []byte) url.Values {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(self.Expires.Unix(), 10))
+	if self.Nonce != "" {
+		query.Set("nonce", self.Nonce)
+	}
+	if self.IP != "" {
+		query.Set("ip", self.IP)
+	}
+	query.Set("sig", self.signature(key))
+	return query
+}
+
+func (self *DownloadLink) Path() string {
+	return ChannelPath(self.Channel) + "/item/" + url.PathEscape(self.Item) + "/data"
+}
+
+//ParseDownloadLink checks the signed parameters of a request for an
+//item's data.  It does not check single use; see useLink.
+func ParseDownloadLink(chanSlug, itemSlug string, query url.Values, key []byte, now time.Time) (*DownloadLink, error) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, ErrLinkInvalid
+	}
+	link := &DownloadLink{
+		Channel: chanSlug,
+		Item:    itemSlug,
+		Expires: time.Unix(expires, 0),
+		Nonce:   query.Get("nonce"),
+		IP:      query.Get("ip"),
+	}
+	if !hmac.Equal([]byte(link.signature(key)), []byte(query.Get("sig"))) {
+		return nil, ErrLinkInvalid
+	}
+	if !now.Before(link.Expires) {
+		return nil, ErrLinkExpired
+	}
+	return link, nil
+}
+
+type usedLinkDBRecord struct {
+	Nonce   string    "_id"
+	Expires time.Time "expires"
+}
+
+//useLink records the use of a single-use link, failing with ErrLinkUsed
+//if it was used before.  Records go away by themselves once the link
+//has expired.
+func useLink(db *mgo.Database, link *DownloadLink) error {
+	if link.Nonce == "" {
+		return nil
+	}
+	used := db.C(usedLinksCollection)
+	err := used.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		return err
+	}
+	err = used.Insert(&usedLinkDBRecord{link.Nonce, link.Expires})
+	if mgo.IsDup(err) {
+		return ErrLinkUsed
+	}
+	return err
+}
+
+//clientIP is the address the request came from.  Behind a proxy this is
+//the proxy's address.
+func clientIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+//checkDownloadLink lets a request for an item's data through if it
+//carries a valid link, failing it if the link is bad.  It reports
+//whether there was a link at all.
+func (self *Config) checkDownloadLink(c *gin.Context, chanSlug, itemSlug string) bool {
+	query := c.Request.URL.Query()
+	if query.Get("sig") == "" {
+		return false
+	}
+	link, err := ParseDownloadLink(chanSlug, itemSlug, query, linkKey(self.opts.AuthSecret), time.Now())
+	if err == ErrLinkExpired {
+		Fail(http.StatusForbidden, CodeLinkExpired, err.Error())
+	} else if err != nil {
+		Fail(http.StatusForbidden, CodeLinkInvalid, err.Error())
+	}
+	if link.IP != "" && !net.ParseIP(link.IP).Equal(net.ParseIP(clientIP(c))) {
+		Fail(http.StatusForbidden, CodeLinkIPMismatch, ErrLinkIPMismatch.Error())
+	}
+	err = useLink(requestDB(c), link)
+	if err == ErrLinkUsed {
+		Fail(http.StatusForbidden, CodeLinkUsed, err.Error())
+	} else if err != nil {
+		InternalError("Could not record the use of a download link")
+	}
+	return true
+}
+
+//CreateDownloadLink mints a link to an item's data; it takes a
+//maintainer, as the link works for anyone.  Optional form
+//fields: expires_in (seconds, default an hour, at most a week),
+//single_use, and ip to bind the link to one client address.
+func (self *Config) CreateDownloadLink(c *gin.Context) {
+	username := forceAuth(c)
+	chanSlug := channelSlug(c)
+	itemSlug := c.Params.ByName("itemSlug")
+	chanRec := fetchChannelAs(c, chanSlug, username, RoleMaintainer)
+	if chanRec.FindItem(itemSlug) == nil {
+		NotFound("Channel " + chanSlug + " has no item " + itemSlug)
+	}
+
+	lifetime := defaultLinkLifetime
+	if value, ok := formValue(c, "expires_in"); ok {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxLinkLifetime {
+			BadRequest("expires_in must be a number of seconds, at most " + strconv.Itoa(int(maxLinkLifetime/time.Second)))
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	singleUse := false
+	if value, ok := formValue(c, "single_use"); ok {
+		singleUse = boolParam("single_use", value)
+	}
+	ip := ""
+	if value, ok := formValue(c, "ip"); ok && value != "" {
+		parsed := net.ParseIP(value)
+		if parsed == nil {
+			BadRequest("ip must be an IP address")
+		}
+		ip = parsed.String()
+	}
+
+	link, err := NewDownloadLink(chanSlug, itemSlug, lifetime, singleUse, ip)
+	if err != nil {
+		InternalError("Could not make a download link")
+	}
+	c.JSON(http.StatusCreated, &LinkJSONRecord{
+		URL:       link.Path() + "?" + link.Query(linkKey(self.opts.AuthSecret)).Encode(),
+		Expires:   link.Expires,
+		SingleUse: singleUse,
+		IP:        ip,
+	})
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type LinkSuite struct{}
+
+var _ = Suite(&LinkSuite{})
+
+func (self *LinkSuite) TestRoundTrip(c *C) {
+	key := linkKey("secret")
+	link, err := NewDownloadLink("photos", "beach", time.Hour, true, "192.0.2.1")
+	c.Assert(err, IsNil)
+	c.Assert(link.Nonce, HasLen, 32)
+	query := link.Query(key)
+
+	parsed, err := ParseDownloadLink("photos", "beach", query, key, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(parsed.Expires.Equal(link.Expires), Equals, true)
+	c.Assert(parsed.Nonce, Equals, link.Nonce)
+	c.Assert(parsed.IP, Equals, "192.0.2.1")
+
+	_, err = ParseDownloadLink("photos", "beach", query, key, link.Expires)
+	c.Assert(err, Equals, ErrLinkExpired)
+	_, err = ParseDownloadLink("photos", "other", query, key, time.Now())
+	c.Assert(err, Equals, ErrLinkInvalid)
+	_, err = ParseDownloadLink("photos", "beach", query, linkKey("other secret"), time.Now())
+	c.Assert(err, Equals, ErrLinkInvalid)
+}
+
+func (self *LinkSuite) TestTampering(c *C) {
+	key := linkKey("secret")
+	link, err := NewDownloadLink("photos", "beach", time.Hour, false, "")
+	c.Assert(err, IsNil)
+	c.Assert(link.Nonce, Equals, "")
+
+	for param, value := range map[string]string{
+		"expires": "99999999999",
+		"ip":      "192.0.2.1",
+		"nonce":   "0123",
+		"sig":     "00",
+	} {
+		query := link.Query(key)
+		query.Set(param, value)
+		_, err = ParseDownloadLink("photos", "beach", query, key, time.Now())
+		c.Assert(err, Equals, ErrLinkInvalid, Commentf("%s", param))
+	}
+	query := link.Query(key)
+	query.Del("expires")
+	_, err = ParseDownloadLink("photos", "beach", query, key, time.Now())
+	c.Assert(err, Equals, ErrLinkInvalid)
+}
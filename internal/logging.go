@@ -0,0 +1,55 @@
+package api
+
+import (
+	"errors"
+	"log"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var (
+	logLevel = levelInfo
+)
+
+func SetLogLevel(level string) error {
+	switch level {
+	case "debug":
+		logLevel = levelDebug
+	case "info":
+		logLevel = levelInfo
+	case "warn":
+		logLevel = levelWarn
+	case "error":
+		logLevel = levelError
+	default:
+		return errors.New("Unknown log level " + level)
+	}
+	return nil
+}
+
+func logf(level int, prefix, format string, args ...interface{}) {
+	if level >= logLevel {
+		log.Printf(prefix+format, args...)
+	}
+}
+
+func debugf(format string, args ...interface{}) {
+	logf(levelDebug, "DEBUG: ", format, args...)
+}
+
+func infof(format string, args ...interface{}) {
+	logf(levelInfo, "INFO: ", format, args...)
+}
+
+func warnf(format string, args ...interface{}) {
+	logf(levelWarn, "WARN: ", format, args...)
+}
+
+func errorf(format string, args ...interface{}) {
+	logf(levelError, "ERROR: ", format, args...)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"net/http"
+)
+
+//GetChannelMembers lists everyone with a role in a channel, owner
+//first.  Only members can see it.  An organization's members aren't
+//listed; see GetOrganization.
+func (self *Config) GetChannelMembers(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	chanRec := fetchChannelAs(c, slug, username, RoleViewer)
+	members := make([]*MemberJSONRecord, 0)
+	if chanRec.Owner != "" {
+		members = append(members, &MemberJSONRecord{Username: chanRec.Owner, Role: RoleOwner})
+	}
+	for _, member := range chanRec.Members {
+		members = append(members, member.ToJSON())
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+//SetChannelMember adds a user to a channel with the role given in the
+//form, or changes their role if they are a member already.
+func (self *Config) SetChannelMember(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	memberName := c.Params.ByName("username")
+	role, err := ParseRole(c.Request.FormValue("role"))
+	if err != nil {
+		BadRequest(err.Error())
+	}
+	chanRec := fetchChannelAs(c, slug, username, RoleMaintainer)
+	checkCanManage(chanRec, username, memberName, role)
+
+	db := requestDB(c)
+	_, err = FindUser(db, memberName)
+	if err == mgo.ErrNotFound {
+		NotFound("No such user " + memberName)
+	} else if err != nil {
+		InternalError("Could not fetch user info from database")
+	}
+	added, err := SetMember(db, slug, memberName, role)
+	if err != nil {
+		InternalError("Cannot update channel info in database")
+	}
+	status := http.StatusOK
+	if added {
+		status = http.StatusCreated
+	}
+	c.JSON(status, &MemberJSONRecord{Username: memberName, Role: role})
+}
+
+//RemoveChannelMember takes a user's role in a channel away.  Members
+//can always remove themselves.
+func (self *Config) RemoveChannelMember(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	memberName := c.Params.ByName("username")
+	var chanRec *ChannelDBRecord
+	if memberName == username {
+		chanRec = fetchChannelAs(c, slug, username, RoleViewer)
+	} else {
+		chanRec = fetchChannelAs(c, slug, username, RoleMaintainer)
+	}
+	if chanRec.RoleOf(memberName) == "" {
+		NotFound(memberName + " is not a member of channel " + slug)
+	}
+	if memberName != username {
+		checkCanManage(chanRec, username, memberName, "")
+	} else if memberName == chanRec.Owner {
+		BadRequest("The channel's creator cannot leave it")
+	}
+
+	err := RemoveMember(requestDB(c), slug, memberName)
+	if err == mgo.ErrNotFound {
+		NotFound(memberName + " is not a member of channel " + slug)
+	} else if err != nil {
+		InternalError("Cannot update channel info in database")
+	}
+	c.String(http.StatusNoContent, "")
+}
+
+//checkCanManage fails unless username may give memberName the role to,
+//or remove them if to is "".
+func checkCanManage(chanRec *ChannelDBRecord, username, memberName, to string) {
+	if memberName == chanRec.Owner {
+		BadRequest("The channel's creator is always an owner")
+	}
+	if !canManage(chanRec.RoleOf(username), chanRec.RoleOf(memberName), to) {
+		Forbidden("Only owners can manage maintainers and owners")
+	}
+}
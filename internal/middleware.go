@@ -2,8 +2,6 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
-	"labix.org/v2/mgo"
-	"log"
 	"net/http"
 	"reflect"
 	"strings"
@@ -11,7 +9,10 @@ import (
 
 //WARNING!  The following "authentication" scheme is TERRIBLE!
 //DO NOT COPY/PASTE THIS CODE!  YOU WILL REGRET IT!
-func MiddlewareAuth(usercoll *mgo.Collection) gin.HandlerFunc {
+//
+//Session tokens from POST /login and API keys are the exception: they are
+//random and stored hashed, and sessions can be revoked.
+func MiddlewareAuth(secret string, clientCertAuth bool, sessions *SessionCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
 		if authHeader != "" {
@@ -22,6 +23,18 @@ func MiddlewareAuth(usercoll *mgo.Collection) gin.HandlerFunc {
 			if authParts[0] != "Bearer" {
 				BadRequest("Malformed authorization: does not start with 'Bearer'")
 			}
+			if strings.HasPrefix(authParts[1], SessionTokenPrefix) {
+				sessrec := authenticateSession(c, authParts[1], sessions)
+				c.Set("USERNAME", sessrec.Username)
+				c.Set("SESSION", sessrec.Id.Hex())
+				c.Next()
+				return
+			}
+			if strings.HasPrefix(authParts[1], APIKeyPrefix) {
+				c.Set("USERNAME", authenticateKey(c, authParts[1]))
+				c.Next()
+				return
+			}
 			//Hi, I'm an idiot who copied this code off the Internet.
 			//I'm too dumb to have read the very clear warning above.
 			//Please fire my dumb ass!
@@ -29,36 +42,101 @@ func MiddlewareAuth(usercoll *mgo.Collection) gin.HandlerFunc {
 			if len(tokenParts) != 2 {
 				BadRequest("Malformed authorization: wrong number of parts")
 			}
-			if tokenParts[0] != "SUP3R_S33CR37" {
+			if tokenParts[0] != secret {
 				BadRequest("Malformed authorization: wrong secret")
 			}
 			username := tokenParts[1]
-			log.Printf("Good token for user %s", username)
-			var userRec UserDBRecord
-			err := usercoll.FindId(username).One(&userRec)
+			debugf("Good token for user %s", username)
+			userrec, err := FindUser(requestDB(c), username)
 			if err != nil {
 				Unauthorized("No such user " + username)
 			}
+			refuseSingleFactor(c, userrec)
 			c.Set("USERNAME", username)
 			c.Next()
+		} else if clientCertAuth {
+			username := clientCertUsername(c.Request)
+			if username == "" {
+				return
+			}
+			userrec, err := FindUser(requestDB(c), username)
+			if err != nil {
+				Unauthorized("No such user " + username)
+			}
+			refuseSingleFactor(c, userrec)
+			debugf("Good client certificate for user %s", username)
+			c.Set("USERNAME", username)
+			c.Next()
+		}
+	}
+}
+
+//clientCertUsername returns the common name of the request's verified
+//client certificate, or "" if there isn't one.
+func clientCertUsername(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	chain := req.TLS.VerifiedChains[0]
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[0].Subject.CommonName
+}
+
+//MiddlewareCORS answers CORS preflights and tags responses for the
+//listed origins.  "*" allows any origin.
+func MiddlewareCORS(origins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+	return func(c *gin.Context) {
+		origin := c.Request.Header.Get("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			return
+		}
+		header := c.Writer.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+		if c.Request.Method == "OPTIONS" && c.Request.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			header.Set("Access-Control-Max-Age", "600")
+			c.String(http.StatusNoContent, "")
 		}
 	}
 }
 
+//MiddlewareBodyLimit rejects request bodies larger than maxBytes.
+func MiddlewareBodyLimit(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			Fail(http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request body too large")
+		}
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		}
+		c.Next()
+	}
+}
+
 type AjaxErrorReport struct {
 	Error string `json:"error"`
 	Info  string `json:"info"`
+	Code  string `json:"code,omitempty"`
 }
 
 func makeAjaxErrorReporter() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if r := recover(); r != nil {
-			var errorText string
+			var errorText, code string
 			status := http.StatusInternalServerError
 			ajaxErr, ok := r.(*ErrorDescription)
 			if ok {
 				errorText = ajaxErr.Error
 				status = ajaxErr.Status
+				code = ajaxErr.Code
 			} else {
 				//It's not a *ErrorDescription.  Maybe it's a vanilla error?
 				err, ok := r.(error)
@@ -71,7 +149,7 @@ func makeAjaxErrorReporter() gin.HandlerFunc {
 			}
 			var moreInfo string
 			moreInfo = errorText + "\n" + GetStack()
-			c.JSON(status, AjaxErrorReport{errorText, moreInfo})
+			c.JSON(status, AjaxErrorReport{errorText, moreInfo, code})
 		}
 	}
 }
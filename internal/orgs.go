@@ -0,0 +1,291 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//An organization owns channels on behalf of its members, so that they
+//outlive any one of them.  An organization's channels have slugs like
+//"acme/holiday" and live under /org/acme/channel/holiday.  Org admins
+//are owners of all of them and org members contributors; the channels'
+//own members come on top.
+
+const orgsCollection = "orgs"
+
+const (
+	OrgRoleMember = "member"
+	OrgRoleAdmin  = "admin"
+)
+
+func ParseOrgRole(value string) (string, error) {
+	if value != OrgRoleMember && value != OrgRoleAdmin {
+		return "", errors.New("role must be member or admin")
+	}
+	return value, nil
+}
+
+//channelRoleInOrg is the role org members have in the org's channels.
+var channelRoleInOrg = map[string]string{
+	OrgRoleMember: RoleContributor,
+	OrgRoleAdmin:  RoleOwner,
+}
+
+//SplitChannelSlug splits "org/name" into its organization and name; a
+//personal channel's organization is "".
+func SplitChannelSlug(slug string) (string, string) {
+	i := strings.Index(slug, "/")
+	if i < 0 {
+		return "", slug
+	}
+	return slug[:i], slug[i+1:]
+}
+
+//ChannelPath is where a channel's routes are.
+func ChannelPath(slug string) string {
+	org, name := SplitChannelSlug(slug)
+	if org == "" {
+		return "/channel/" + url.PathEscape(name)
+	}
+	return "/org/" + url.PathEscape(org) + "/channel/" + url.PathEscape(name)
+}
+
+//channelFilename is a channel's slug made fit for a file name.
+func channelFilename(slug string) string {
+	return strings.Replace(slug, "/", "-", -1)
+}
+
+//validName is true of names that can be a path segment, or a file name
+//in an archive, on their own: organization names, the parts of channel
+//slugs and item slugs.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\?#%")
+}
+
+func InsertOrg(db *mgo.Database, name, title, admin string) (*OrgDBRecord, error) {
+	if !validName(name) {
+		return nil, errors.New("organization name cannot be empty, . or .., or contain / \\ ? # or %")
+	}
+	orgrec := &OrgDBRecord{
+		Name:        name,
+		Title:       title,
+		Members:     []OrgMemberDBRecord{{admin, OrgRoleAdmin}},
+		DateCreated: time.Now(),
+	}
+	err := db.C(orgsCollection).Insert(orgrec)
+	return orgrec, err
+}
+
+func FindOrg(db *mgo.Database, name string) (*OrgDBRecord, error) {
+	var orgrec OrgDBRecord
+	err := db.C(orgsCollection).FindId(name).One(&orgrec)
+	if err != nil {
+		return nil, err
+	}
+	return &orgrec, nil
+}
+
+func ListOrgs(db *mgo.Database) ([]OrgDBRecord, error) {
+	orgs := make([]OrgDBRecord, 0)
+	err := db.C(orgsCollection).Find(nil).Sort("_id").All(&orgs)
+	return orgs, err
+}
+
+//SetOrgMember gives username a role in an organization, adding them if
+//need be.  It reports whether they were added.
+func SetOrgMember(db *mgo.Database, name, username, role string) (bool, error) {
+	orgs := db.C(orgsCollection)
+	err := orgs.Update(bson.M{"_id": name, "members.username": username},
+		bson.M{"$set": bson.M{"members.$.role": role}})
+	if err != mgo.ErrNotFound {
+		return false, err
+	}
+	err = orgs.Update(bson.M{"_id": name, "members.username": bson.M{"$ne": username}},
+		bson.M{"$push": bson.M{"members": &OrgMemberDBRecord{username, role}}})
+	return err == nil, err
+}
+
+func RemoveOrgMember(db *mgo.Database, name, username string) error {
+	return db.C(orgsCollection).Update(bson.M{"_id": name, "members.username": username},
+		bson.M{"$pull": bson.M{"members": bson.M{"username": username}}})
+}
+
+//loadOrgs attaches their organizations to channels that have one, so
+//that RoleOf knows about org members.  A channel whose organization is
+//gone just gets no org roles.
+func loadOrgs(db *mgo.Database, channels []ChannelDBRecord) error {
+	orgs := make(map[string]*OrgDBRecord)
+	for i := range channels {
+		name := channels[i].Org
+		if name == "" {
+			continue
+		}
+		orgrec, ok := orgs[name]
+		if !ok {
+			var err error
+			orgrec, err = FindOrg(db, name)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+			orgs[name] = orgrec
+		}
+		channels[i].org = orgrec
+	}
+	return nil
+}
+
+//channelSlug is the full slug of the channel a request is about,
+//including the organization for routes under /org/:org.
+func channelSlug(c *gin.Context) string {
+	return orgChannelSlug(c, c.Params.ByName("slug"))
+}
+
+func orgChannelSlug(c *gin.Context, name string) string {
+	org := c.Params.ByName("org")
+	if org == "" {
+		return name
+	}
+	return org + "/" + name
+}
+
+func fetchOrg(c *gin.Context, name string) *OrgDBRecord {
+	orgrec, err := FindOrg(requestDB(c), name)
+	if err == mgo.ErrNotFound {
+		NotFound("No such organization " + name)
+	} else if err != nil {
+		InternalError("Could not fetch organization info from database")
+	}
+	return orgrec
+}
+
+//fetchOrgAs is fetchOrg for routes that need username to have at least
+//the given org role.  Organizations are as invisible to outsiders as
+//private channels.
+func fetchOrgAs(c *gin.Context, name, username, role string) *OrgDBRecord {
+	orgrec := fetchOrg(c, name)
+	switch orgrec.RoleOf(username) {
+	case OrgRoleAdmin:
+	case OrgRoleMember:
+		if role == OrgRoleAdmin {
+			Forbidden("You must be an admin of organization " + name)
+		}
+	default:
+		NotFound("No such organization " + name)
+	}
+	return orgrec
+}
+
+//newChannelFor makes the record for a channel username is creating.  An
+//organization's channels can only be created by its admins, and have no
+//personal owner.
+func newChannelFor(c *gin.Context, slug, title, username string) *ChannelDBRecord {
+	org, name := SplitChannelSlug(slug)
+	if !validName(name) || (org != "" && !validName(org)) {
+		BadRequest("slug must be a name or org/name, without \\ ? # or %")
+	}
+	if org == "" {
+		return NewChannel(slug, title, username)
+	}
+	orgrec := fetchOrgAs(c, org, username, OrgRoleAdmin)
+	chanrec := NewChannel(slug, title, "")
+	chanrec.Org = org
+	chanrec.org = orgrec
+	return chanrec
+}
+
+//CreateOrganization makes a new organization with its creator as admin.
+func (self *Config) CreateOrganization(c *gin.Context) {
+	username := forceAuth(c)
+	name := c.Request.FormValue("name")
+	title := c.Request.FormValue("title")
+	if title == "" {
+		title = name
+	}
+	orgrec, err := InsertOrg(requestDB(c), name, title, username)
+	if mgo.IsDup(err) {
+		BadRequest("Organization " + name + " already exists")
+	} else if err != nil {
+		BadRequest(err.Error())
+	}
+	c.JSON(http.StatusCreated, orgrec.ToJSON())
+}
+
+//GetOrganization shows an organization and its members, to members.
+func (self *Config) GetOrganization(c *gin.Context) {
+	username := forceAuth(c)
+	orgrec := fetchOrgAs(c, c.Params.ByName("org"), username, OrgRoleMember)
+	c.JSON(http.StatusOK, orgrec.ToJSON())
+}
+
+//SetOrganizationMember adds a user to an organization with the role in
+//the form, or changes their role.  Only admins can, and an organization
+//always keeps at least one admin.
+func (self *Config) SetOrganizationMember(c *gin.Context) {
+	username := forceAuth(c)
+	name := c.Params.ByName("org")
+	memberName := c.Params.ByName("username")
+	role, err := ParseOrgRole(c.Request.FormValue("role"))
+	if err != nil {
+		BadRequest(err.Error())
+	}
+	orgrec := fetchOrgAs(c, name, username, OrgRoleAdmin)
+	if role != OrgRoleAdmin {
+		checkKeepsAdmin(orgrec, memberName)
+	}
+
+	db := requestDB(c)
+	_, err = FindUser(db, memberName)
+	if err == mgo.ErrNotFound {
+		NotFound("No such user " + memberName)
+	} else if err != nil {
+		InternalError("Could not fetch user info from database")
+	}
+	added, err := SetOrgMember(db, name, memberName, role)
+	if err != nil {
+		InternalError("Cannot update organization info in database")
+	}
+	status := http.StatusOK
+	if added {
+		status = http.StatusCreated
+	}
+	c.JSON(status, &MemberJSONRecord{Username: memberName, Role: role})
+}
+
+//RemoveOrganizationMember takes a user out of an organization.  Admins
+//can remove anyone, and members themselves.
+func (self *Config) RemoveOrganizationMember(c *gin.Context) {
+	username := forceAuth(c)
+	name := c.Params.ByName("org")
+	memberName := c.Params.ByName("username")
+	var orgrec *OrgDBRecord
+	if memberName == username {
+		orgrec = fetchOrgAs(c, name, username, OrgRoleMember)
+	} else {
+		orgrec = fetchOrgAs(c, name, username, OrgRoleAdmin)
+	}
+	if orgrec.RoleOf(memberName) == "" {
+		NotFound(memberName + " is not a member of organization " + name)
+	}
+	checkKeepsAdmin(orgrec, memberName)
+
+	err := RemoveOrgMember(requestDB(c), name, memberName)
+	if err == mgo.ErrNotFound {
+		NotFound(memberName + " is not a member of organization " + name)
+	} else if err != nil {
+		InternalError("Cannot update organization info in database")
+	}
+	c.String(http.StatusNoContent, "")
+}
+
+//checkKeepsAdmin fails if memberName is the organization's last admin.
+func checkKeepsAdmin(orgrec *OrgDBRecord, memberName string) {
+	if orgrec.lastAdmin(memberName) {
+		BadRequest("Organization " + orgrec.Name + " needs at least one admin")
+	}
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//A session is what POST /login hands out: a "tfs_" token standing for
+//the user until it is revoked, goes unused for the idle timeout, or
+//reaches its maximum age.  As with API keys only the token's hash is
+//stored.  Sessions are checked on every request, so each server keeps
+//the ones it has seen in a SessionCache and only asks MongoDB about
+//them again after sessionCacheTTL; a session revoked through another
+//server can therefore live on here for that long.
+
+const (
+	sessionsCollection = "sessions"
+
+	SessionTokenPrefix = "tfs_"
+
+	sessionCacheTTL   = 30 * time.Second
+	maxCachedSessions = 10000
+
+	//touchSessionEvery keeps a busy session from writing its last use on
+	//every request.
+	touchSessionEvery = time.Minute
+)
+
+//Error codes sent when a session token is refused.
+const (
+	CodeSessionInvalid = "session_invalid"
+	CodeSessionExpired = "session_expired"
+)
+
+//Active says whether a session can still be used at now.  An idle
+//timeout of 0 means sessions never go idle.
+func (self *SessionDBRecord) Active(now time.Time, idleTimeout time.Duration) bool {
+	if !now.Before(self.Expires) {
+		return false
+	}
+	return idleTimeout <= 0 || now.Sub(self.LastSeen) < idleTimeout
+}
+
+//InsertSession starts a session for username lasting at most maxAge.
+//The token is returned alongside the record, which only holds its hash.
+func InsertSession(db *mgo.Database, username, userAgent, ip string, maxAge time.Duration) (*SessionDBRecord, string, error) {
+	token, err := newToken(SessionTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	sessions := db.C(sessionsCollection)
+	err = sessions.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true})
+	if err == nil {
+		//Sessions past their maximum age go away by themselves.
+		err = sessions.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	sessrec := &SessionDBRecord{
+		Id:          bson.NewObjectId(),
+		Hash:        hashToken(token),
+		Username:    username,
+		DateCreated: now,
+		LastSeen:    now,
+		Expires:     now.Add(maxAge),
+		UserAgent:   userAgent,
+		IP:          ip,
+	}
+	err = sessions.Insert(sessrec)
+	if err != nil {
+		return nil, "", err
+	}
+	return sessrec, token, nil
+}
+
+func findSessionByHash(db *mgo.Database, hash string) (*SessionDBRecord, error) {
+	var sessrec SessionDBRecord
+	err := db.C(sessionsCollection).Find(bson.M{"hash": hash}).One(&sessrec)
+	if err != nil {
+		return nil, err
+	}
+	return &sessrec, nil
+}
+
+func ListSessions(db *mgo.Database, username string) ([]SessionDBRecord, error) {
+	sessions := make([]SessionDBRecord, 0)
+	err := db.C(sessionsCollection).Find(bson.M{"username": username}).Sort("-last_seen").All(&sessions)
+	return sessions, err
+}
+
+//RemoveSession revokes one of username's sessions, returning it.
+func RemoveSession(db *mgo.Database, username, id string) (*SessionDBRecord, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, mgo.ErrNotFound
+	}
+	var old SessionDBRecord
+	_, err := db.C(sessionsCollection).Find(bson.M{"_id": bson.ObjectIdHex(id), "username": username}).
+		Apply(mgo.Change{Remove: true}, &old)
+	if err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+//RemoveSessions revokes all of username's sessions.
+func RemoveSessions(db *mgo.Database, username string) error {
+	_, err := db.C(sessionsCollection).RemoveAll(bson.M{"username": username})
+	return err
+}
+
+type cachedSession struct {
+	session SessionDBRecord
+	fetched time.Time
+}
+
+//SessionCache remembers recently checked sessions, keyed by token hash.
+type SessionCache struct {
+	mutex       sync.Mutex
+	entries     map[string]*cachedSession
+	idleTimeout time.Duration
+}
+
+func NewSessionCache(idleTimeout time.Duration) *SessionCache {
+	return &SessionCache{
+		entries:     make(map[string]*cachedSession),
+		idleTimeout: idleTimeout,
+	}
+}
+
+//get returns a copy of the cached session, or nil if it isn't cached or
+//is due to be fetched again.
+func (self *SessionCache) get(hash string, now time.Time) *SessionDBRecord {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	entry, ok := self.entries[hash]
+	if !ok || now.Sub(entry.fetched) >= sessionCacheTTL {
+		return nil
+	}
+	sessrec := entry.session
+	return &sessrec
+}
+
+func (self *SessionCache) put(sessrec *SessionDBRecord, now time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.entries) >= maxCachedSessions {
+		for hash, entry := range self.entries {
+			if now.Sub(entry.fetched) >= sessionCacheTTL {
+				delete(self.entries, hash)
+			}
+		}
+		if len(self.entries) >= maxCachedSessions {
+			self.entries = make(map[string]*cachedSession)
+		}
+	}
+	self.entries[sessrec.Hash] = &cachedSession{*sessrec, now}
+}
+
+func (self *SessionCache) touch(hash string, lastSeen time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if entry, ok := self.entries[hash]; ok {
+		entry.session.LastSeen = lastSeen
+	}
+}
+
+func (self *SessionCache) forget(hash string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.entries, hash)
+}
+
+func (self *SessionCache) forgetUser(username string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for hash, entry := range self.entries {
+		if entry.session.Username == username {
+			delete(self.entries, hash)
+		}
+	}
+}
+
+//authenticateSession checks a session token and returns its session.
+//MongoDB is only asked when the cache doesn't know the session, or
+//thinks it has expired; another server may have seen it more recently.
+func authenticateSession(c *gin.Context, token string, cache *SessionCache) *SessionDBRecord {
+	hash := hashToken(token)
+	now := time.Now()
+	sessrec := cache.get(hash, now)
+	if sessrec == nil || !sessrec.Active(now, cache.idleTimeout) {
+		var err error
+		db := requestDB(c)
+		sessrec, err = findSessionByHash(db, hash)
+		if err == mgo.ErrNotFound {
+			cache.forget(hash)
+			Fail(http.StatusUnauthorized, CodeSessionInvalid, "Invalid or revoked session")
+		} else if err != nil {
+			InternalError("Could not fetch session from database")
+		}
+		userrec, err := FindUser(db, sessrec.Username)
+		if err != nil {
+			Unauthorized("No such user " + sessrec.Username)
+		}
+		//Like API keys, a session opened before a second factor was needed
+		//may never have been given one.
+		if userrec.TOTPSecret != "" && sessrec.DateCreated.Before(userrec.TOTPSince) {
+			cache.forget(hash)
+			Fail(http.StatusUnauthorized, CodeTOTPSessionRequired, "Session predates two-factor authentication; log in again")
+		}
+		cache.put(sessrec, now)
+	}
+	if !sessrec.Active(now, cache.idleTimeout) {
+		cache.forget(hash)
+		Fail(http.StatusUnauthorized, CodeSessionExpired, "Session has expired")
+	}
+	if now.Sub(sessrec.LastSeen) >= touchSessionEvery {
+		err := requestDB(c).C(sessionsCollection).UpdateId(sessrec.Id, bson.M{"$set": bson.M{"last_seen": now}})
+		if err != nil && err != mgo.ErrNotFound {
+			warnf("Could not record the use of session %s: %s", sessrec.Id.Hex(), err.Error())
+		}
+		cache.touch(hash, now)
+	}
+	return sessrec
+}
+
+//currentSession is the ID of the session the request came with, or "".
+func currentSession(c *gin.Context) string {
+	idI, err := c.Get("SESSION")
+	if err != nil {
+		return ""
+	}
+	id, _ := idI.(string)
+	return id
+}
+
+//Login starts a session for the user the request authenticated as,
+//returning its token.  This is the only time the token is shown.  Users
+//with two-factor authentication on must also send a "code".  A session
+//can't log in again, or it could outlive its own expiry.
+func (self *Config) Login(c *gin.Context) {
+	username := forceAuth(c)
+	if currentSession(c) != "" {
+		Forbidden("Log in with your credentials, not a session token")
+	}
+	userrec := fetchUser(c, username)
+	if userrec.TOTPSecret != "" {
+		forceSecondFactor(c, userrec)
+	}
+	sessrec, token, err := InsertSession(requestDB(c), username, c.Request.UserAgent(), clientIP(c), self.opts.SessionMaxAge)
+	if err != nil {
+		InternalError("Could not save session")
+	}
+	sessJSON := sessrec.ToJSON()
+	sessJSON.Token = token
+	c.JSON(http.StatusCreated, sessJSON)
+}
+
+//GetSessions lists the user's sessions that can still be used, most
+//recently used first.
+func (self *Config) GetSessions(c *gin.Context) {
+	username := forceAuth(c)
+	sessions, err := ListSessions(requestDB(c), username)
+	if err != nil {
+		InternalError("Could not fetch sessions from database")
+	}
+	now := time.Now()
+	current := currentSession(c)
+	sessionData := make([]*SessionJSONRecord, 0)
+	for i := range sessions {
+		if !sessions[i].Active(now, self.opts.SessionIdleTimeout) {
+			continue
+		}
+		sessJSON := sessions[i].ToJSON()
+		sessJSON.Current = sessJSON.ID == current
+		sessionData = append(sessionData, sessJSON)
+	}
+	c.JSON(http.StatusOK, sessionData)
+}
+
+func (self *Config) DeleteSession(c *gin.Context) {
+	username := forceAuth(c)
+	id := c.Params.ByName("sessionId")
+	sessrec, err := RemoveSession(requestDB(c), username, id)
+	if err == mgo.ErrNotFound {
+		NotFound("No such session " + id)
+	} else if err != nil {
+		InternalError("Could not revoke session")
+	}
+	self.sessions.forget(sessrec.Hash)
+	c.String(http.StatusNoContent, "")
+}
+
+//DeleteSessions revokes every session of the user, the current one
+//included.
+func (self *Config) DeleteSessions(c *gin.Context) {
+	username := forceAuth(c)
+	err := RemoveSessions(requestDB(c), username)
+	if err != nil {
+		InternalError("Could not revoke sessions")
+	}
+	self.sessions.forgetUser(username)
+	c.String(http.StatusNoContent, "")
+}
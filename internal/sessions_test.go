@@ -0,0 +1,48 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+type SessionSuite struct{}
+
+var _ = Suite(&SessionSuite{})
+
+func (self *SessionSuite) TestActive(c *C) {
+	now := time.Now()
+	sessrec := &SessionDBRecord{LastSeen: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)}
+	c.Assert(sessrec.Active(now, 3*time.Hour), Equals, true)
+	c.Assert(sessrec.Active(now, time.Hour), Equals, false)
+	c.Assert(sessrec.Active(now, 0), Equals, true)
+	c.Assert(sessrec.Active(now.Add(time.Hour), 0), Equals, false)
+}
+
+func (self *SessionSuite) TestCache(c *C) {
+	cache := NewSessionCache(time.Hour)
+	now := time.Now()
+	first := &SessionDBRecord{Id: bson.NewObjectId(), Hash: "first", Username: "alice", LastSeen: now}
+	second := &SessionDBRecord{Id: bson.NewObjectId(), Hash: "second", Username: "bob", LastSeen: now}
+	cache.put(first, now)
+	cache.put(second, now)
+
+	cached := cache.get("first", now.Add(time.Second))
+	c.Assert(cached, NotNil)
+	c.Assert(cached.Username, Equals, "alice")
+	c.Assert(cache.get("first", now.Add(sessionCacheTTL)), IsNil)
+	c.Assert(cache.get("third", now), IsNil)
+
+	later := now.Add(touchSessionEvery)
+	cache.touch("first", later)
+	c.Assert(cache.get("first", now).LastSeen, Equals, later)
+	//What get returns is a copy.
+	cached.Username = "mallory"
+	c.Assert(cache.get("first", now).Username, Equals, "alice")
+
+	cache.forgetUser("alice")
+	c.Assert(cache.get("first", now), IsNil)
+	c.Assert(cache.get("second", now), NotNil)
+	cache.forget("second")
+	c.Assert(cache.get("second", now), IsNil)
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	eventHistorySize  = 1000
+	eventBufferSize   = 64
+	heartbeatInterval = 15 * time.Second
+)
+
+func writeSSE(c *gin.Context, id int64, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		_, err = fmt.Fprintf(c.Writer, "id: %d\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", eventType, data)
+	if err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+//GetChannelEvents streams a channel's item events as Server-Sent Events.
+//A client that reconnects with Last-Event-ID gets the events it missed
+//first.  If some of those are no longer known (the server restarted, or
+//the client was away too long) a "resync" event tells it to re-fetch
+//the item list.
+//
+//The stream also ends when this client falls too far behind, or when a
+//write_timeout is set and reached; EventSource reconnects and resumes on
+//its own.
+func (self *Config) GetChannelEvents(c *gin.Context) {
+	slug := channelSlug(c)
+	_ = fetchReadableChannel(c, slug)
+
+	var lastID int64
+	if header := c.Request.Header.Get("Last-Event-ID"); header != "" {
+		var err error
+		lastID, err = strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			BadRequest("Last-Event-ID must be an integer")
+		}
+	}
+	sub, missed, complete := self.events.Subscribe(eventBufferSize, lastID, slug)
+	defer sub.Close()
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+	_, err := fmt.Fprint(c.Writer, "retry: 2000\n\n")
+	if err != nil {
+		return
+	}
+	if !complete {
+		err = writeSSE(c, 0, "resync", map[string]string{"channel": slug})
+	}
+	for _, event := range missed {
+		if err == nil {
+			err = writeSSE(c, event.ID, event.Type, event)
+		}
+	}
+	if err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	gone := c.Request.Context().Done()
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			err = writeSSE(c, event.ID, event.Type, event)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		case <-gone:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usersCollection    = "users"
+	channelsCollection = "channels"
+)
+
+//MiddlewareSession gives every request its own copy of session, so a
+//broken socket only fails the request that was using it and concurrent
+//requests don't queue up behind a single socket.  The copy is closed
+//when the request is done.
+func MiddlewareSession(session *mgo.Session, dbname string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reqSession := session.Copy()
+		defer reqSession.Close()
+		c.Set("DB", reqSession.DB(dbname))
+		c.Next()
+	}
+}
+
+func requestDB(c *gin.Context) *mgo.Database {
+	dbI, err := c.Get("DB")
+	if err != nil {
+		InternalError("No database session for this request")
+	}
+	db, ok := dbI.(*mgo.Database)
+	if !ok {
+		InternalError("DB is of incorrect type!")
+	}
+	return db
+}
+
+//The functions below are the store code shared by the HTTP handlers and
+//the admin commands in main.  They return mgo.ErrNotFound when the thing
+//asked about doesn't exist.
+
+func InsertUser(db *mgo.Database, username string) (*UserDBRecord, error) {
+	if username == "" {
+		return nil, errors.New("username cannot be empty")
+	}
+	userrec := &UserDBRecord{
+		Username:      username,
+		Subscriptions: make([]string, 0),
+	}
+	err := db.C(usersCollection).Insert(userrec)
+	return userrec, err
+}
+
+func FindUser(db *mgo.Database, username string) (*UserDBRecord, error) {
+	var userrec UserDBRecord
+	err := db.C(usersCollection).FindId(username).One(&userrec)
+	if err != nil {
+		return nil, err
+	}
+	return &userrec, nil
+}
+
+func ListUsers(db *mgo.Database) ([]UserDBRecord, error) {
+	users := make([]UserDBRecord, 0)
+	err := db.C(usersCollection).Find(nil).Sort("_id").All(&users)
+	return users, err
+}
+
+//RemoveUser deletes a user along with their sessions, API keys and
+//memberships.  Users who still own channels, or are the last admin of an
+//organization, are refused; otherwise a user made later with the same
+//name would inherit them.
+func RemoveUser(db *mgo.Database, username string) error {
+	owned := make([]ChannelDBRecord, 0)
+	err := db.C(channelsCollection).Find(bson.M{"owner": username}).Select(bson.M{"_id": 1}).All(&owned)
+	if err != nil {
+		return err
+	}
+	if len(owned) > 0 {
+		slugs := make([]string, len(owned))
+		for i := range owned {
+			slugs[i] = owned[i].Slug
+		}
+		return fmt.Errorf("%s still owns channels %s; delete them first", username, strings.Join(slugs, ", "))
+	}
+	orgs := make([]OrgDBRecord, 0)
+	err = db.C(orgsCollection).Find(bson.M{"members.username": username}).All(&orgs)
+	if err != nil {
+		return err
+	}
+	for i := range orgs {
+		if orgs[i].lastAdmin(username) {
+			return fmt.Errorf("%s is the last admin of organization %s; make someone else admin first", username, orgs[i].Name)
+		}
+	}
+
+	err = db.C(usersCollection).RemoveId(username)
+	if err != nil {
+		return err
+	}
+	err = RemoveSessions(db, username)
+	if err != nil {
+		return err
+	}
+	_, err = db.C(apiKeysCollection).RemoveAll(bson.M{"owner": username})
+	if err != nil {
+		return err
+	}
+	_, err = db.C(channelsCollection).UpdateAll(bson.M{"members.username": username},
+		bson.M{"$pull": bson.M{"members": bson.M{"username": username}}})
+	if err != nil {
+		return err
+	}
+	_, err = db.C(orgsCollection).UpdateAll(bson.M{"members.username": username},
+		bson.M{"$pull": bson.M{"members": bson.M{"username": username}}})
+	return err
+}
+
+//NewChannel makes an empty channel record with default settings.
+func NewChannel(slug, title, owner string) *ChannelDBRecord {
+	return &ChannelDBRecord{
+		Slug:  slug,
+		Title: title,
+		Owner: owner,
+		Items: make([]ItemDBRecord, 0),
+	}
+}
+
+func AddChannel(db *mgo.Database, chanrec *ChannelDBRecord) error {
+	return db.C(channelsCollection).Insert(chanrec)
+}
+
+func InsertChannel(db *mgo.Database, slug, title, owner string) (*ChannelDBRecord, error) {
+	chanrec := NewChannel(slug, title, owner)
+	err := AddChannel(db, chanrec)
+	return chanrec, err
+}
+
+//UpdateChannel sets fields of a channel record, e.g.
+//bson.M{"strip_exif": true}.
+func UpdateChannel(db *mgo.Database, slug string, changes bson.M) error {
+	return db.C(channelsCollection).UpdateId(slug, bson.M{"$set": changes})
+}
+
+//SetMember gives username a role in a channel, adding them as a member
+//if need be.  It reports whether they were added.
+func SetMember(db *mgo.Database, slug, username, role string) (bool, error) {
+	channels := db.C(channelsCollection)
+	err := channels.Update(bson.M{"_id": slug, "members.username": username},
+		bson.M{"$set": bson.M{"members.$.role": role}})
+	if err != mgo.ErrNotFound {
+		return false, err
+	}
+	err = channels.Update(bson.M{"_id": slug, "members.username": bson.M{"$ne": username}},
+		bson.M{"$push": bson.M{"members": &MemberDBRecord{username, role}}})
+	return err == nil, err
+}
+
+//RemoveMember takes username's role in a channel away.
+func RemoveMember(db *mgo.Database, slug, username string) error {
+	return db.C(channelsCollection).Update(bson.M{"_id": slug, "members.username": username},
+		bson.M{"$pull": bson.M{"members": bson.M{"username": username}}})
+}
+
+func FindChannel(db *mgo.Database, slug string) (*ChannelDBRecord, error) {
+	channels := make([]ChannelDBRecord, 1)
+	err := db.C(channelsCollection).FindId(slug).One(&channels[0])
+	if err == nil {
+		err = loadOrgs(db, channels)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &channels[0], nil
+}
+
+func ListChannels(db *mgo.Database) ([]ChannelDBRecord, error) {
+	channels := make([]ChannelDBRecord, 0)
+	err := db.C(channelsCollection).Find(nil).Sort("_id").All(&channels)
+	if err == nil {
+		err = loadOrgs(db, channels)
+	}
+	return channels, err
+}
+
+//RemoveChannel deletes a channel along with its webhooks and cached
+//image variants, and releases its items' data.
+func RemoveChannel(db *mgo.Database, slug string) error {
+	var old ChannelDBRecord
+	_, err := db.C(channelsCollection).FindId(slug).Select(bson.M{"items.hash": 1}).Apply(mgo.Change{Remove: true}, &old)
+	if err != nil {
+		return err
+	}
+	releaseItems(db, old.Items)
+	err = removeVariants(db, slug, "")
+	if err != nil {
+		return err
+	}
+	_, err = db.C(webhooksCollection).RemoveAll(bson.M{"channel": slug})
+	if err != nil {
+		return err
+	}
+	_, err = db.C(deliveriesCollection).RemoveAll(bson.M{"channel": slug})
+	return err
+}
+
+//releaseItems drops the blob references of items that are gone.  A
+//failure only delays collecting the data (Collect recounts), so it is
+//logged rather than returned.
+func releaseItems(db *mgo.Database, items []ItemDBRecord) {
+	for _, item := range items {
+		err := ReleaseBlob(db, item.Hash)
+		if err != nil {
+			warnf("Could not release blob %s: %s", item.Hash, err.Error())
+		}
+	}
+}
+
+//NewItem makes an item record uploaded now.
+func NewItem(slug, title, b64data, uploader string) *ItemDBRecord {
+	return &ItemDBRecord{
+		Slug:         slug,
+		Title:        title,
+		DateUploaded: time.Now(),
+		Data:         b64data,
+		Uploader:     uploader,
+	}
+}
+
+//AddItem appends itemrec to the channel's items.
+func AddItem(db *mgo.Database, chanSlug string, itemrec *ItemDBRecord) error {
+	return db.C(channelsCollection).UpdateId(chanSlug, bson.M{
+		"$push": bson.M{"items": itemrec},
+	})
+}
+
+//PutItem stores itemrec in the channel, replacing any item with the same
+//slug.  It reports whether an existing item was replaced.
+func PutItem(db *mgo.Database, chanSlug string, itemrec *ItemDBRecord) (bool, error) {
+	chancoll := db.C(channelsCollection)
+	for attempt := 0; attempt < 2; attempt++ {
+		var old ChannelDBRecord
+		_, err := chancoll.Find(bson.M{"_id": chanSlug, "items._id": itemrec.Slug}).
+			Select(bson.M{"items._id": 1, "items.hash": 1}).
+			Apply(mgo.Change{Update: bson.M{"$set": bson.M{"items.$": itemrec}}}, &old)
+		if err == nil {
+			if olditem := old.FindItem(itemrec.Slug); olditem != nil {
+				releaseItems(db, []ItemDBRecord{*olditem})
+			}
+			return true, removeVariants(db, chanSlug, itemrec.Slug)
+		} else if err != mgo.ErrNotFound {
+			return true, err
+		}
+		//The slug is new (or the channel is missing).  Only push if it is
+		//still new, in case someone else got there first.
+		err = chancoll.Update(
+			bson.M{"_id": chanSlug, "items._id": bson.M{"$ne": itemrec.Slug}},
+			bson.M{"$push": bson.M{"items": itemrec}},
+		)
+		if err != mgo.ErrNotFound {
+			return false, err
+		}
+		_, err = FindChannel(db, chanSlug)
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, errors.New("item " + itemrec.Slug + " keeps changing; giving up")
+}
+
+//RemoveItem deletes an item from a channel and releases its data.
+func RemoveItem(db *mgo.Database, chanSlug, itemSlug string) error {
+	var old ChannelDBRecord
+	_, err := db.C(channelsCollection).Find(bson.M{"_id": chanSlug, "items._id": itemSlug}).
+		Select(bson.M{"items._id": 1, "items.hash": 1}).
+		Apply(mgo.Change{Update: bson.M{"$pull": bson.M{"items": bson.M{"_id": itemSlug}}}}, &old)
+	if err != nil {
+		return err
+	}
+	if olditem := old.FindItem(itemSlug); olditem != nil {
+		releaseItems(db, []ItemDBRecord{*olditem})
+	}
+	return removeVariants(db, chanSlug, itemSlug)
+}
+
+const (
+	minReconnectDelay = 250 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+//storeMonitor pings MongoDB in the background.  When a ping fails it
+//keeps retrying with exponential backoff, refreshing the master session
+//each time so that new copies don't inherit a dead socket.
+type storeMonitor struct {
+	session  *mgo.Session
+	interval time.Duration
+	stop     chan bool
+	done     chan bool
+
+	mutex   sync.RWMutex
+	healthy bool
+}
+
+func newStoreMonitor(session *mgo.Session, interval time.Duration) *storeMonitor {
+	return &storeMonitor{
+		session:  session,
+		interval: interval,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+		healthy:  true,
+	}
+}
+
+func (self *storeMonitor) ping() error {
+	//Ping on a copy; pinging the master would make it reserve a socket
+	//that every later copy would then share.
+	pingSession := self.session.Copy()
+	defer pingSession.Close()
+	return pingSession.Ping()
+}
+
+func (self *storeMonitor) setHealthy(healthy bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.healthy = healthy
+}
+
+func (self *storeMonitor) Healthy() bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.healthy
+}
+
+func (self *storeMonitor) run() {
+	defer close(self.done)
+	delay := self.interval
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-time.After(delay):
+		}
+		err := self.ping()
+		if err == nil {
+			if !self.Healthy() {
+				infof("MongoDB is reachable again")
+				self.setHealthy(true)
+			}
+			delay = self.interval
+			continue
+		}
+		if self.Healthy() {
+			errorf("Lost contact with MongoDB: %s", err.Error())
+			self.setHealthy(false)
+			delay = minReconnectDelay
+		} else {
+			warnf("MongoDB still unreachable (retrying in %s): %s", delay, err.Error())
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+		self.session.Refresh()
+	}
+}
+
+func (self *storeMonitor) Stop() {
+	close(self.stop)
+	<-self.done
+}
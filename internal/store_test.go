@@ -0,0 +1,117 @@
+package api
+
+import (
+	"github.com/drewolson/testflight"
+	. "gopkg.in/check.v1"
+	"labix.org/v2/mgo"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+//ReconnectSuite runs its own throwaway mongod so that it can restart it
+//underneath a running router.  It is skipped when mongod isn't in PATH.
+type ReconnectSuite struct {
+	mongodPath string
+	dbPath     string
+	port       int
+	mongod     *exec.Cmd
+	apiConfig  *Config
+}
+
+var _ = Suite(&ReconnectSuite{})
+
+func (self *ReconnectSuite) SetUpSuite(c *C) {
+	path, err := exec.LookPath("mongod")
+	if err != nil {
+		c.Skip("mongod is not in PATH")
+	}
+	self.mongodPath = path
+	self.dbPath = c.MkDir()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	self.port = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	self.startMongod(c)
+	session, err := mgo.DialWithTimeout(self.url(), 2*time.Second)
+	c.Assert(err, IsNil)
+	self.apiConfig = NewConfig(session, "reconnect", DefaultOptions())
+	self.apiConfig.WatchStore(100 * time.Millisecond)
+
+	insertSession := session.Copy()
+	defer insertSession.Close()
+	_, err = createUser("reconnectuser", insertSession.DB("reconnect").C(usersCollection))
+	c.Assert(err, IsNil)
+}
+
+func (self *ReconnectSuite) TearDownSuite(c *C) {
+	if self.apiConfig != nil {
+		self.apiConfig.Close()
+	}
+	self.stopMongod(c)
+}
+
+func (self *ReconnectSuite) url() string {
+	return "mongodb://127.0.0.1:" + strconv.Itoa(self.port)
+}
+
+func (self *ReconnectSuite) startMongod(c *C) {
+	self.mongod = exec.Command(self.mongodPath,
+		"--dbpath", self.dbPath,
+		"--bind_ip", "127.0.0.1",
+		"--port", strconv.Itoa(self.port),
+	)
+	err := self.mongod.Start()
+	c.Assert(err, IsNil)
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(self.port))
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Fatal("mongod did not start listening")
+}
+
+func (self *ReconnectSuite) stopMongod(c *C) {
+	if self.mongod == nil {
+		return
+	}
+	self.mongod.Process.Kill()
+	self.mongod.Wait()
+	self.mongod = nil
+}
+
+func (self *ReconnectSuite) getChannels(r *testflight.Requester) int {
+	req, err := http.NewRequest("GET", "/channel", nil)
+	if err != nil {
+		return 0
+	}
+	req.Header.Add("Authorization", "Bearer SUP3R_S33CR37:reconnectuser")
+	return r.Do(req).StatusCode
+}
+
+func (self *ReconnectSuite) TestSurvivesMongodRestart(c *C) {
+	testflight.WithServer(self.apiConfig.GetRouter(), func(r *testflight.Requester) {
+		c.Assert(self.getChannels(r), Equals, http.StatusOK)
+
+		self.stopMongod(c)
+		c.Assert(self.getChannels(r), Not(Equals), http.StatusOK)
+
+		self.startMongod(c)
+		status := 0
+		for i := 0; i < 60 && status != http.StatusOK; i++ {
+			time.Sleep(500 * time.Millisecond)
+			status = self.getChannels(r)
+		}
+		c.Assert(status, Equals, http.StatusOK)
+		for i := 0; i < 100 && !self.apiConfig.monitor.Healthy(); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		c.Assert(self.apiConfig.monitor.Healthy(), Equals, true)
+	})
+}
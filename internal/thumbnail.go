@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"strconv"
+	"time"
+)
+
+const (
+	variantsCollection = "variants"
+
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitFill    = "fill"
+
+	thumbnailSize = 256
+	//maxSourcePixels keeps a small file that claims to be a huge image
+	//from eating all our memory.
+	maxSourcePixels = 50 * 1000 * 1000
+)
+
+var ErrNotImage = errors.New("item is not a JPEG, PNG or GIF image")
+
+//VariantSpec describes a resized copy of an image.  A zero Width or
+//Height means "whatever keeps the aspect ratio".
+type VariantSpec struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+//ThumbnailSpec is the variant made for every image on upload.
+var ThumbnailSpec = VariantSpec{thumbnailSize, thumbnailSize, FitContain}
+
+//variantSizes are the only widths and heights variants come in.  Every
+//variant made is cached; with a fixed set of sizes, anyone who can read
+//a channel can neither fill the variants collection nor have images
+//decoded again and again.
+var variantSizes = []int{64, 128, 256, 512, 1024, 2048}
+
+//ParseVariantSpec reads the w, h and fit query parameters.  ok is false
+//if neither w nor h is given, i.e. the caller wants the original.
+func ParseVariantSpec(w, h, fit string) (spec VariantSpec, ok bool, err error) {
+	if w == "" && h == "" {
+		return spec, false, nil
+	}
+	spec.Width, err = parseDimension("w", w)
+	if err != nil {
+		return spec, false, err
+	}
+	spec.Height, err = parseDimension("h", h)
+	if err != nil {
+		return spec, false, err
+	}
+	switch fit {
+	case "":
+		spec.Fit = FitContain
+	case FitContain, FitCover, FitFill:
+		spec.Fit = fit
+	default:
+		return spec, false, errors.New("fit must be contain, cover or fill")
+	}
+	return spec, true, nil
+}
+
+func parseDimension(name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil {
+		for _, size := range variantSizes {
+			if n == size {
+				return n, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%s must be one of %v", name, variantSizes)
+}
+
+func (self VariantSpec) key(chanSlug, itemSlug string) string {
+	return fmt.Sprintf("%s/%s/%dx%d/%s", chanSlug, itemSlug, self.Width, self.Height, self.Fit)
+}
+
+//dimensions works out the output size and the part of the source (of
+//size sw x sh) to scale into it.
+func (self VariantSpec) dimensions(sw, sh int) (dw, dh int, crop image.Rectangle) {
+	crop = image.Rect(0, 0, sw, sh)
+	w, h := self.Width, self.Height
+	if w == 0 || h == 0 || self.Fit == FitContain {
+		//Fit inside the box without ever enlarging.
+		scale := 1.0
+		if w > 0 && float64(w)/float64(sw) < scale {
+			scale = float64(w) / float64(sw)
+		}
+		if h > 0 && float64(h)/float64(sh) < scale {
+			scale = float64(h) / float64(sh)
+		}
+		return atLeastOne(float64(sw) * scale), atLeastOne(float64(sh) * scale), crop
+	}
+	if w > sw || h > sh {
+		//Shrink a box bigger than the source, keeping its shape.
+		scale := float64(sw) / float64(w)
+		if float64(sh)/float64(h) < scale {
+			scale = float64(sh) / float64(h)
+		}
+		w, h = atLeastOne(float64(w)*scale), atLeastOne(float64(h)*scale)
+	}
+	if self.Fit == FitCover {
+		//Scale to cover the box, then take its middle.
+		scale := float64(w) / float64(sw)
+		if float64(h)/float64(sh) > scale {
+			scale = float64(h) / float64(sh)
+		}
+		cw := atLeastOne(float64(w) / scale)
+		ch := atLeastOne(float64(h) / scale)
+		x := (sw - cw) / 2
+		y := (sh - ch) / 2
+		crop = image.Rect(x, y, x+cw, y+ch)
+	}
+	return w, h, crop
+}
+
+func atLeastOne(x float64) int {
+	n := int(x + 0.5)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+//MakeVariant decodes an image and resizes it according to spec.  JPEGs
+//stay JPEGs; everything else comes out as PNG.  Only the first frame of
+//an animated GIF is used.
+func MakeVariant(data []byte, spec VariantSpec) (resized []byte, contentType string, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrNotImage
+	}
+	if config.Width*config.Height > maxSourcePixels {
+		return nil, "", errors.New("image is too large to resize")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := src.Bounds()
+	dw, dh, crop := spec.dimensions(bounds.Dx(), bounds.Dy())
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop.Add(bounds.Min), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+//FindVariant returns a cached variant of an item, or mgo.ErrNotFound if
+//there isn't an up-to-date one.
+func FindVariant(db *mgo.Database, chanSlug string, item *ItemDBRecord, spec VariantSpec) (*VariantDBRecord, error) {
+	var variant VariantDBRecord
+	err := db.C(variantsCollection).FindId(spec.key(chanSlug, item.Slug)).One(&variant)
+	if err != nil {
+		return nil, err
+	}
+	if !variant.Source.Equal(item.DateUploaded) {
+		return nil, mgo.ErrNotFound
+	}
+	return &variant, nil
+}
+
+//NewVariant makes a variant of an item from its decoded data, ready to
+//be cached with PutVariant.
+func NewVariant(chanSlug string, item *ItemDBRecord, data []byte, spec VariantSpec) (*VariantDBRecord, error) {
+	switch extensionFor(data) {
+	case ".jpg", ".png", ".gif":
+	default:
+		return nil, ErrNotImage
+	}
+	resized, contentType, err := MakeVariant(data, spec)
+	if err != nil {
+		return nil, err
+	}
+	return &VariantDBRecord{
+		Key:         spec.key(chanSlug, item.Slug),
+		Channel:     chanSlug,
+		Item:        item.Slug,
+		Source:      item.DateUploaded,
+		ContentType: contentType,
+		Data:        resized,
+		DateCreated: time.Now(),
+	}, nil
+}
+
+func PutVariant(db *mgo.Database, variant *VariantDBRecord) error {
+	_, err := db.C(variantsCollection).UpsertId(variant.Key, variant)
+	return err
+}
+
+//removeVariants forgets the cached variants of one item, or of a whole
+//channel if itemSlug is "".
+func removeVariants(db *mgo.Database, chanSlug, itemSlug string) error {
+	selector := bson.M{"channel": chanSlug}
+	if itemSlug != "" {
+		selector["item"] = itemSlug
+	}
+	_, err := db.C(variantsCollection).RemoveAll(selector)
+	return err
+}
+
+//makeThumbnail caches the standard thumbnail of a newly stored item,
+//given its decoded data.  Items that aren't images are skipped.
+func makeThumbnail(db *mgo.Database, chanSlug string, item *ItemDBRecord, data []byte) {
+	variant, err := NewVariant(chanSlug, item, data, ThumbnailSpec)
+	if err == nil {
+		err = PutVariant(db, variant)
+	}
+	if err != nil && err != ErrNotImage {
+		warnf("Could not make a thumbnail of %s/%s: %s", chanSlug, item.Slug, err.Error())
+	}
+}
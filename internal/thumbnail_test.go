@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+type ThumbnailSuite struct{}
+
+var _ = Suite(&ThumbnailSuite{})
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return img
+}
+
+func (self *ThumbnailSuite) TestParseVariantSpec(c *C) {
+	_, ok, err := ParseVariantSpec("", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	spec, ok, err := ParseVariantSpec("128", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(spec, Equals, VariantSpec{128, 0, FitContain})
+
+	spec, _, err = ParseVariantSpec("128", "64", "cover")
+	c.Assert(err, IsNil)
+	c.Assert(spec, Equals, VariantSpec{128, 64, FitCover})
+
+	for _, bad := range [][]string{{"0", "", ""}, {"x", "", ""}, {"", "4096", ""}, {"100", "", ""}, {"64", "65", ""}, {"64", "64", "squash"}} {
+		_, _, err = ParseVariantSpec(bad[0], bad[1], bad[2])
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
+}
+
+func (self *ThumbnailSuite) TestDimensions(c *C) {
+	w, h, crop := VariantSpec{100, 100, FitContain}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{100, 50})
+	c.Assert(crop, Equals, image.Rect(0, 0, 400, 200))
+
+	//Never enlarged.
+	w, h, _ = VariantSpec{1000, 0, FitContain}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{400, 200})
+
+	w, h, _ = VariantSpec{0, 100, FitFill}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{200, 100})
+
+	w, h, crop = VariantSpec{100, 100, FitCover}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{100, 100})
+	c.Assert(crop, Equals, image.Rect(100, 0, 300, 200))
+
+	w, h, crop = VariantSpec{100, 100, FitFill}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{100, 100})
+	c.Assert(crop, Equals, image.Rect(0, 0, 400, 200))
+
+	//Nothing is ever made bigger than the source.
+	w, h, crop = VariantSpec{4096, 4096, FitCover}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{200, 200})
+	c.Assert(crop, Equals, image.Rect(100, 0, 300, 200))
+
+	w, h, crop = VariantSpec{4096, 4096, FitFill}.dimensions(4, 2)
+	c.Assert([]int{w, h}, DeepEquals, []int{2, 2})
+	c.Assert(crop, Equals, image.Rect(0, 0, 4, 2))
+
+	w, h, _ = VariantSpec{100, 300, FitFill}.dimensions(400, 200)
+	c.Assert([]int{w, h}, DeepEquals, []int{67, 200})
+}
+
+func (self *ThumbnailSuite) TestMakeVariant(c *C) {
+	src := testImage(300, 200)
+	encoders := map[string]func(*bytes.Buffer) error{
+		"image/jpeg": func(buf *bytes.Buffer) error { return jpeg.Encode(buf, src, nil) },
+		"image/png":  func(buf *bytes.Buffer) error { return png.Encode(buf, src) },
+		"image/gif":  func(buf *bytes.Buffer) error { return gif.Encode(buf, src, nil) },
+	}
+	for format, encode := range encoders {
+		var buf bytes.Buffer
+		c.Assert(encode(&buf), IsNil)
+		resized, contentType, err := MakeVariant(buf.Bytes(), VariantSpec{30, 30, FitCover})
+		c.Assert(err, IsNil)
+		if format == "image/jpeg" {
+			c.Assert(contentType, Equals, "image/jpeg")
+		} else {
+			c.Assert(contentType, Equals, "image/png")
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(resized))
+		c.Assert(err, IsNil)
+		c.Assert([]int{config.Width, config.Height}, DeepEquals, []int{30, 30}, Commentf("%s", format))
+	}
+
+	_, _, err := MakeVariant([]byte("just some text"), ThumbnailSpec)
+	c.Assert(err, Equals, ErrNotImage)
+}
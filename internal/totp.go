@@ -0,0 +1,374 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Users can turn on two-factor authentication with an authenticator app
+//(RFC 6238 TOTP: HMAC-SHA1, 6 digits, 30-second steps).  Enrolling hands
+//out a secret and an otpauth:// URI to show as a QR code; the secret only
+//takes effect once a code from it is confirmed, which also hands out the
+//recovery codes.  From then on POST /login wants a code as well, and a
+//code is never accepted twice.  Recovery codes work once each in place
+//of a code; like API keys, only their hashes are stored.  The shared
+//secret and client certificates, which never ask for a code, are only
+//good for POST /login, and API keys must be made afterwards.  Too many
+//wrong codes lock the second factor for a while.
+
+const (
+	totpIssuer = "testflight"
+	totpDigits = 6
+	totpPeriod = 30
+	//totpSkew is how many steps either side of now are accepted, for
+	//clocks that are a little off.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	maxTOTPFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+//Error codes sent when POST /login wants a second factor, or when a
+//user with two-factor authentication on sends credentials that skip it.
+const (
+	CodeTOTPRequired        = "totp_required"
+	CodeTOTPInvalid         = "totp_invalid"
+	CodeTOTPLocked          = "totp_locked"
+	CodeTOTPSessionRequired = "totp_session_required"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpStep(now time.Time) int64 {
+	return now.Unix() / totpPeriod
+}
+
+//totpCode is the code for one time step (RFC 4226 section 5.3).
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+//matchTOTP looks for the step code belongs to near now, if any.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+//TOTPURI is the otpauth:// URI authenticator apps read from a QR code.
+func TOTPURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+//newRecoveryCodes returns fresh recovery codes, formatted like
+//"abcde-fghij", along with the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	raw := make([]byte, 8)
+	for i := range codes {
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+//hashRecoveryCode forgives the dash, spaces and case when hashing a
+//code someone typed in.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return hashToken(code)
+}
+
+//StartTOTP records secret as the one being enrolled, replacing any
+//earlier enrollment that was never confirmed.
+func StartTOTP(db *mgo.Database, username, secret string) error {
+	return db.C(usersCollection).UpdateId(username, bson.M{"$set": bson.M{"totp_pending": secret}})
+}
+
+//EnableTOTP turns two-factor authentication on with the enrolled secret,
+//recording step as used.  It fails with mgo.ErrNotFound if secret is no
+//longer the one being enrolled.
+func EnableTOTP(db *mgo.Database, username, secret string, step int64, recoveryHashes []string) error {
+	return db.C(usersCollection).Update(
+		bson.M{"_id": username, "totp_pending": secret},
+		bson.M{
+			"$set": bson.M{
+				"totp_secret":    secret,
+				"totp_last_step": step,
+				"totp_since":     time.Now(),
+				"recovery_codes": recoveryHashes,
+			},
+			"$unset": bson.M{"totp_pending": "", "totp_failures": "", "totp_locked_until": ""},
+		})
+}
+
+//DisableTOTP turns two-factor authentication off, dropping the secret and
+//the recovery codes.
+func DisableTOTP(db *mgo.Database, username string) error {
+	return db.C(usersCollection).UpdateId(username, bson.M{"$unset": bson.M{
+		"totp_secret":       "",
+		"totp_pending":      "",
+		"totp_last_step":    "",
+		"totp_since":        "",
+		"totp_failures":     "",
+		"totp_locked_until": "",
+		"recovery_codes":    "",
+	}})
+}
+
+func SetRecoveryCodes(db *mgo.Database, username string, recoveryHashes []string) error {
+	return db.C(usersCollection).UpdateId(username, bson.M{"$set": bson.M{"recovery_codes": recoveryHashes}})
+}
+
+//useTOTPStep marks step as used, failing with mgo.ErrNotFound if it or a
+//later step already was.  Doing it in one update keeps two requests from
+//both getting in with the same code.
+func useTOTPStep(db *mgo.Database, username string, step int64) error {
+	return db.C(usersCollection).Update(
+		bson.M{"_id": username, "totp_last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totp_last_step": step}})
+}
+
+//useRecoveryCode uses up a recovery code, failing with mgo.ErrNotFound if
+//there is no such code left.
+func useRecoveryCode(db *mgo.Database, username, hash string) error {
+	return db.C(usersCollection).Update(
+		bson.M{"_id": username, "recovery_codes": hash},
+		bson.M{"$pull": bson.M{"recovery_codes": hash}})
+}
+
+//countTOTPFailure records a wrong code, locking the second factor once
+//there have been too many.
+func countTOTPFailure(db *mgo.Database, username string, now time.Time) error {
+	users := db.C(usersCollection)
+	var userrec UserDBRecord
+	_, err := users.FindId(username).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"totp_failures": 1}},
+		ReturnNew: true,
+	}, &userrec)
+	if err != nil || userrec.TOTPFailures < maxTOTPFailures {
+		return err
+	}
+	return users.UpdateId(username, bson.M{
+		"$set":   bson.M{"totp_locked_until": now.Add(totpLockout)},
+		"$unset": bson.M{"totp_failures": ""},
+	})
+}
+
+//checkSecondFactor checks code as a TOTP code or else a recovery code
+//for a user with two-factor authentication on, using it up if good.
+//Wrong codes are counted towards a lockout.
+func checkSecondFactor(db *mgo.Database, userrec *UserDBRecord, code string) bool {
+	code = strings.TrimSpace(code)
+	now := time.Now()
+	var err error
+	if step, ok := matchTOTP(userrec.TOTPSecret, code, now); ok {
+		err = useTOTPStep(db, userrec.Username, step)
+	} else {
+		err = useRecoveryCode(db, userrec.Username, hashRecoveryCode(code))
+	}
+	if err == mgo.ErrNotFound {
+		err = countTOTPFailure(db, userrec.Username, now)
+		if err != nil {
+			InternalError("Could not record failed two-factor code")
+		}
+		return false
+	} else if err != nil {
+		InternalError("Could not check two-factor code")
+	}
+	if userrec.TOTPFailures > 0 {
+		db.C(usersCollection).UpdateId(userrec.Username, bson.M{"$unset": bson.M{"totp_failures": ""}})
+	}
+	return true
+}
+
+//forceSecondFactor fails the request unless its "code" is good.
+func forceSecondFactor(c *gin.Context, userrec *UserDBRecord) {
+	if time.Now().Before(userrec.TOTPLockedUntil) {
+		Fail(http.StatusTooManyRequests, CodeTOTPLocked, "Too many wrong two-factor codes; try again later")
+	}
+	code, ok := formValue(c, "code")
+	if !ok || code == "" {
+		Fail(http.StatusUnauthorized, CodeTOTPRequired, "A two-factor code is required")
+	}
+	if !checkSecondFactor(requestDB(c), userrec, code) {
+		Fail(http.StatusUnauthorized, CodeTOTPInvalid, "Invalid two-factor code")
+	}
+}
+
+//refuseSingleFactor fails requests from users with two-factor
+//authentication on that authenticated with the shared secret or a client
+//certificate, neither of which asks for a code, unless they are logging
+//in.
+func refuseSingleFactor(c *gin.Context, userrec *UserDBRecord) {
+	if userrec.TOTPSecret == "" || (c.Request.Method == "POST" && c.Request.URL.Path == "/login") {
+		return
+	}
+	Fail(http.StatusUnauthorized, CodeTOTPSessionRequired, "Two-factor authentication is on; log in with POST /login and use the session")
+}
+
+func fetchUser(c *gin.Context, username string) *UserDBRecord {
+	userrec, err := FindUser(requestDB(c), username)
+	if err == mgo.ErrNotFound {
+		NotFound("No such user " + username)
+	} else if err != nil {
+		InternalError("Could not fetch user from database")
+	}
+	return userrec
+}
+
+func totpStatus(userrec *UserDBRecord) *TOTPJSONRecord {
+	return &TOTPJSONRecord{
+		Enabled:           userrec.TOTPSecret != "",
+		RecoveryCodesLeft: len(userrec.RecoveryCodes),
+	}
+}
+
+func (self *Config) GetTOTP(c *gin.Context) {
+	userrec := fetchUser(c, forceAuth(c))
+	c.JSON(http.StatusOK, totpStatus(userrec))
+}
+
+//EnrollTOTP starts turning on two-factor authentication, answering with
+//the secret to give an authenticator app.
+func (self *Config) EnrollTOTP(c *gin.Context) {
+	userrec := fetchUser(c, forceAuth(c))
+	if userrec.TOTPSecret != "" {
+		BadRequest("Two-factor authentication is already enabled")
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		InternalError("Could not generate secret")
+	}
+	err = StartTOTP(requestDB(c), userrec.Username, secret)
+	if err != nil {
+		InternalError("Could not save secret")
+	}
+	status := totpStatus(userrec)
+	status.Secret = secret
+	status.URI = TOTPURI(userrec.Username, secret)
+	c.JSON(http.StatusCreated, status)
+}
+
+//ConfirmTOTP turns on two-factor authentication given a code from the
+//enrolled secret, answering with the recovery codes.  This is the only
+//time they are shown.
+func (self *Config) ConfirmTOTP(c *gin.Context) {
+	userrec := fetchUser(c, forceAuth(c))
+	if userrec.TOTPSecret != "" {
+		BadRequest("Two-factor authentication is already enabled")
+	}
+	if userrec.TOTPPending == "" {
+		BadRequest("Start enrolling with POST /user/me/totp first")
+	}
+	code, _ := formValue(c, "code")
+	step, ok := matchTOTP(userrec.TOTPPending, strings.TrimSpace(code), time.Now())
+	if !ok {
+		Fail(http.StatusBadRequest, CodeTOTPInvalid, "Invalid two-factor code")
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		InternalError("Could not generate recovery codes")
+	}
+	err = EnableTOTP(requestDB(c), userrec.Username, userrec.TOTPPending, step, hashes)
+	if err == mgo.ErrNotFound {
+		BadRequest("Enrollment was restarted; confirm the new secret")
+	} else if err != nil {
+		InternalError("Could not enable two-factor authentication")
+	}
+	//So that the user's older sessions are checked against TOTPSince.
+	self.sessions.forgetUser(userrec.Username)
+	c.JSON(http.StatusOK, &TOTPJSONRecord{
+		Enabled:           true,
+		RecoveryCodesLeft: len(codes),
+		RecoveryCodes:     codes,
+	})
+}
+
+//RegenerateRecoveryCodes replaces the recovery codes, given a code.
+func (self *Config) RegenerateRecoveryCodes(c *gin.Context) {
+	userrec := fetchUser(c, forceAuth(c))
+	if userrec.TOTPSecret == "" {
+		BadRequest("Two-factor authentication is not enabled")
+	}
+	forceSecondFactor(c, userrec)
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		InternalError("Could not generate recovery codes")
+	}
+	err = SetRecoveryCodes(requestDB(c), userrec.Username, hashes)
+	if err != nil {
+		InternalError("Could not save recovery codes")
+	}
+	c.JSON(http.StatusOK, &TOTPJSONRecord{
+		Enabled:           true,
+		RecoveryCodesLeft: len(codes),
+		RecoveryCodes:     codes,
+	})
+}
+
+//DeleteTOTP turns off two-factor authentication, given a code.
+func (self *Config) DeleteTOTP(c *gin.Context) {
+	userrec := fetchUser(c, forceAuth(c))
+	if userrec.TOTPSecret != "" {
+		forceSecondFactor(c, userrec)
+	}
+	err := DisableTOTP(requestDB(c), userrec.Username)
+	if err != nil {
+		InternalError("Could not disable two-factor authentication")
+	}
+	c.String(http.StatusNoContent, "")
+}
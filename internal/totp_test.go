@@ -0,0 +1,58 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+	"net/url"
+	"time"
+)
+
+type TOTPSuite struct{}
+
+var _ = Suite(&TOTPSuite{})
+
+//The SHA-1 test vectors from RFC 6238, cut down to 6 digits.
+func (self *TOTPSuite) TestCode(c *C) {
+	key := []byte("12345678901234567890")
+	c.Assert(totpCode(key, totpStep(time.Unix(59, 0))), Equals, "287082")
+	c.Assert(totpCode(key, totpStep(time.Unix(1111111109, 0))), Equals, "081804")
+	c.Assert(totpCode(key, totpStep(time.Unix(2000000000, 0))), Equals, "279037")
+}
+
+func (self *TOTPSuite) TestMatch(c *C) {
+	secret, err := newTOTPSecret()
+	c.Assert(err, IsNil)
+	key, err := totpEncoding.DecodeString(secret)
+	c.Assert(err, IsNil)
+	now := time.Now()
+	current := totpStep(now)
+
+	step, ok := matchTOTP(secret, totpCode(key, current-1), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(step, Equals, current-1)
+	_, ok = matchTOTP(secret, totpCode(key, current+1), now)
+	c.Assert(ok, Equals, true)
+	_, ok = matchTOTP(secret, totpCode(key, current+3), now)
+	c.Assert(ok, Equals, false)
+	_, ok = matchTOTP(secret, "", now)
+	c.Assert(ok, Equals, false)
+}
+
+func (self *TOTPSuite) TestURI(c *C) {
+	uri, err := url.Parse(TOTPURI("alice smith", "ABCDEF"))
+	c.Assert(err, IsNil)
+	c.Assert(uri.Scheme, Equals, "otpauth")
+	c.Assert(uri.Host, Equals, "totp")
+	c.Assert(uri.Path, Equals, "/testflight:alice smith")
+	c.Assert(uri.Query().Get("secret"), Equals, "ABCDEF")
+	c.Assert(uri.Query().Get("issuer"), Equals, "testflight")
+}
+
+func (self *TOTPSuite) TestRecoveryCodes(c *C) {
+	codes, hashes, err := newRecoveryCodes()
+	c.Assert(err, IsNil)
+	c.Assert(codes, HasLen, recoveryCodeCount)
+	c.Assert(codes[0], Matches, "[a-z2-7]{5}-[a-z2-7]{5}")
+	c.Assert(hashes[0], Equals, hashRecoveryCode(codes[0]))
+	c.Assert(hashRecoveryCode(" "+codes[0][:5]+codes[0][6:]), Equals, hashes[0])
+	c.Assert(codes[0], Not(Equals), codes[1])
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//Error codes sent with upload failures.
+const (
+	CodeBodyTooLarge   = "body_too_large"
+	CodeInvalidBase64  = "invalid_base64"
+	CodeInvalidSlug    = "invalid_slug"
+	CodeItemTooLarge   = "item_too_large"
+	CodeTypeNotAllowed = "type_not_allowed"
+)
+
+//UploadError is why an item was refused.
+type UploadError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (self *UploadError) Error() string {
+	return self.Message
+}
+
+//sniffContentType works out a MIME type (without parameters) from the
+//first bytes of a file.
+func sniffContentType(head []byte) string {
+	contentType := http.DetectContentType(head)
+	return strings.TrimSpace(strings.Split(contentType, ";")[0])
+}
+
+//ParseTypePatterns reads a comma-separated allowlist such as
+//"image/*, application/pdf".  An empty list allows everything.
+func ParseTypePatterns(list string) ([]string, error) {
+	patterns := make([]string, 0)
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		parts := strings.Split(pattern, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || (parts[0] == "*" && parts[1] != "*") {
+			return nil, errors.New("bad content type pattern " + pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func typeAllowed(patterns []string, contentType string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == "*/*" || pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+//CheckItem checks a new item's slug can be a file name, decodes its data
+//to make sure it is valid base64, records its size and sniffed content
+//type, and checks both against the channel's limits.  Refusals are
+//*UploadError.
+func CheckItem(chanrec *ChannelDBRecord, itemrec *ItemDBRecord) error {
+	if !validName(itemrec.Slug) {
+		return &UploadError{http.StatusBadRequest, CodeInvalidSlug, "slug cannot be empty, . or .., or contain / \\ ? # or %"}
+	}
+	data, err := base64.StdEncoding.DecodeString(itemrec.Data)
+	if err != nil {
+		return &UploadError{http.StatusBadRequest, CodeInvalidBase64, "b64data is not valid base64"}
+	}
+	itemrec.Size = int64(len(data))
+	itemrec.ContentType = sniffContentType(data)
+	//Items that will be stripped are measured by ProcessItem instead.
+	if !stripsMetadata(chanrec, itemrec) {
+		err = checkItemSize(chanrec, itemrec)
+		if err != nil {
+			return err
+		}
+	}
+	if !typeAllowed(chanrec.AllowedTypes, itemrec.ContentType) {
+		return &UploadError{http.StatusUnsupportedMediaType, CodeTypeNotAllowed,
+			fmt.Sprintf("Channel %s does not accept %s (only %s)", chanrec.Slug, itemrec.ContentType, strings.Join(chanrec.AllowedTypes, ", "))}
+	}
+	return nil
+}
+
+func checkItemSize(chanrec *ChannelDBRecord, itemrec *ItemDBRecord) error {
+	if chanrec.MaxItemBytes > 0 && itemrec.Size > chanrec.MaxItemBytes {
+		return &UploadError{http.StatusRequestEntityTooLarge, CodeItemTooLarge,
+			fmt.Sprintf("Items in channel %s may be at most %d bytes", chanrec.Slug, chanrec.MaxItemBytes)}
+	}
+	return nil
+}
+
+//checkUpload is CheckItem for handlers.
+func checkUpload(chanrec *ChannelDBRecord, itemrec *ItemDBRecord) {
+	err := CheckItem(chanrec, itemrec)
+	if err != nil {
+		uploadErr := err.(*UploadError)
+		Fail(uploadErr.Status, uploadErr.Code, "Item "+itemrec.Slug+": "+uploadErr.Message)
+	}
+}
+
+//processUpload is ProcessItem for handlers.
+func processUpload(chanrec *ChannelDBRecord, itemrec *ItemDBRecord) {
+	err := ProcessItem(chanrec, itemrec)
+	if uploadErr, ok := err.(*UploadError); ok {
+		Fail(uploadErr.Status, uploadErr.Code, "Item "+itemrec.Slug+": "+uploadErr.Message)
+	} else if err != nil {
+		BadRequest("Cannot strip metadata from " + itemrec.Slug + ": " + err.Error())
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/base64"
+	. "gopkg.in/check.v1"
+	"net/http"
+)
+
+type UploadSuite struct{}
+
+var _ = Suite(&UploadSuite{})
+
+func (self *UploadSuite) TestParseTypePatterns(c *C) {
+	patterns, err := ParseTypePatterns(" image/*, Application/PDF ,")
+	c.Assert(err, IsNil)
+	c.Assert(patterns, DeepEquals, []string{"image/*", "application/pdf"})
+
+	patterns, err = ParseTypePatterns("")
+	c.Assert(err, IsNil)
+	c.Assert(patterns, HasLen, 0)
+
+	for _, bad := range []string{"image", "image/", "*/png", "a/b/c"} {
+		_, err = ParseTypePatterns(bad)
+		c.Assert(err, NotNil, Commentf("%s", bad))
+	}
+}
+
+func (self *UploadSuite) TestTypeAllowed(c *C) {
+	c.Assert(typeAllowed(nil, "text/plain"), Equals, true)
+	c.Assert(typeAllowed([]string{"*/*"}, "text/plain"), Equals, true)
+	patterns := []string{"image/*", "application/pdf"}
+	c.Assert(typeAllowed(patterns, "image/png"), Equals, true)
+	c.Assert(typeAllowed(patterns, "application/pdf"), Equals, true)
+	c.Assert(typeAllowed(patterns, "text/plain"), Equals, false)
+	c.Assert(typeAllowed(patterns, "imagery/png"), Equals, false)
+}
+
+func (self *UploadSuite) TestCheckItem(c *C) {
+	chanrec := NewChannel("uploads", "Uploads", "someone")
+	itemrec := NewItem("text", "Text", base64.StdEncoding.EncodeToString([]byte("hello, world")), "someone")
+	c.Assert(CheckItem(chanrec, itemrec), IsNil)
+	c.Assert(itemrec.ContentType, Equals, "text/plain")
+	c.Assert(itemrec.Size, Equals, int64(12))
+
+	itemrec = NewItem("bad", "Bad", "this is not base64!", "someone")
+	err := CheckItem(chanrec, itemrec)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*UploadError).Code, Equals, CodeInvalidBase64)
+	c.Assert(err.(*UploadError).Status, Equals, http.StatusBadRequest)
+
+	chanrec.MaxItemBytes = 10
+	itemrec = NewItem("text", "Text", base64.StdEncoding.EncodeToString([]byte("hello, world")), "someone")
+	err = CheckItem(chanrec, itemrec)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*UploadError).Code, Equals, CodeItemTooLarge)
+	c.Assert(err.(*UploadError).Status, Equals, http.StatusRequestEntityTooLarge)
+
+	chanrec.MaxItemBytes = 0
+	chanrec.AllowedTypes = []string{"image/*"}
+	err = CheckItem(chanrec, itemrec)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*UploadError).Code, Equals, CodeTypeNotAllowed)
+	c.Assert(err.(*UploadError).Status, Equals, http.StatusUnsupportedMediaType)
+}
+
+func (self *UploadSuite) TestCheckItemSlug(c *C) {
+	chanrec := NewChannel("uploads", "Uploads", "someone")
+	data := base64.StdEncoding.EncodeToString([]byte("hello, world"))
+	for _, slug := range []string{"", ".", "..", "../../.bashrc", "a/b", `..\evil`} {
+		err := CheckItem(chanrec, NewItem(slug, "Text", data, "someone"))
+		c.Assert(err, NotNil, Commentf("%q", slug))
+		c.Assert(err.(*UploadError).Code, Equals, CodeInvalidSlug)
+	}
+	c.Assert(CheckItem(chanrec, NewItem(".bashrc", "Text", data, "someone")), IsNil)
+}
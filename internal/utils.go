@@ -1,9 +1,13 @@
 package api
 
 import (
+	"encoding/base64"
 	"errors"
 	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
 	"runtime"
+	"strings"
 )
 
 func forceAuth(c *gin.Context) string {
@@ -20,6 +24,20 @@ func forceAuth(c *gin.Context) string {
 	panic(errors.New("This should not be possible!"))
 }
 
+//currentUser is forceAuth for routes that also serve anonymous
+//requests; it returns "" for those.
+func currentUser(c *gin.Context) string {
+	usernameI, err := c.Get("USERNAME")
+	if err != nil {
+		return ""
+	}
+	username, ok := usernameI.(string)
+	if !ok {
+		InternalError("USERNAME is of incorrect type!")
+	}
+	return username
+}
+
 func GetStack() string {
 	chunk := 2048
 	stackTrace := ""
@@ -35,3 +53,70 @@ func GetStack() string {
 
 	return stackTrace
 }
+
+//extensions is copied in client/files.go so that files the client saves
+//get the same names as archive entries; keep the two the same.
+var extensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"video/mp4":       ".mp4",
+	"audio/mpeg":      ".mp3",
+	"text/plain":      ".txt",
+}
+
+//extensionFor guesses a file extension (with the dot) from the first
+//bytes of a file, falling back to ".bin".
+func extensionFor(head []byte) string {
+	return extensionForType(sniffContentType(head))
+}
+
+func extensionForType(contentType string) string {
+	ext, ok := extensions[contentType]
+	if !ok {
+		return ".bin"
+	}
+	return ext
+}
+
+//The item data helpers below work on the base64 strings items are
+//stored as, without decoding more than they need to.
+
+func validBase64(b64data string) bool {
+	if len(b64data)%4 != 0 {
+		return false
+	}
+	_, err := io.Copy(ioutil.Discard, decodeReader(b64data))
+	return err == nil
+}
+
+func decodeReader(b64data string) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, strings.NewReader(b64data))
+}
+
+//decodedLen is the exact number of bytes b64data decodes to, assuming
+//it is valid.
+func decodedLen(b64data string) int64 {
+	n := int64(len(b64data)) / 4 * 3
+	if strings.HasSuffix(b64data, "==") {
+		n -= 2
+	} else if strings.HasSuffix(b64data, "=") {
+		n--
+	}
+	return n
+}
+
+//decodeHead decodes enough of b64data for content sniffing.
+func decodeHead(b64data string) []byte {
+	const sniffLen = 512
+	end := len(b64data)
+	if end > sniffLen/3*4+4 {
+		end = sniffLen/3*4 + 4
+	}
+	head, _ := base64.StdEncoding.DecodeString(b64data[:end])
+	return head
+}
@@ -0,0 +1,569 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhooksCollection   = "webhooks"
+	deliveriesCollection = "webhook_deliveries"
+
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+
+	maxDeliveryLog = 100
+)
+
+var webhookEventTypes = []string{EventItemCreated, EventItemUpdated, EventItemDeleted}
+
+//SignPayload returns the X-Testflight-Signature header value for a
+//webhook payload.  Receivers should compute the same thing with their
+//copy of the secret and compare with hmac.Equal.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+//parseWebhookEvents turns a comma-separated list of event types into a
+//slice.  An empty list means all of them.
+func parseWebhookEvents(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return webhookEventTypes, nil
+	}
+	events := make([]string, 0)
+	for _, event := range strings.Split(list, ",") {
+		event = strings.TrimSpace(event)
+		known := false
+		for _, eventType := range webhookEventTypes {
+			if event == eventType {
+				known = true
+			}
+		}
+		if !known {
+			return nil, errors.New("unknown event type " + event)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func validWebhookURL(rawURL string) bool {
+	hookURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return (hookURL.Scheme == "http" || hookURL.Scheme == "https") && hookURL.Host != ""
+}
+
+//Unless WebhookAllowInternal is set, webhooks may only reach the public
+//internet: otherwise a maintainer could point one at the server's own
+//network, or a cloud metadata service at 169.254.169.254, and have the
+//server make requests there.  Host names are checked when a webhook is
+//registered, but what counts is the address actually dialled, which is
+//checked on every connection; a name can resolve differently later.
+
+//internalNets are the special-purpose ranges that net.IP has no method
+//for.
+var internalNets = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipnet
+	}
+	return nets
+}
+
+//internalIP is true of addresses that aren't on the public internet.
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, ipnet := range internalNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//internalWebhookURL is true of URLs whose host is plainly internal: an
+//internal address or localhost.
+func internalWebhookURL(rawURL string) bool {
+	hookURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(hookURL.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && internalIP(ip)
+}
+
+//checkDialAddress is a net.Dialer Control function refusing connections
+//to internal addresses.  It sees the address after name resolution.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || internalIP(ip) {
+		return fmt.Errorf("webhooks may not connect to internal address %s", host)
+	}
+	return nil
+}
+
+//newWebhookClient makes the client deliveries are sent with.  It never
+//follows redirects, which could lead anywhere, and ignores any proxy
+//settings, which would hide the address really connected to.
+func newWebhookClient(allowInternal bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowInternal {
+		dialer.Control = checkDialAddress
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func InsertWebhook(db *mgo.Database, chanSlug, hookURL string, events []string, creator string) (*WebhookDBRecord, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	hookrec := &WebhookDBRecord{
+		Id:          bson.NewObjectId(),
+		Channel:     chanSlug,
+		URL:         hookURL,
+		Secret:      secret,
+		Events:      events,
+		Creator:     creator,
+		DateCreated: time.Now(),
+	}
+	err = db.C(webhooksCollection).Insert(hookrec)
+	return hookrec, err
+}
+
+//FindWebhook looks up a webhook by its hex ID within a channel.
+func FindWebhook(db *mgo.Database, chanSlug, id string) (*WebhookDBRecord, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, mgo.ErrNotFound
+	}
+	var hookrec WebhookDBRecord
+	err := db.C(webhooksCollection).Find(bson.M{
+		"_id":     bson.ObjectIdHex(id),
+		"channel": chanSlug,
+	}).One(&hookrec)
+	if err != nil {
+		return nil, err
+	}
+	return &hookrec, nil
+}
+
+func ListWebhooks(db *mgo.Database, chanSlug string) ([]WebhookDBRecord, error) {
+	hooks := make([]WebhookDBRecord, 0)
+	err := db.C(webhooksCollection).Find(bson.M{"channel": chanSlug}).Sort("_id").All(&hooks)
+	return hooks, err
+}
+
+//RemoveWebhook deletes a webhook along with its queue and delivery log.
+func RemoveWebhook(db *mgo.Database, hookrec *WebhookDBRecord) error {
+	err := db.C(webhooksCollection).RemoveId(hookrec.Id)
+	if err != nil {
+		return err
+	}
+	_, err = db.C(deliveriesCollection).RemoveAll(bson.M{"webhook": hookrec.Id})
+	return err
+}
+
+//PruneDeliveries keeps the delivery log of a webhook to its newest
+//maxDeliveryLog finished deliveries.  Pending ones are left alone.
+func PruneDeliveries(db *mgo.Database, hookID bson.ObjectId) error {
+	finished := bson.M{"webhook": hookID, "status": bson.M{"$in": []string{DeliveryDelivered, DeliveryFailed}}}
+	var oldest struct {
+		Id bson.ObjectId "_id"
+	}
+	err := db.C(deliveriesCollection).Find(finished).Sort("-_id").Skip(maxDeliveryLog - 1).Select(bson.M{"_id": 1}).One(&oldest)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	finished["_id"] = bson.M{"$lt": oldest.Id}
+	_, err = db.C(deliveriesCollection).RemoveAll(finished)
+	return err
+}
+
+//ListDeliveries returns a webhook's most recent deliveries, newest
+//first.
+func ListDeliveries(db *mgo.Database, hookrec *WebhookDBRecord) ([]DeliveryDBRecord, error) {
+	deliveries := make([]DeliveryDBRecord, 0)
+	err := db.C(deliveriesCollection).Find(bson.M{"webhook": hookrec.Id}).Sort("-_id").Limit(maxDeliveryLog).All(&deliveries)
+	return deliveries, err
+}
+
+//EnqueueDeliveries queues an event for every webhook on its channel
+//that wants it.  It returns the number of deliveries queued.
+func EnqueueDeliveries(db *mgo.Database, event *Event) (int, error) {
+	hooks, err := ListWebhooks(db, event.Channel)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, hookrec := range hooks {
+		if !hookrec.Wants(event.Type) {
+			continue
+		}
+		now := time.Now()
+		err = db.C(deliveriesCollection).Insert(&DeliveryDBRecord{
+			Id:          bson.NewObjectId(),
+			Webhook:     hookrec.Id,
+			Channel:     event.Channel,
+			EventType:   event.Type,
+			Payload:     string(payload),
+			Status:      DeliveryPending,
+			NextAttempt: now,
+			DateCreated: now,
+		})
+		if err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+const (
+	webhookTimeout       = 10 * time.Second
+	webhookPollEvery     = 5 * time.Second
+	webhookRetryDelay    = 10 * time.Second
+	webhookMaxRetryDelay = time.Hour
+	webhookMaxAttempts   = 10
+)
+
+//webhookDispatcher works through the delivery queue in the background.
+//Each delivery is claimed by pushing its next_attempt past the request
+//timeout, so several servers can share one queue, and a delivery claimed
+//by a server that died is simply retried later.
+type webhookDispatcher struct {
+	session       *mgo.Session
+	dbname        string
+	client        *http.Client
+	pollEvery     time.Duration
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+	maxAttempts   int
+	kick          chan bool
+	stop          chan bool
+	done          chan bool
+}
+
+func newWebhookDispatcher(session *mgo.Session, dbname string, allowInternal bool) *webhookDispatcher {
+	return &webhookDispatcher{
+		session:       session,
+		dbname:        dbname,
+		client:        newWebhookClient(allowInternal),
+		pollEvery:     webhookPollEvery,
+		retryDelay:    webhookRetryDelay,
+		maxRetryDelay: webhookMaxRetryDelay,
+		maxAttempts:   webhookMaxAttempts,
+		kick:          make(chan bool, 1),
+		stop:          make(chan bool),
+		done:          make(chan bool),
+	}
+}
+
+//Kick makes the dispatcher look at the queue now rather than at its
+//next poll.
+func (self *webhookDispatcher) Kick() {
+	select {
+	case self.kick <- true:
+	default:
+	}
+}
+
+func (self *webhookDispatcher) run() {
+	defer close(self.done)
+	self.ensureIndexes()
+	for {
+		self.deliverDue()
+		select {
+		case <-self.stop:
+			return
+		case <-self.kick:
+		case <-time.After(self.pollEvery):
+		}
+	}
+}
+
+func (self *webhookDispatcher) ensureIndexes() {
+	dbSession := self.session.Copy()
+	defer dbSession.Close()
+	db := dbSession.DB(self.dbname)
+	err := db.C(webhooksCollection).EnsureIndexKey("channel")
+	if err == nil {
+		err = db.C(deliveriesCollection).EnsureIndexKey("status", "next_attempt")
+	}
+	if err == nil {
+		err = db.C(deliveriesCollection).EnsureIndexKey("webhook")
+	}
+	if err != nil {
+		warnf("Could not create webhook indexes: %s", err.Error())
+	}
+}
+
+func (self *webhookDispatcher) stopping() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *webhookDispatcher) deliverDue() {
+	dbSession := self.session.Copy()
+	defer dbSession.Close()
+	db := dbSession.DB(self.dbname)
+	for !self.stopping() {
+		delivery, err := self.claim(db)
+		if err == mgo.ErrNotFound {
+			return
+		} else if err != nil {
+			warnf("Could not read the webhook queue: %s", err.Error())
+			return
+		}
+		self.deliver(db, delivery)
+	}
+}
+
+func (self *webhookDispatcher) claim(db *mgo.Database) (*DeliveryDBRecord, error) {
+	now := time.Now()
+	var delivery DeliveryDBRecord
+	_, err := db.C(deliveriesCollection).Find(bson.M{
+		"status":       DeliveryPending,
+		"next_attempt": bson.M{"$lte": now},
+	}).Sort("next_attempt").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"next_attempt": now.Add(2 * webhookTimeout)}},
+		ReturnNew: true,
+	}, &delivery)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+//backoff is the wait before the next try after the given number of
+//failed attempts.
+func (self *webhookDispatcher) backoff(attempts int) time.Duration {
+	delay := self.retryDelay
+	for i := 1; i < attempts && delay < self.maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > self.maxRetryDelay {
+		delay = self.maxRetryDelay
+	}
+	return delay
+}
+
+func (self *webhookDispatcher) deliver(db *mgo.Database, delivery *DeliveryDBRecord) {
+	var hookrec WebhookDBRecord
+	err := db.C(webhooksCollection).FindId(delivery.Webhook).One(&hookrec)
+	if err == mgo.ErrNotFound {
+		//Deleted while the delivery was in flight.
+		db.C(deliveriesCollection).RemoveId(delivery.Id)
+		return
+	} else if err != nil {
+		warnf("Could not load webhook %s: %s", delivery.Webhook.Hex(), err.Error())
+		return
+	}
+
+	status, err := self.post(&hookrec, delivery)
+	update := bson.M{
+		"attempts":    delivery.Attempts + 1,
+		"last_status": status,
+		"last_error":  "",
+	}
+	if err == nil {
+		update["status"] = DeliveryDelivered
+		update["date_delivered"] = time.Now()
+		debugf("Delivered %s to webhook %s", delivery.EventType, hookrec.Id.Hex())
+	} else {
+		update["last_error"] = err.Error()
+		if delivery.Attempts+1 >= self.maxAttempts {
+			update["status"] = DeliveryFailed
+			warnf("Giving up on delivery %s to %s: %s", delivery.Id.Hex(), hookrec.URL, err.Error())
+		} else {
+			update["next_attempt"] = time.Now().Add(self.backoff(delivery.Attempts + 1))
+			debugf("Delivery %s to %s failed: %s", delivery.Id.Hex(), hookrec.URL, err.Error())
+		}
+	}
+	err = db.C(deliveriesCollection).UpdateId(delivery.Id, bson.M{"$set": update})
+	if err != nil {
+		warnf("Could not record delivery %s: %s", delivery.Id.Hex(), err.Error())
+	}
+	if update["status"] != nil {
+		err = PruneDeliveries(db, hookrec.Id)
+		if err != nil {
+			warnf("Could not prune the delivery log of webhook %s: %s", hookrec.Id.Hex(), err.Error())
+		}
+	}
+}
+
+func (self *webhookDispatcher) post(hookrec *WebhookDBRecord, delivery *DeliveryDBRecord) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", hookrec.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "testflight-demo-webhooks")
+	req.Header.Set("X-Testflight-Event", delivery.EventType)
+	req.Header.Set("X-Testflight-Delivery", delivery.Id.Hex())
+	req.Header.Set("X-Testflight-Signature", SignPayload(hookrec.Secret, payload))
+	response, err := self.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+func (self *webhookDispatcher) Stop() {
+	close(self.stop)
+	<-self.done
+}
+
+func fetchWebhook(c *gin.Context, chanSlug, id string) *WebhookDBRecord {
+	hookrec, err := FindWebhook(requestDB(c), chanSlug, id)
+	if err == mgo.ErrNotFound {
+		NotFound("Channel " + chanSlug + " has no webhook " + id)
+	} else if err != nil {
+		InternalError("Could not fetch webhook from database")
+	}
+	return hookrec
+}
+
+//CreateChannelWebhook registers a URL to be POSTed the channel's item
+//events.  The response is the only time the signing secret is shown.
+func (self *Config) CreateChannelWebhook(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	_ = fetchChannelAs(c, slug, username, RoleMaintainer)
+	hookURL := c.Request.FormValue("url")
+	if !validWebhookURL(hookURL) {
+		BadRequest("url must be an absolute http or https URL")
+	}
+	if !self.opts.WebhookAllowInternal && internalWebhookURL(hookURL) {
+		BadRequest("url must not point at a private, loopback or link-local address")
+	}
+	events, err := parseWebhookEvents(c.Request.FormValue("events"))
+	if err != nil {
+		BadRequest(err.Error())
+	}
+	hookrec, err := InsertWebhook(requestDB(c), slug, hookURL, events, username)
+	if err != nil {
+		InternalError("Could not save webhook")
+	}
+	hookJSON := hookrec.ToJSON()
+	hookJSON.Secret = hookrec.Secret
+	c.JSON(http.StatusCreated, hookJSON)
+}
+
+func (self *Config) GetChannelWebhooks(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	_ = fetchChannelAs(c, slug, username, RoleMaintainer)
+	hooks, err := ListWebhooks(requestDB(c), slug)
+	if err != nil {
+		InternalError("Could not fetch webhooks from database")
+	}
+	hookData := make([]*WebhookJSONRecord, 0)
+	for _, hookrec := range hooks {
+		hookData = append(hookData, hookrec.ToJSON())
+	}
+	c.JSON(http.StatusOK, hookData)
+}
+
+func (self *Config) DeleteChannelWebhook(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	_ = fetchChannelAs(c, slug, username, RoleMaintainer)
+	hookrec := fetchWebhook(c, slug, c.Params.ByName("webhookId"))
+	err := RemoveWebhook(requestDB(c), hookrec)
+	if err != nil {
+		InternalError("Could not delete webhook")
+	}
+	c.String(http.StatusNoContent, "")
+}
+
+//GetWebhookDeliveries is the delivery log: the webhook's most recent
+//deliveries, newest first, whether pending, delivered or failed.
+func (self *Config) GetWebhookDeliveries(c *gin.Context) {
+	username := forceAuth(c)
+	slug := channelSlug(c)
+	_ = fetchChannelAs(c, slug, username, RoleMaintainer)
+	hookrec := fetchWebhook(c, slug, c.Params.ByName("webhookId"))
+	deliveries, err := ListDeliveries(requestDB(c), hookrec)
+	if err != nil {
+		InternalError("Could not fetch deliveries from database")
+	}
+	deliveryData := make([]*DeliveryJSONRecord, 0)
+	for i := range deliveries {
+		deliveryData = append(deliveryData, deliveries[i].ToJSON())
+	}
+	c.JSON(http.StatusOK, deliveryData)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+type WebhookSuite struct{}
+
+var _ = Suite(&WebhookSuite{})
+
+func (self *WebhookSuite) TestSignPayload(c *C) {
+	//echo -n '{"a":1}' | openssl dgst -sha256 -hmac secret
+	c.Assert(SignPayload("secret", []byte(`{"a":1}`)), Equals,
+		"sha256=aa9e2e3575f5d7098b6caccd790888c36d5fdb63342a73bada2d6a51747a8494")
+}
+
+func (self *WebhookSuite) TestParseEvents(c *C) {
+	events, err := parseWebhookEvents("")
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, webhookEventTypes)
+
+	events, err = parseWebhookEvents("item-created, item-deleted")
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []string{EventItemCreated, EventItemDeleted})
+
+	_, err = parseWebhookEvents("item-created,item-eaten")
+	c.Assert(err, NotNil)
+}
+
+func (self *WebhookSuite) TestValidURL(c *C) {
+	c.Assert(validWebhookURL("https://ci.example.com/hook"), Equals, true)
+	c.Assert(validWebhookURL("http://127.0.0.1:8080/"), Equals, true)
+	c.Assert(validWebhookURL("ftp://ci.example.com/hook"), Equals, false)
+	c.Assert(validWebhookURL("/hook"), Equals, false)
+	c.Assert(validWebhookURL("https://"), Equals, false)
+}
+
+func (self *WebhookSuite) TestBackoff(c *C) {
+	dispatcher := newWebhookDispatcher(nil, "", false)
+	dispatcher.retryDelay = time.Second
+	dispatcher.maxRetryDelay = 10 * time.Second
+	c.Assert(dispatcher.backoff(1), Equals, time.Second)
+	c.Assert(dispatcher.backoff(2), Equals, 2*time.Second)
+	c.Assert(dispatcher.backoff(4), Equals, 8*time.Second)
+	c.Assert(dispatcher.backoff(5), Equals, 10*time.Second)
+	c.Assert(dispatcher.backoff(50), Equals, 10*time.Second)
+}
+
+func (self *WebhookSuite) TestInternalAddresses(c *C) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		c.Assert(internalIP(net.ParseIP(addr)), Equals, true, Commentf("%s", addr))
+	}
+	for _, addr := range []string{"8.8.8.8", "93.184.216.34", "2606:4700::1111"} {
+		c.Assert(internalIP(net.ParseIP(addr)), Equals, false, Commentf("%s", addr))
+	}
+	c.Assert(internalWebhookURL("http://169.254.169.254/latest/meta-data/"), Equals, true)
+	c.Assert(internalWebhookURL("http://[::1]:8080/hook"), Equals, true)
+	c.Assert(internalWebhookURL("http://LOCALHOST./hook"), Equals, true)
+	c.Assert(internalWebhookURL("https://ci.example.com/hook"), Equals, false)
+}
+
+func (self *WebhookSuite) TestClient(c *C) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "http://169.254.169.254/", http.StatusFound)
+	}))
+	defer receiver.Close()
+
+	//Loopback is refused when dialling, whatever the URL says.
+	_, err := newWebhookClient(false).Post(receiver.URL, "application/json", nil)
+	c.Assert(err, ErrorMatches, ".*internal address 127.0.0.1.*")
+
+	response, err := newWebhookClient(true).Post(receiver.URL, "application/json", nil)
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusFound)
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"labix.org/v2/mgo"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	socketWriteWait   = 10 * time.Second
+	socketPongWait    = 2 * heartbeatInterval
+	socketMaxMessage  = 4096
+	socketMaxChannels = 256
+
+	//Browsers can't set Authorization on a WebSocket, so they offer the
+	//subprotocols socketProtocol and socketTokenPrefix+<token> instead.
+	socketProtocol    = "testflight-events"
+	socketTokenPrefix = "testflight-token."
+)
+
+//SocketRequest is what a client sends over the event socket, e.g.
+//{"action": "subscribe", "channels": ["foo", "bar"]}.
+type SocketRequest struct {
+	Action   string   `json:"action"`
+	Channels []string `json:"channels"`
+}
+
+//SocketReply answers a SocketRequest.  Events are sent as plain Event
+//objects; both have a "type" field to tell them apart.
+type SocketReply struct {
+	Type     string   `json:"type"`
+	Channels []string `json:"channels,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+//checkSocketOrigin accepts same-origin upgrades, requests without an
+//Origin header (i.e. not from a browser) and the configured CORS
+//origins.
+func checkSocketOrigin(origins []string) func(*http.Request) bool {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" || allowed["*"] || allowed[origin] {
+			return true
+		}
+		originURL, err := url.Parse(origin)
+		return err == nil && originURL.Host == req.Host
+	}
+}
+
+//socketToken returns the session token or API key offered as a
+//subprotocol, or "".
+func socketToken(req *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(req) {
+		if strings.HasPrefix(protocol, socketTokenPrefix) {
+			return strings.TrimPrefix(protocol, socketTokenPrefix)
+		}
+	}
+	return ""
+}
+
+//forceSocketAuth is forceAuth, also accepting a token from socketToken.
+//Only session tokens and API keys are taken that way.
+func forceSocketAuth(c *gin.Context, sessions *SessionCache) string {
+	if username := currentUser(c); username != "" {
+		return username
+	}
+	token := socketToken(c.Request)
+	if strings.HasPrefix(token, SessionTokenPrefix) {
+		return authenticateSession(c, token, sessions).Username
+	} else if strings.HasPrefix(token, APIKeyPrefix) {
+		return authenticateKey(c, token)
+	}
+	return forceAuth(c)
+}
+
+//readSocket passes the client's messages to the handler until the
+//connection fails or done is closed.  It also keeps the read deadline
+//moving while pongs come back.
+func readSocket(conn *websocket.Conn, messages chan<- []byte, failed chan<- error, done <-chan bool) {
+	conn.SetReadLimit(socketMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			failed <- err
+			return
+		}
+		select {
+		case messages <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+func writeSocket(conn *websocket.Conn, payload interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return conn.WriteJSON(payload)
+}
+
+func closeSocket(conn *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(socketWriteWait))
+}
+
+//GetEventSocket upgrades to a WebSocket on which the client can
+//subscribe to item events on any number of channels.  The server pings
+//every heartbeatInterval and hangs up on clients that stop answering.
+//A client that can't keep up with its events is disconnected with
+//status 1013 (try again later) rather than slowing down everyone else;
+//it should reconnect and re-fetch the item lists it cares about.
+func (self *Config) GetEventSocket(c *gin.Context) {
+	username := forceSocketAuth(c, self.sessions)
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: socketWriteWait,
+		CheckOrigin:      checkSocketOrigin(self.opts.CORSOrigins),
+		Subprotocols:     []string{socketProtocol},
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		//Upgrade has already sent an error response.
+		debugf("WebSocket upgrade failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	//Give the request's database session back rather than hold it for
+	//as long as the socket is open; each message gets its own copy.
+	requestDB(c).Session.Close()
+
+	sub, _, _ := self.events.Subscribe(eventBufferSize, 0)
+	defer sub.Close()
+	subscribed := make(map[string]bool)
+
+	messages := make(chan []byte)
+	failed := make(chan error, 1)
+	done := make(chan bool)
+	defer close(done)
+	go readSocket(conn, messages, failed, done)
+
+	ping := time.NewTicker(heartbeatInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case message := <-messages:
+			session := self.session.Copy()
+			reply := self.handleSocketRequest(session.DB(self.db.Name), username, sub, subscribed, message)
+			session.Close()
+			err = writeSocket(conn, reply)
+		case event, ok := <-sub.C:
+			if !ok {
+				if sub.Overflowed() {
+					closeSocket(conn, websocket.CloseTryAgainLater, "Too many undelivered events")
+				} else {
+					closeSocket(conn, websocket.CloseGoingAway, "Server shutting down")
+				}
+				return
+			}
+			err = writeSocket(conn, event)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait))
+		case err = <-failed:
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				debugf("WebSocket read failed: %s", err.Error())
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (self *Config) handleSocketRequest(db *mgo.Database, username string, sub *Subscription, subscribed map[string]bool, message []byte) *SocketReply {
+	var req SocketRequest
+	err := json.Unmarshal(message, &req)
+	if err != nil {
+		return &SocketReply{Type: "error", Error: "Malformed request: " + err.Error()}
+	}
+	if len(req.Channels) == 0 {
+		return &SocketReply{Type: "error", Error: "channels cannot be empty"}
+	}
+
+	switch req.Action {
+	case "subscribe":
+		added := make(map[string]bool)
+		for _, slug := range req.Channels {
+			if !subscribed[slug] {
+				added[slug] = true
+			}
+		}
+		if len(subscribed)+len(added) > socketMaxChannels {
+			return &SocketReply{Type: "error", Error: "Too many subscriptions"}
+		}
+		for _, slug := range req.Channels {
+			chanRec, err := FindChannel(db, slug)
+			if err == mgo.ErrNotFound || (err == nil && !chanRec.CanRead(username)) {
+				return &SocketReply{Type: "error", Channels: []string{slug}, Error: "No such channel " + slug}
+			} else if err != nil {
+				return &SocketReply{Type: "error", Error: "Could not fetch channel info from database"}
+			}
+		}
+		for _, slug := range req.Channels {
+			subscribed[slug] = true
+			sub.Add(slug)
+		}
+		return &SocketReply{Type: "subscribed", Channels: req.Channels}
+	case "unsubscribe":
+		for _, slug := range req.Channels {
+			delete(subscribed, slug)
+			sub.Remove(slug)
+		}
+		return &SocketReply{Type: "unsubscribed", Channels: req.Channels}
+	}
+	return &SocketReply{Type: "error", Error: "Unknown action " + req.Action}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	. "gopkg.in/check.v1"
+	"net/http"
+)
+
+type SocketSuite struct{}
+
+var _ = Suite(&SocketSuite{})
+
+func (self *SocketSuite) TestCheckOrigin(c *C) {
+	check := checkSocketOrigin([]string{"https://wall.example.com/"})
+	req, err := http.NewRequest("GET", "http://api.example.com/events", nil)
+	c.Assert(err, IsNil)
+	c.Assert(check(req), Equals, true)
+
+	for origin, ok := range map[string]bool{
+		"http://api.example.com":   true,
+		"https://wall.example.com": true,
+		"https://evil.example.com": false,
+	} {
+		req.Header.Set("Origin", origin)
+		c.Assert(check(req), Equals, ok, Commentf("origin %s", origin))
+	}
+
+	check = checkSocketOrigin([]string{"*"})
+	c.Assert(check(req), Equals, true)
+}
+
+func (self *SocketSuite) TestSocketToken(c *C) {
+	req, err := http.NewRequest("GET", "http://api.example.com/events", nil)
+	c.Assert(err, IsNil)
+	c.Assert(socketToken(req), Equals, "")
+	req.Header.Set("Sec-WebSocket-Protocol", socketProtocol+", "+socketTokenPrefix+"tfs_abc")
+	c.Assert(socketToken(req), Equals, "tfs_abc")
+}
@@ -1,29 +1,143 @@
 package main
 
 import (
+	"fmt"
 	api "github.com/waucka/testflight-demo/internal"
 	"labix.org/v2/mgo"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	apiConfig *api.Config
 )
 
+const usageText = `usage: %[1]s [serve] [flags]
+       %[1]s user add|list|delete|totp-reset [flags] [username]
+       %[1]s channel add|list|delete [flags] [slug [title owner]]
+       %[1]s org add|list [flags] [name title admin]
+       %[1]s org member [flags] <org> <username> member|admin
+       %[1]s item import [flags] <channel> <file> [slug [title]]
+       %[1]s item export [flags] <channel> <item> [file]
+       %[1]s blob gc|migrate [flags]
+
+Every command accepts the server's configuration flags (see -help);
+the admin commands only use the database settings.
+`
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageText, os.Args[0])
+}
+
 func main() {
-	dburl := "mongodb://" + os.Getenv("MONGO_HOST")
-	session, err := mgo.Dial(dburl)
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	switch command {
+	case "serve":
+		os.Exit(runServe(args))
+	case "user", "channel", "org", "item", "blob":
+		os.Exit(runAdmin(command, args))
+	case "help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func dial(settings *Settings) (*mgo.Session, error) {
+	session, err := mgo.DialWithTimeout(settings.DBURL, time.Duration(settings.DBTimeout))
+	if err != nil {
+		return nil, err
+	}
+	//DialWithTimeout also shortens the socket timeout; slow queries on
+	//big channels still need the usual minute.
+	session.SetSocketTimeout(time.Minute)
+	return session, nil
+}
+
+func runServe(args []string) int {
+	settings, printConfig, err := LoadSettings(os.Args[0]+" serve", args)
+	if err != nil {
+		log.Println("Bad configuration!")
+		log.Println(err)
+		return 2
+	}
+	if printConfig {
+		settings.Print(os.Stdout)
+		return 0
+	}
+
+	err = api.SetLogLevel(settings.LogLevel)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	session, err := dial(settings)
 	if err != nil {
 		log.Println("Couldn't connect to MongoDB!")
 		log.Println(err)
-		return
+		return 1
 	}
 
-	apiConfig = api.NewConfig(session, "demo")
+	opts := settings.APIOptions()
+	opts.BlobBackend, err = settings.NewBlobBackend(session)
+	if err != nil {
+		log.Println("Couldn't set up the blob store!")
+		log.Println(err)
+		return 1
+	}
+	others, err := api.NewBlobStore(opts.BlobBackend).ForeignBackends(session.DB(settings.DBName))
+	if err != nil {
+		log.Println("Couldn't check the blob store!")
+		log.Println(err)
+		return 1
+	} else if len(others) > 0 {
+		log.Printf("Some item data is stored with another blob backend than %q; run blob migrate first", settings.BlobBackend)
+		return 1
+	}
+	apiConfig = api.NewConfig(session, settings.DBName, opts)
+	apiConfig.WatchStore(time.Duration(settings.DBPingEvery))
+	apiConfig.DeliverWebhooks()
+	if settings.BlobGCEvery > 0 {
+		apiConfig.CollectBlobs(time.Duration(settings.BlobGCEvery))
+	}
+	defer apiConfig.Close()
 
 	router := apiConfig.GetRouter()
 
-	listenAddr := "0.0.0.0:8080"
-	router.Run(listenAddr)
+	server := newHTTPServer(settings, router)
+	server.RegisterOnShutdown(apiConfig.StopStreams)
+	if settings.TLSCertFile != "" {
+		reloader, err := newCertReloader(settings.TLSCertFile, settings.TLSKeyFile)
+		if err != nil {
+			log.Println("Couldn't load TLS certificate!")
+			log.Println(err)
+			return 1
+		}
+		server.TLSConfig, err = newTLSConfig(settings, reloader)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		stopWatching := make(chan bool)
+		defer close(stopWatching)
+		go reloader.watch(time.Duration(settings.TLSReloadEvery), stopWatching)
+	}
+
+	err = serveUntilSignalled(server, time.Duration(settings.ShutdownTimeout))
+	if err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func newHTTPServer(settings *Settings, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         settings.ListenAddr,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(settings.ReadTimeout),
+		WriteTimeout: time.Duration(settings.WriteTimeout),
+		IdleTimeout:  time.Duration(settings.IdleTimeout),
+	}
+}
+
+//serveUntilSignalled runs server (over TLS if it has a TLSConfig) until
+//it fails or the process gets SIGTERM/SIGINT.  On a signal it stops
+//accepting connections and waits up to drainTimeout for in-flight
+//requests to finish.
+func serveUntilSignalled(server *http.Server, drainTimeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			//The certificate comes from TLSConfig.GetCertificate.
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Printf("Got %s; draining connections (up to %s)", sig, drainTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("Shutdown deadline passed; closing remaining connections")
+		server.Close()
+		return err
+	}
+	log.Println("All connections drained")
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+func freeAddr(c *C) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func (self *ServerSuite) TestDrainOnSIGTERM(c *C) {
+	started := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	settings := DefaultSettings()
+	settings.ListenAddr = freeAddr(c)
+	server := newHTTPServer(settings, handler)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serveUntilSignalled(server, 5*time.Second)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			response, err := http.Get("http://" + settings.ListenAddr + "/")
+			if err == nil {
+				response.Body.Close()
+				status <- response.StatusCode
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		status <- 0
+	}()
+
+	<-started
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+
+	c.Assert(<-status, Equals, http.StatusOK)
+	c.Assert(<-serveErr, IsNil)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	api "github.com/waucka/testflight-demo/internal"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Duration is a time.Duration that reads and writes itself as a string
+//like "30s" in config files and on the command line.
+type Duration time.Duration
+
+func (self Duration) String() string {
+	return time.Duration(self).String()
+}
+
+func (self *Duration) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*self = Duration(d)
+	return nil
+}
+
+func (self Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.String())
+}
+
+func (self *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	return self.Set(value)
+}
+
+//Settings holds everything the server needs to know before it starts.
+//Values come from (in increasing order of precedence) the built-in
+//defaults, a JSON config file, TESTFLIGHT_* environment variables and
+//command-line flags.
+type Settings struct {
+	ListenAddr      string   `json:"listen_addr"`
+	DBURL           string   `json:"db_url"`
+	DBName          string   `json:"db_name"`
+	AuthSecret      string   `json:"auth_secret"`
+	MaxUploadBytes  int64    `json:"max_upload_bytes"`
+	CORSOrigins     []string `json:"cors_origins"`
+	LogLevel        string   `json:"log_level"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	TLSCertFile     string   `json:"tls_cert_file"`
+	TLSKeyFile      string   `json:"tls_key_file"`
+	TLSClientCAFile string   `json:"tls_client_ca_file"`
+	TLSClientAuth   string   `json:"tls_client_auth"`
+	TLSReloadEvery  Duration `json:"tls_reload_every"`
+	DBTimeout       Duration `json:"db_timeout"`
+	DBPingEvery     Duration `json:"db_ping_every"`
+	BlobGCEvery     Duration `json:"blob_gc_every"`
+	SessionIdle     Duration `json:"session_idle_timeout"`
+	SessionMaxAge   Duration `json:"session_max_age"`
+	//WebhookAllowInternal lets webhooks reach loopback, private and
+	//link-local addresses, for receivers on the same network.
+	WebhookAllowInternal bool   `json:"webhook_allow_internal"`
+	BlobBackend          string `json:"blob_backend"`
+	BlobDir              string `json:"blob_dir"`
+	S3Endpoint           string `json:"s3_endpoint"`
+	S3Region             string `json:"s3_region"`
+	S3Bucket             string `json:"s3_bucket"`
+	S3Prefix             string `json:"s3_prefix"`
+	S3AccessKey          string `json:"s3_access_key"`
+	S3SecretKey          string `json:"s3_secret_key"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		ListenAddr:      "0.0.0.0:8080",
+		DBURL:           "mongodb://localhost",
+		DBName:          "demo",
+		AuthSecret:      "SUP3R_S33CR37",
+		MaxUploadBytes:  32 << 20,
+		CORSOrigins:     make([]string, 0),
+		LogLevel:        "info",
+		ReadTimeout:     Duration(time.Minute),
+		IdleTimeout:     Duration(2 * time.Minute),
+		ShutdownTimeout: Duration(30 * time.Second),
+		TLSClientAuth:   "none",
+		TLSReloadEvery:  Duration(time.Minute),
+		DBTimeout:       Duration(10 * time.Second),
+		DBPingEvery:     Duration(10 * time.Second),
+		BlobGCEvery:     Duration(time.Hour),
+		SessionIdle:     Duration(24 * time.Hour),
+		SessionMaxAge:   Duration(30 * 24 * time.Hour),
+		BlobBackend:     "gridfs",
+		S3Region:        "us-east-1",
+	}
+}
+
+type stringListFlag []string
+
+func (self *stringListFlag) String() string {
+	return strings.Join(*self, ",")
+}
+
+func (self *stringListFlag) Set(value string) error {
+	*self = splitList(value)
+	return nil
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
+//LoadSettings builds the effective settings for the server from args
+//(normally os.Args[1:]).  The returned bool is true when the user asked
+//for --print-config.
+func LoadSettings(name string, args []string) (*Settings, bool, error) {
+	settings, printConfig, rest, err := loadSettings(name, args)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rest) > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", rest[0])
+	}
+	return settings, printConfig, nil
+}
+
+//LoadSettingsWithArgs is LoadSettings for subcommands that take
+//positional arguments after their flags; those are returned.
+func LoadSettingsWithArgs(name string, args []string) (*Settings, []string, error) {
+	settings, _, rest, err := loadSettings(name, args)
+	return settings, rest, err
+}
+
+func loadSettings(name string, args []string) (*Settings, bool, []string, error) {
+	var (
+		configFile      string
+		printConfig     bool
+		listenAddr      string
+		dbURL           string
+		dbName          string
+		authSecret      string
+		maxUploadBytes  int64
+		corsOrigins     stringListFlag
+		logLevel        string
+		readTimeout     Duration
+		writeTimeout    Duration
+		idleTimeout     Duration
+		shutdownTimeout Duration
+		tlsCertFile     string
+		tlsKeyFile      string
+		tlsClientCAFile string
+		tlsClientAuth   string
+		tlsReloadEvery  Duration
+		dbTimeout       Duration
+		dbPingEvery     Duration
+		blobGCEvery     Duration
+		sessionIdle     Duration
+		sessionMaxAge   Duration
+		webhookInternal bool
+		blobBackend     string
+		blobDir         string
+		s3Endpoint      string
+		s3Region        string
+		s3Bucket        string
+		s3Prefix        string
+		s3AccessKey     string
+		s3SecretKey     string
+	)
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", os.Getenv("TESTFLIGHT_CONFIG"), "path to a JSON config file")
+	flags.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	flags.StringVar(&listenAddr, "listen", "", "address to listen on (host:port)")
+	flags.StringVar(&dbURL, "db-url", "", "MongoDB URL (mongodb://...)")
+	flags.StringVar(&dbName, "db-name", "", "MongoDB database name")
+	flags.StringVar(&authSecret, "auth-secret", "", "shared secret for bearer tokens")
+	flags.Int64Var(&maxUploadBytes, "max-upload-bytes", 0, "maximum size of a request body in bytes")
+	flags.Var(&corsOrigins, "cors-origins", "comma-separated list of allowed CORS origins")
+	flags.StringVar(&logLevel, "log-level", "", "one of debug, info, warn, error")
+	flags.Var(&readTimeout, "read-timeout", "maximum time to read a request, including the body")
+	flags.Var(&writeTimeout, "write-timeout", "maximum time to write a response")
+	flags.Var(&idleTimeout, "idle-timeout", "how long to keep idle keep-alive connections open")
+	flags.Var(&shutdownTimeout, "shutdown-timeout", "how long to wait for in-flight requests on shutdown")
+	flags.StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate to serve HTTPS with")
+	flags.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flags.StringVar(&tlsClientCAFile, "tls-client-ca", "", "PEM CA bundle for verifying client certificates")
+	flags.StringVar(&tlsClientAuth, "tls-client-auth", "", "client certificates: none, optional or require")
+	flags.Var(&tlsReloadEvery, "tls-reload-every", "how often to check the certificate files for changes")
+	flags.Var(&dbTimeout, "db-timeout", "how long to wait for a usable MongoDB server")
+	flags.Var(&dbPingEvery, "db-ping-every", "how often to check that MongoDB is reachable")
+	flags.Var(&blobGCEvery, "blob-gc-every", "how often to delete unused item data (0 to never)")
+	flags.Var(&sessionIdle, "session-idle-timeout", "how long a login session lasts unused (0 for ever)")
+	flags.Var(&sessionMaxAge, "session-max-age", "how long a login session lasts at most")
+	flags.BoolVar(&webhookInternal, "webhook-allow-internal", false, "let webhooks reach private and loopback addresses")
+	flags.StringVar(&blobBackend, "blob-backend", "", "where item data is kept: gridfs, fs or s3")
+	flags.StringVar(&blobDir, "blob-dir", "", "directory for item data with -blob-backend fs")
+	flags.StringVar(&s3Endpoint, "s3-endpoint", "", "S3-compatible service URL with -blob-backend s3")
+	flags.StringVar(&s3Region, "s3-region", "", "S3 region")
+	flags.StringVar(&s3Bucket, "s3-bucket", "", "S3 bucket for item data")
+	flags.StringVar(&s3Prefix, "s3-prefix", "", "prefix for S3 object keys")
+	flags.StringVar(&s3AccessKey, "s3-access-key", "", "S3 access key ID")
+	flags.StringVar(&s3SecretKey, "s3-secret-key", "", "S3 secret access key")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	settings := DefaultSettings()
+	if configFile != "" {
+		err = settings.loadFile(configFile)
+		if err != nil {
+			return nil, false, nil, err
+		}
+	}
+	err = settings.loadEnv()
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			settings.ListenAddr = listenAddr
+		case "db-url":
+			settings.DBURL = dbURL
+		case "db-name":
+			settings.DBName = dbName
+		case "auth-secret":
+			settings.AuthSecret = authSecret
+		case "max-upload-bytes":
+			settings.MaxUploadBytes = maxUploadBytes
+		case "cors-origins":
+			settings.CORSOrigins = corsOrigins
+		case "log-level":
+			settings.LogLevel = logLevel
+		case "read-timeout":
+			settings.ReadTimeout = readTimeout
+		case "write-timeout":
+			settings.WriteTimeout = writeTimeout
+		case "idle-timeout":
+			settings.IdleTimeout = idleTimeout
+		case "shutdown-timeout":
+			settings.ShutdownTimeout = shutdownTimeout
+		case "tls-cert":
+			settings.TLSCertFile = tlsCertFile
+		case "tls-key":
+			settings.TLSKeyFile = tlsKeyFile
+		case "tls-client-ca":
+			settings.TLSClientCAFile = tlsClientCAFile
+		case "tls-client-auth":
+			settings.TLSClientAuth = tlsClientAuth
+		case "tls-reload-every":
+			settings.TLSReloadEvery = tlsReloadEvery
+		case "db-timeout":
+			settings.DBTimeout = dbTimeout
+		case "db-ping-every":
+			settings.DBPingEvery = dbPingEvery
+		case "blob-gc-every":
+			settings.BlobGCEvery = blobGCEvery
+		case "session-idle-timeout":
+			settings.SessionIdle = sessionIdle
+		case "session-max-age":
+			settings.SessionMaxAge = sessionMaxAge
+		case "webhook-allow-internal":
+			settings.WebhookAllowInternal = webhookInternal
+		case "blob-backend":
+			settings.BlobBackend = blobBackend
+		case "blob-dir":
+			settings.BlobDir = blobDir
+		case "s3-endpoint":
+			settings.S3Endpoint = s3Endpoint
+		case "s3-region":
+			settings.S3Region = s3Region
+		case "s3-bucket":
+			settings.S3Bucket = s3Bucket
+		case "s3-prefix":
+			settings.S3Prefix = s3Prefix
+		case "s3-access-key":
+			settings.S3AccessKey = s3AccessKey
+		case "s3-secret-key":
+			settings.S3SecretKey = s3SecretKey
+		}
+	})
+
+	err = settings.Validate()
+	if err != nil {
+		return nil, false, nil, err
+	}
+	return settings, printConfig, flags.Args(), nil
+}
+
+func (self *Settings) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, self)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func (self *Settings) loadEnv() error {
+	//MONGO_HOST predates the rest of the settings; keep honoring it.
+	if host := os.Getenv("MONGO_HOST"); host != "" {
+		self.DBURL = "mongodb://" + host
+	}
+	if v := os.Getenv("TESTFLIGHT_LISTEN_ADDR"); v != "" {
+		self.ListenAddr = v
+	}
+	if v := os.Getenv("TESTFLIGHT_DB_URL"); v != "" {
+		self.DBURL = v
+	}
+	if v := os.Getenv("TESTFLIGHT_DB_NAME"); v != "" {
+		self.DBName = v
+	}
+	if v := os.Getenv("TESTFLIGHT_AUTH_SECRET"); v != "" {
+		self.AuthSecret = v
+	}
+	if v := os.Getenv("TESTFLIGHT_MAX_UPLOAD_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("TESTFLIGHT_MAX_UPLOAD_BYTES must be an integer")
+		}
+		self.MaxUploadBytes = n
+	}
+	if v := os.Getenv("TESTFLIGHT_WEBHOOK_ALLOW_INTERNAL"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("TESTFLIGHT_WEBHOOK_ALLOW_INTERNAL must be true or false")
+		}
+		self.WebhookAllowInternal = allow
+	}
+	if v := os.Getenv("TESTFLIGHT_CORS_ORIGINS"); v != "" {
+		self.CORSOrigins = splitList(v)
+	}
+	if v := os.Getenv("TESTFLIGHT_LOG_LEVEL"); v != "" {
+		self.LogLevel = v
+	}
+	if v := os.Getenv("TESTFLIGHT_TLS_CERT_FILE"); v != "" {
+		self.TLSCertFile = v
+	}
+	if v := os.Getenv("TESTFLIGHT_TLS_KEY_FILE"); v != "" {
+		self.TLSKeyFile = v
+	}
+	if v := os.Getenv("TESTFLIGHT_TLS_CLIENT_CA_FILE"); v != "" {
+		self.TLSClientCAFile = v
+	}
+	if v := os.Getenv("TESTFLIGHT_TLS_CLIENT_AUTH"); v != "" {
+		self.TLSClientAuth = v
+	}
+	strs := map[string]*string{
+		"TESTFLIGHT_BLOB_BACKEND":  &self.BlobBackend,
+		"TESTFLIGHT_BLOB_DIR":      &self.BlobDir,
+		"TESTFLIGHT_S3_ENDPOINT":   &self.S3Endpoint,
+		"TESTFLIGHT_S3_REGION":     &self.S3Region,
+		"TESTFLIGHT_S3_BUCKET":     &self.S3Bucket,
+		"TESTFLIGHT_S3_PREFIX":     &self.S3Prefix,
+		"TESTFLIGHT_S3_ACCESS_KEY": &self.S3AccessKey,
+		"TESTFLIGHT_S3_SECRET_KEY": &self.S3SecretKey,
+	}
+	for name, str := range strs {
+		if v := os.Getenv(name); v != "" {
+			*str = v
+		}
+	}
+	durations := map[string]*Duration{
+		"TESTFLIGHT_READ_TIMEOUT":         &self.ReadTimeout,
+		"TESTFLIGHT_WRITE_TIMEOUT":        &self.WriteTimeout,
+		"TESTFLIGHT_IDLE_TIMEOUT":         &self.IdleTimeout,
+		"TESTFLIGHT_SHUTDOWN_TIMEOUT":     &self.ShutdownTimeout,
+		"TESTFLIGHT_TLS_RELOAD_EVERY":     &self.TLSReloadEvery,
+		"TESTFLIGHT_DB_TIMEOUT":           &self.DBTimeout,
+		"TESTFLIGHT_DB_PING_EVERY":        &self.DBPingEvery,
+		"TESTFLIGHT_BLOB_GC_EVERY":        &self.BlobGCEvery,
+		"TESTFLIGHT_SESSION_IDLE_TIMEOUT": &self.SessionIdle,
+		"TESTFLIGHT_SESSION_MAX_AGE":      &self.SessionMaxAge,
+	}
+	for name, d := range durations {
+		if v := os.Getenv(name); v != "" {
+			err := d.Set(v)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (self *Settings) Validate() error {
+	_, _, err := net.SplitHostPort(self.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %s", self.ListenAddr, err.Error())
+	}
+	if !strings.HasPrefix(self.DBURL, "mongodb://") {
+		return fmt.Errorf("invalid database URL %q: must start with mongodb://", self.DBURL)
+	}
+	if self.DBName == "" {
+		return errors.New("database name cannot be empty")
+	}
+	if self.AuthSecret == "" {
+		return errors.New("auth secret cannot be empty")
+	}
+	if self.MaxUploadBytes <= 0 {
+		return errors.New("max upload size must be positive")
+	}
+	for _, origin := range self.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid CORS origin %q", origin)
+		}
+	}
+	switch self.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid log level %q", self.LogLevel)
+	}
+	if self.ReadTimeout < 0 || self.WriteTimeout < 0 || self.IdleTimeout < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+	if self.ShutdownTimeout <= 0 {
+		return errors.New("shutdown timeout must be positive")
+	}
+	if (self.TLSCertFile == "") != (self.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	_, err = clientAuthType(self.TLSClientAuth)
+	if err != nil {
+		return err
+	}
+	if self.TLSClientAuth != "none" && self.TLSClientAuth != "" {
+		if self.TLSCertFile == "" {
+			return errors.New("tls_client_auth requires tls_cert_file and tls_key_file")
+		}
+		if self.TLSClientCAFile == "" {
+			return errors.New("tls_client_auth requires tls_client_ca_file")
+		}
+	}
+	if self.TLSReloadEvery <= 0 {
+		return errors.New("TLS reload interval must be positive")
+	}
+	if self.DBTimeout <= 0 || self.DBPingEvery <= 0 {
+		return errors.New("database timeout and ping interval must be positive")
+	}
+	if self.BlobGCEvery < 0 {
+		return errors.New("blob collection interval cannot be negative")
+	}
+	if self.SessionIdle < 0 || self.SessionMaxAge <= 0 {
+		return errors.New("session idle timeout cannot be negative, and session max age must be positive")
+	}
+	switch self.BlobBackend {
+	case "gridfs":
+	case "fs":
+		if self.BlobDir == "" {
+			return errors.New("blob_backend fs requires blob_dir")
+		}
+	case "s3":
+		if self.S3Endpoint == "" || self.S3Bucket == "" {
+			return errors.New("blob_backend s3 requires s3_endpoint and s3_bucket")
+		}
+		if self.S3AccessKey == "" || self.S3SecretKey == "" {
+			return errors.New("blob_backend s3 requires s3_access_key and s3_secret_key")
+		}
+	default:
+		return fmt.Errorf("invalid blob backend %q", self.BlobBackend)
+	}
+	return nil
+}
+
+//Print writes the settings as JSON, with secrets masked.
+func (self *Settings) Print(w io.Writer) error {
+	masked := *self
+	masked.AuthSecret = maskSecret(masked.AuthSecret)
+	masked.S3SecretKey = maskSecret(masked.S3SecretKey)
+	data, err := json.MarshalIndent(&masked, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
+
+//NewBlobBackend makes the blob backend the settings ask for.
+func (self *Settings) NewBlobBackend(session *mgo.Session) (api.BlobBackend, error) {
+	return self.newBlobBackendNamed(session, self.BlobBackend)
+}
+
+//newBlobBackendNamed makes any backend the settings configure, so that
+//blob migrate can read blobs from the one used before.
+func (self *Settings) newBlobBackendNamed(session *mgo.Session, name string) (api.BlobBackend, error) {
+	switch name {
+	case "gridfs":
+	case "fs":
+		if self.BlobDir == "" {
+			return nil, errors.New("the fs blob backend needs blob_dir")
+		}
+		return api.NewFSBackend(self.BlobDir)
+	case "s3":
+		return api.NewS3Backend(api.S3Options{
+			Endpoint:  self.S3Endpoint,
+			Region:    self.S3Region,
+			Bucket:    self.S3Bucket,
+			Prefix:    self.S3Prefix,
+			AccessKey: self.S3AccessKey,
+			SecretKey: self.S3SecretKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", name)
+	}
+	return api.NewGridFSBackend(session, self.DBName), nil
+}
+
+func (self *Settings) APIOptions() *api.Options {
+	return &api.Options{
+		AuthSecret:           self.AuthSecret,
+		MaxUploadBytes:       self.MaxUploadBytes,
+		CORSOrigins:          self.CORSOrigins,
+		ClientCertAuth:       self.TLSClientAuth == "optional" || self.TLSClientAuth == "require",
+		SessionIdleTimeout:   time.Duration(self.SessionIdle),
+		SessionMaxAge:        time.Duration(self.SessionMaxAge),
+		WebhookAllowInternal: self.WebhookAllowInternal,
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SettingsSuite struct {
+	dir string
+}
+
+var _ = Suite(&SettingsSuite{})
+
+func (self *SettingsSuite) SetUpTest(c *C) {
+	self.dir = c.MkDir()
+	for _, name := range []string{"MONGO_HOST", "TESTFLIGHT_CONFIG", "TESTFLIGHT_LISTEN_ADDR", "TESTFLIGHT_DB_NAME", "TESTFLIGHT_LOG_LEVEL", "TESTFLIGHT_WEBHOOK_ALLOW_INTERNAL"} {
+		os.Setenv(name, "")
+	}
+}
+
+func (self *SettingsSuite) writeConfig(c *C, contents string) string {
+	path := filepath.Join(self.dir, "config.json")
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (self *SettingsSuite) TestDefaults(c *C) {
+	settings, printConfig, err := LoadSettings("test", []string{})
+	c.Assert(err, IsNil)
+	c.Assert(printConfig, Equals, false)
+	c.Assert(settings.ListenAddr, Equals, "0.0.0.0:8080")
+	c.Assert(settings.DBName, Equals, "demo")
+	c.Assert(settings.WebhookAllowInternal, Equals, false)
+	c.Assert(settings.APIOptions().WebhookAllowInternal, Equals, false)
+}
+
+func (self *SettingsSuite) TestPrecedence(c *C) {
+	path := self.writeConfig(c, `{"listen_addr": "127.0.0.1:1111", "db_name": "fromfile", "log_level": "warn"}`)
+	os.Setenv("TESTFLIGHT_DB_NAME", "fromenv")
+	os.Setenv("TESTFLIGHT_LOG_LEVEL", "error")
+	settings, _, err := LoadSettings("test", []string{"-config", path, "-log-level", "debug"})
+	c.Assert(err, IsNil)
+	c.Assert(settings.ListenAddr, Equals, "127.0.0.1:1111")
+	c.Assert(settings.DBName, Equals, "fromenv")
+	c.Assert(settings.LogLevel, Equals, "debug")
+}
+
+func (self *SettingsSuite) TestWebhookAllowInternal(c *C) {
+	os.Setenv("TESTFLIGHT_WEBHOOK_ALLOW_INTERNAL", "true")
+	settings, _, err := LoadSettings("test", []string{})
+	c.Assert(err, IsNil)
+	c.Assert(settings.APIOptions().WebhookAllowInternal, Equals, true)
+	settings, _, err = LoadSettings("test", []string{"-webhook-allow-internal=false"})
+	c.Assert(err, IsNil)
+	c.Assert(settings.WebhookAllowInternal, Equals, false)
+	os.Setenv("TESTFLIGHT_WEBHOOK_ALLOW_INTERNAL", "perhaps")
+	_, _, err = LoadSettings("test", []string{})
+	c.Assert(err, NotNil)
+}
+
+func (self *SettingsSuite) TestMongoHost(c *C) {
+	os.Setenv("MONGO_HOST", "db.example.com")
+	settings, _, err := LoadSettings("test", []string{})
+	c.Assert(err, IsNil)
+	c.Assert(settings.DBURL, Equals, "mongodb://db.example.com")
+}
+
+func (self *SettingsSuite) TestValidation(c *C) {
+	_, _, err := LoadSettings("test", []string{"-listen", "nonsense"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-log-level", "loud"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-cors-origins", "example.com"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-max-upload-bytes", "0"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-blob-backend", "tape"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-blob-backend", "fs"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-blob-backend", "s3", "-s3-endpoint", "http://localhost:9000", "-s3-bucket", "items"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-session-max-age", "0s"})
+	c.Assert(err, NotNil)
+}
+
+func (self *SettingsSuite) TestPrintConfigMasksSecrets(c *C) {
+	settings, printConfig, err := LoadSettings("test", []string{"-print-config", "-auth-secret", "hunter2", "-s3-secret-key", "swordfish"})
+	c.Assert(err, IsNil)
+	c.Assert(printConfig, Equals, true)
+	path := filepath.Join(self.dir, "out.json")
+	out, err := os.Create(path)
+	c.Assert(err, IsNil)
+	err = settings.Print(out)
+	out.Close()
+	c.Assert(err, IsNil)
+	printed, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(printed), Not(Matches), "(?s).*hunter2.*")
+	c.Assert(string(printed), Not(Matches), "(?s).*swordfish.*")
+}
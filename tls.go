@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//certReloader hands the current certificate to the TLS stack and swaps
+//in a fresh one from disk on SIGHUP or when the files change.  Existing
+//connections keep the certificate they were established with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (self *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{self.certFile, self.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (self *certReloader) reload() error {
+	modTime, err := self.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(self.certFile, self.keyFile)
+	if err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.cert = &cert
+	self.modTime = modTime
+	self.mutex.Unlock()
+	return nil
+}
+
+func (self *certReloader) changed() bool {
+	modTime, err := self.latestModTime()
+	if err != nil {
+		return false
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return !modTime.Equal(self.modTime)
+}
+
+func (self *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.cert, nil
+}
+
+//watch reloads the certificate on SIGHUP and whenever the files on disk
+//change (checked every interval) until stop is closed.  A bad
+//certificate on disk is logged and the old one stays in use.
+func (self *certReloader) watch(interval time.Duration, stop chan bool) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangups:
+		case <-ticker.C:
+			if !self.changed() {
+				continue
+			}
+		}
+		err := self.reload()
+		if err != nil {
+			log.Println("Couldn't reload TLS certificate; keeping the old one")
+			log.Println(err)
+		} else {
+			log.Println("Reloaded TLS certificate")
+		}
+	}
+}
+
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, errors.New("tls_client_auth must be none, optional or require")
+}
+
+func newTLSConfig(settings *Settings, reloader *certReloader) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	authType, err := clientAuthType(settings.TLSClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = authType
+	if authType != tls.NoClientCert {
+		pem, err := ioutil.ReadFile(settings.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + settings.TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
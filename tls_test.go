@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type TLSSuite struct {
+	dir string
+}
+
+var _ = Suite(&TLSSuite{})
+
+func (self *TLSSuite) SetUpTest(c *C) {
+	self.dir = c.MkDir()
+}
+
+func (self *TLSSuite) writeCert(c *C, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	certFile := filepath.Join(self.dir, "cert.pem")
+	keyFile := filepath.Join(self.dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	c.Assert(err, IsNil)
+	return certFile, keyFile
+}
+
+func currentCommonName(c *C, reloader *certReloader) string {
+	cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, IsNil)
+	return leaf.Subject.CommonName
+}
+
+func (self *TLSSuite) TestReloadOnChange(c *C) {
+	certFile, keyFile := self.writeCert(c, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	c.Assert(err, IsNil)
+	c.Assert(currentCommonName(c, reloader), Equals, "first")
+	c.Assert(reloader.changed(), Equals, false)
+
+	self.writeCert(c, "second")
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(certFile, later, later), IsNil)
+	c.Assert(reloader.changed(), Equals, true)
+
+	stop := make(chan bool)
+	go reloader.watch(10*time.Millisecond, stop)
+	defer close(stop)
+	for i := 0; i < 100 && currentCommonName(c, reloader) != "second"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(currentCommonName(c, reloader), Equals, "second")
+}
+
+func (self *TLSSuite) TestBadCertKeepsOldOne(c *C) {
+	certFile, keyFile := self.writeCert(c, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	c.Assert(err, IsNil)
+	c.Assert(reloader.reload(), NotNil)
+	c.Assert(currentCommonName(c, reloader), Equals, "first")
+}
+
+func (self *TLSSuite) TestClientAuthNeedsCA(c *C) {
+	certFile, keyFile := self.writeCert(c, "server")
+	_, _, err := LoadSettings("test", []string{"-tls-cert", certFile, "-tls-key", keyFile, "-tls-client-auth", "require"})
+	c.Assert(err, NotNil)
+	_, _, err = LoadSettings("test", []string{"-tls-cert", certFile})
+	c.Assert(err, NotNil)
+}